@@ -0,0 +1,254 @@
+package proxydialer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const accessLogTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+// accessLogger appends the requests and tunnels once they are done, in the Apache combined format
+// followed by the upstream, the bytes received from the client and the duration
+type accessLogger struct {
+	mu   sync.Mutex
+	file io.WriteCloser
+}
+
+// accessLog is the access log of the running server, nil when disabled
+var accessLog atomic.Pointer[accessLogger]
+
+func openAccessLog(path string, rotate RotateConf) (*accessLogger, error) {
+	file, err := openAppendFile(path, rotate)
+	if err != nil {
+		return nil, err
+	}
+	return &accessLogger{file: file}, nil
+}
+
+func (l *accessLogger) write(line string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	io.WriteString(l.file, line)
+}
+
+func (l *accessLogger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
+
+// Requests kept for the admin API
+const recentRequestsSize = 100
+
+// recentRequest is a request or tunnel done, as listed by the admin API
+type recentRequest struct {
+	Time     time.Time `json:"time"`
+	Client   string    `json:"client"`
+	User     string    `json:"user,omitempty"`
+	Method   string    `json:"method"`
+	Target   string    `json:"target"`
+	Protocol string    `json:"protocol"`
+	Status   int       `json:"status"`
+	Sent     int64     `json:"sent"`
+	Received int64     `json:"received"`
+	Upstream string    `json:"upstream,omitempty"`
+	Duration float64   `json:"duration_seconds"`
+}
+
+// requestHistory keeps the last requests done while the admin API is enabled
+type requestHistory struct {
+	enabled atomic.Bool
+	mu      sync.Mutex
+	entries []recentRequest
+	next    int
+}
+
+var recentRequests = &requestHistory{}
+
+func (h *requestHistory) add(request recentRequest) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.entries) < recentRequestsSize {
+		h.entries = append(h.entries, request)
+		return
+	}
+	h.entries[h.next] = request
+	h.next = (h.next + 1) % recentRequestsSize
+}
+
+// list returns the requests, the most recent first
+func (h *requestHistory) list() []recentRequest {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	requests := make([]recentRequest, 0, len(h.entries))
+	for i := len(h.entries) - 1; i >= 0; i-- {
+		requests = append(requests, h.entries[(h.next+i)%len(h.entries)])
+	}
+	return requests
+}
+
+// accessEntry is a request or tunnel being served, nil when neither the access log, the admin API, tracing nor accounting is enabled
+type accessEntry struct {
+	logger    *accessLogger
+	span      *span
+	start     time.Time
+	client    string
+	user      string
+	method    string
+	target    string
+	protocol  string
+	referer   string
+	userAgent string
+	upstream  atomic.Pointer[string]
+}
+
+// newAccessEntry starts the entry and the span of a request, protocol is the HTTP version or the kind of tunnel,
+// the returned context carries the span to the dial
+func newAccessEntry(ctx context.Context, method, target, protocol string) (context.Context, *accessEntry) {
+	logger := accessLog.Load()
+	if logger == nil && !recentRequests.enabled.Load() && spanTracer.Load() == nil && !clientAccounts.enabled.Load() && !hasEventHandlers() {
+		return ctx, nil
+	}
+	e := &accessEntry{
+		logger:   logger,
+		start:    time.Now(),
+		client:   getClientIP(ctx),
+		user:     getUser(ctx),
+		method:   method,
+		target:   target,
+		protocol: protocol,
+	}
+	ctx, e.span = startSpan(ctx, method, SPAN_KIND_SERVER)
+	e.span.setAttribute("proxydialer.target", target)
+	e.span.setAttribute("proxydialer.protocol", protocol)
+	e.span.setAttribute("client.address", e.client)
+	if e.user != "" {
+		e.span.setAttribute("enduser.id", e.user)
+	}
+	return ctx, e
+}
+
+// newRequestAccessEntry starts the entry of a request received by the HTTP proxy
+func newRequestAccessEntry(r *http.Request) (context.Context, *accessEntry) {
+	target := r.Host
+	if r.Method != http.MethodConnect {
+		target = r.URL.String()
+	}
+	ctx, e := newAccessEntry(withTraceParent(r.Context(), r.Header), r.Method, target, r.Proto)
+	if e != nil {
+		e.referer = r.Referer()
+		e.userAgent = r.UserAgent()
+	}
+	return ctx, e
+}
+
+// startSpan starts a span of the request, e.g. the transfer of a tunnel
+func (e *accessEntry) startSpan(name string) *span {
+	if e == nil {
+		return nil
+	}
+	return e.span.startChild(name, SPAN_KIND_INTERNAL)
+}
+
+// setUpstream records the proxy a connection was dialed through
+func (e *accessEntry) setUpstream(conn net.Conn) {
+	if e == nil {
+		return
+	}
+	if metered, ok := getMeteredConn(conn); ok {
+		e.upstream.Store(&metered.upstream)
+	}
+}
+
+func quoteAccessField(value string) string {
+	if value == "" {
+		return `"-"`
+	}
+	return strconv.Quote(value)
+}
+
+// finish writes the entry, keeps it for the admin API and ends its span, sent are the bytes sent to the client and received the ones received from it
+func (e *accessEntry) finish(status int, sent, received int64) {
+	if e == nil {
+		return
+	}
+	client := e.client
+	if client == "" {
+		client = "-"
+	}
+	user := e.user
+	if user == "" {
+		user = "-"
+	}
+	upstream := ""
+	if name := e.upstream.Load(); name != nil {
+		upstream = *name
+	}
+	duration := time.Since(e.start)
+	e.span.setAttribute("http.response.status_code", status)
+	if upstream != "" {
+		e.span.setAttribute("proxydialer.upstream", upstream)
+	}
+	e.span.setAttribute("proxydialer.sent_bytes", sent)
+	e.span.setAttribute("proxydialer.received_bytes", received)
+	if status >= http.StatusInternalServerError {
+		e.span.setError(errors.New(http.StatusText(status)))
+	}
+	e.span.finish()
+	if clientAccounts.enabled.Load() {
+		clientAccounts.add(e.client, e.user, sent, received)
+	}
+	if recentRequests.enabled.Load() {
+		recentRequests.add(recentRequest{
+			Time:     e.start,
+			Client:   e.client,
+			User:     e.user,
+			Method:   e.method,
+			Target:   e.target,
+			Protocol: e.protocol,
+			Status:   status,
+			Sent:     sent,
+			Received: received,
+			Upstream: upstream,
+			Duration: duration.Seconds(),
+		})
+	}
+	if e.logger == nil {
+		return
+	}
+	request := strings.Join([]string{e.method, e.target, e.protocol}, " ")
+	e.logger.write(fmt.Sprintf("%s - %s [%s] %s %d %d %s %s %s %d %.3f\n",
+		client, user, e.start.Format(accessLogTimeFormat), strconv.Quote(request), status, sent,
+		quoteAccessField(e.referer), quoteAccessField(e.userAgent), quoteAccessField(upstream),
+		received, duration.Seconds()))
+}
+
+// countingReader counts the bytes of a request body or of a side of a tunnel
+type countingReader struct {
+	io.ReadCloser
+	n atomic.Int64
+	// time in nanoseconds bytes were last read at
+	last atomic.Int64
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	r.add(int64(n))
+	return n, err
+}
+
+func (r *countingReader) add(n int64) {
+	if n > 0 {
+		r.n.Add(n)
+		r.last.Store(time.Now().UnixNano())
+	}
+}
@@ -0,0 +1,155 @@
+package proxydialer
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const DEFAULT_ACCOUNTING_SAVE_INTERVAL = time.Minute
+
+// AccountingConf counts the traffic of every client, by user when authenticated and otherwise by IP
+type AccountingConf struct {
+	Enabled bool `yaml:"enabled"`
+	// JSON file the counters are kept in across restarts, only in memory when empty
+	File string `yaml:"file"`
+	// How often the counters are written to the file, default "1m"
+	SaveInterval time.Duration `yaml:"save_interval"`
+}
+
+// clientUsage is the traffic of a client since the counters were started
+type clientUsage struct {
+	// Last IP of a user
+	Client   string    `json:"client"`
+	User     string    `json:"user,omitempty"`
+	Requests uint64    `json:"requests"`
+	Sent     int64     `json:"sent"`
+	Received int64     `json:"received"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// usageAccounts are kept for the lifetime of the process, across reloads
+type usageAccounts struct {
+	enabled atomic.Bool
+	mu      sync.Mutex
+	clients map[string]*clientUsage
+	// file the counters were loaded from and are saved to, none when empty
+	file string
+}
+
+var clientAccounts = &usageAccounts{clients: make(map[string]*clientUsage)}
+
+// add counts a request or tunnel done, sent are the bytes sent to the client and received the ones received from it
+func (a *usageAccounts) add(client, user string, sent, received int64) {
+	key := client
+	if user != "" {
+		key = "user:" + user
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	usage, ok := a.clients[key]
+	if !ok {
+		usage = &clientUsage{User: user}
+		a.clients[key] = usage
+	}
+	usage.Client = client
+	usage.Requests++
+	usage.Sent += sent
+	usage.Received += received
+	usage.LastSeen = time.Now()
+}
+
+// list returns the clients, the ones with the most traffic first
+func (a *usageAccounts) list() []clientUsage {
+	a.mu.Lock()
+	clients := make([]clientUsage, 0, len(a.clients))
+	for _, usage := range a.clients {
+		clients = append(clients, *usage)
+	}
+	a.mu.Unlock()
+	slices.SortFunc(clients, func(x, y clientUsage) int {
+		return cmp.Compare(y.Sent+y.Received, x.Sent+x.Received)
+	})
+	return clients
+}
+
+// load reads the counters of the previous runs, once per file so that a reload doesn't go back in time
+func (a *usageAccounts) load(file string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file == file {
+		return nil
+	}
+	a.file = file
+	data, err := os.ReadFile(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	clients := make(map[string]*clientUsage)
+	if err := json.Unmarshal(data, &clients); err != nil {
+		return err
+	}
+	a.clients = clients
+	return nil
+}
+
+// save writes the counters to a temporary file renamed over the file, so that a crash leaves the previous ones
+func (a *usageAccounts) save() error {
+	a.mu.Lock()
+	file := a.file
+	data, err := json.MarshalIndent(a.clients, "", "  ")
+	a.mu.Unlock()
+	if err != nil || file == "" {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// saveLogged saves the counters and logs the failure
+func (a *usageAccounts) saveLogged() {
+	if err := a.save(); err != nil {
+		slog.Error("Cannot save the client traffic", "err", err)
+	}
+}
+
+// run saves the counters every interval until done is closed, and a last time then
+func (a *usageAccounts) run(interval time.Duration, done chan struct{}) {
+	if interval <= 0 {
+		interval = DEFAULT_ACCOUNTING_SAVE_INTERVAL
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			a.saveLogged()
+			return
+		case <-ticker.C:
+			a.saveLogged()
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package proxydialer
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+)
+
+// clientACL decides which client IPs may use a listener, deny entries take precedence
+// and only the allowed IPs are accepted when there are allow entries
+type clientACL struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// newClientACL returns nil when the listener accepts every client
+func newClientACL(conf DialerConfig) (*clientACL, error) {
+	if len(conf.Allow) == 0 && len(conf.Deny) == 0 {
+		return nil, nil
+	}
+	allow, err := parseNets(conf.Allow)
+	if err != nil {
+		return nil, fmt.Errorf("allow: %w", err)
+	}
+	deny, err := parseNets(conf.Deny)
+	if err != nil {
+		return nil, fmt.Errorf("deny: %w", err)
+	}
+	return &clientACL{allow: allow, deny: deny}, nil
+}
+
+func (acl *clientACL) isAllowed(ip net.IP) bool {
+	if containsIP(acl.deny, ip) {
+		return false
+	}
+	return len(acl.allow) == 0 || containsIP(acl.allow, ip)
+}
+
+// isAllowedAddr checks the IP of a client address, clients of unix sockets have none and are allowed
+func (acl *clientACL) isAllowedAddr(addr net.Addr) bool {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return acl.isAllowed(addr.IP)
+	case *net.UDPAddr:
+		return acl.isAllowed(addr.IP)
+	}
+	return true
+}
+
+// aclListener closes the connections of denied clients as soon as they are accepted
+type aclListener struct {
+	net.Listener
+	acl *clientACL
+}
+
+func (l *aclListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if l.acl.isAllowedAddr(conn.RemoteAddr()) {
+			return conn, nil
+		}
+		slog.Warn("Denied by the client ACL", "client", conn.RemoteAddr().String(), "listener", l.Addr().String())
+		conn.Close()
+	}
+}
+
+// aclPacketConn drops the datagrams of denied clients
+type aclPacketConn struct {
+	net.PacketConn
+	acl *clientACL
+}
+
+func (c *aclPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(p)
+		if err != nil || c.acl.isAllowedAddr(addr) {
+			return n, addr, err
+		}
+		slog.Warn("Denied by the client ACL", "client", addr.String(), "listener", c.LocalAddr().String())
+	}
+}
+
+// withACL applies the ACL to a listener, nothing to do without ACL
+func withACL(listener net.Listener, acl *clientACL) net.Listener {
+	if acl == nil {
+		return listener
+	}
+	return &aclListener{Listener: listener, acl: acl}
+}
@@ -0,0 +1,368 @@
+package proxydialer
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"net/url"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// AdminConf is the HTTP API controlling the running server
+type AdminConf struct {
+	// Address of the API, e.g. "127.0.0.1:9090", disabled when not set
+	Listen string `yaml:"listen"`
+	// Bearer token required by every request, none when empty
+	Token string `yaml:"token" secret:"true"`
+	// Serve the profiles of net/http/pprof at /debug/pprof/
+	Pprof bool `yaml:"pprof"`
+}
+
+// validate requires a token when the API can be reached from other hosts
+func (conf AdminConf) validate() error {
+	if conf.Listen == "" || conf.Token != "" {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(conf.Listen)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("a token is required to listen on %s, which isn't a loopback address", conf.Listen)
+	}
+	return nil
+}
+
+var startTime = time.Now()
+
+// adminAPI answers the requests of the admin API about the server started with config
+type adminAPI struct {
+	config  Config
+	dialers map[string]proxy.Dialer
+	// asks the main loop to read the configuration file again
+	reload func()
+}
+
+type proxyTraffic struct {
+	Received    uint64 `json:"received"`
+	Sent        uint64 `json:"sent"`
+	Connections uint64 `json:"connections"`
+	Open        int64  `json:"open"`
+	DialErrors  uint64 `json:"dial_errors"`
+}
+
+type proxyStatus struct {
+	Name     string `json:"name"`
+	Protocol string `json:"protocol"`
+	Address  string `json:"address"`
+	Use      bool   `json:"use"`
+	// "up", "down", "circuit open", "cooling down" or "unused" when no balancer sends traffic through it
+	State     string       `json:"state"`
+	LatencyMs int64        `json:"latency_ms,omitempty"`
+	Selected  bool         `json:"selected"`
+	Traffic   proxyTraffic `json:"traffic"`
+}
+
+// findBalancers returns the balancers behind the wrappers of a dialer
+func findBalancers(dialer proxy.Dialer) []*balancer {
+	switch d := dialer.(type) {
+	case *balancer:
+		return []*balancer{d}
+	case *router:
+		return findBalancers(d.upstream)
+	case *fallbackDialer:
+		return findBalancers(d.upstream)
+	}
+	return nil
+}
+
+func (s *adminAPI) getBalancers() []*balancer {
+	var balancers []*balancer
+	for _, dialer := range s.dialers {
+		balancers = append(balancers, findBalancers(dialer)...)
+	}
+	return balancers
+}
+
+func getTraffic(name string) proxyTraffic {
+	stats := metrics.getUpstream(name)
+	return proxyTraffic{
+		Received:    stats.received.Load(),
+		Sent:        stats.sent.Load(),
+		Connections: stats.connections.Load(),
+		Open:        stats.open.Load(),
+		DialErrors:  stats.dialErrors.Load(),
+	}
+}
+
+func (s *adminAPI) getProxies() []proxyStatus {
+	balancers := s.getBalancers()
+	proxies := make([]proxyStatus, 0, len(s.config.Proxies))
+	for _, conf := range s.config.Proxies {
+		status := proxyStatus{
+			Name:     conf.getName(),
+			Protocol: string(conf.Protocol),
+			Address:  conf.getProxyAddr(),
+			Use:      conf.Use,
+			State:    "unused",
+			Traffic:  getTraffic(conf.getName()),
+		}
+		for _, b := range balancers {
+			for _, u := range b.upstreams {
+				if u.getName() != status.Name {
+					continue
+				}
+				switch {
+				case u.down.Load():
+					status.State = "down"
+				case u.isCircuitOpen():
+					status.State = "circuit open"
+				case u.isCoolingDown():
+					status.State = "cooling down"
+				default:
+					status.State = "up"
+				}
+				status.LatencyMs = time.Duration(u.latency.Load()).Milliseconds()
+				status.Selected = status.Selected || b.forced.Load() == u
+			}
+		}
+		proxies = append(proxies, status)
+	}
+	return proxies
+}
+
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+func (s *adminAPI) handleStatus(w http.ResponseWriter, r *http.Request) {
+	var listeners []string
+	for _, listener := range s.config.Dialer {
+		for _, port := range []int{listener.Port, listener.SocksPort, listener.MuxPort, listener.TransparentPort, listener.DNSPort} {
+			if port != 0 {
+				listeners = append(listeners, net.JoinHostPort(listener.Server, strconv.Itoa(port)))
+			}
+		}
+		if listener.Socket != "" {
+			listeners = append(listeners, listener.Socket)
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"config_file":    getConfigFile(),
+		"uptime_seconds": int64(time.Since(startTime).Seconds()),
+		"listeners":      listeners,
+		"active_tunnels": metrics.activeTunnels.Load(),
+		"reloads":        metrics.reloads.Load(),
+		"goroutines":     runtime.NumGoroutine(),
+	})
+}
+
+func (s *adminAPI) handleProxies(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.getProxies())
+}
+
+func (s *adminAPI) handleConnections(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"active":  metrics.activeTunnels.Load(),
+		"tunnels": openTunnels.list(),
+	})
+}
+
+// handleCloseConnection drops a tunnel, e.g. a stuck one
+func (s *adminAPI) handleCloseConnection(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid id: "+r.PathValue("id"))
+		return
+	}
+	tunnel, ok := openTunnels.close(id)
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "no open tunnel: "+r.PathValue("id"))
+		return
+	}
+	slog.Info("Tunnel closed through the admin API", "client", tunnel.client, "address", tunnel.target)
+	writeJSON(w, http.StatusOK, map[string]uint64{"closed": id})
+}
+
+func (s *adminAPI) handleTraffic(w http.ResponseWriter, r *http.Request) {
+	traffic := make(map[string]proxyTraffic)
+	metrics.mu.Lock()
+	names := make([]string, 0, len(metrics.upstreams))
+	for name := range metrics.upstreams {
+		names = append(names, name)
+	}
+	metrics.mu.Unlock()
+	for _, name := range names {
+		traffic[name] = getTraffic(name)
+	}
+	writeJSON(w, http.StatusOK, traffic)
+}
+
+func (s *adminAPI) handleReload(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusAccepted, map[string]string{"status": "reloading"})
+	go s.reload()
+}
+
+// handleSelect sends every connection through a proxy of the balancers, or lets them choose again
+// when the name is empty, until the next reload
+func (s *adminAPI) handleSelect(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Proxy string `json:"proxy"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	selected := false
+	for _, b := range s.getBalancers() {
+		if b.selectUpstream(body.Proxy) {
+			selected = true
+		}
+	}
+	if !selected {
+		writeJSONError(w, http.StatusNotFound, "proxy not used: "+body.Proxy)
+		return
+	}
+	if body.Proxy == "" {
+		slog.Info("Automatic proxy selection restored")
+	} else {
+		slog.Info("Proxy selected through the admin API", "proxy", body.Proxy)
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"proxy": body.Proxy})
+}
+
+// checkOrigin refuses the requests changing the server sent by the pages of other sites, through the browser
+// of a user who can reach the API, which tell their origin
+func checkOrigin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			if origin := r.Header.Get("Origin"); origin != "" {
+				if u, err := url.Parse(origin); err != nil || u.Host != r.Host {
+					writeJSONError(w, http.StatusForbidden, "cross-origin request")
+					return
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// checkHost refuses the requests to another host than the API when no token is required, like the ones of
+// a page whose domain was rebound to a loopback address, which could otherwise drive and read the API
+func (s *adminAPI) checkHost(next http.Handler) http.Handler {
+	if s.config.Admin.Token != "" {
+		return next
+	}
+	listenHost, _, _ := net.SplitHostPort(s.config.Admin.Listen)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+		ip := net.ParseIP(host)
+		if !strings.EqualFold(host, "localhost") && host != listenHost && (ip == nil || !ip.IsLoopback()) {
+			writeJSONError(w, http.StatusForbidden, "unknown host")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authorize checks the bearer token of the requests when one is configured
+func (s *adminAPI) authorize(next http.Handler) http.Handler {
+	if s.config.Admin.Token == "" {
+		return next
+	}
+	expected := []byte("Bearer " + s.config.Admin.Token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			writeJSONError(w, http.StatusUnauthorized, "invalid token")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *adminAPI) handleClients(w http.ResponseWriter, r *http.Request) {
+	if !clientAccounts.enabled.Load() {
+		writeJSONError(w, http.StatusNotFound, "accounting is disabled")
+		return
+	}
+	writeJSON(w, http.StatusOK, clientAccounts.list())
+}
+
+func (s *adminAPI) handleRequests(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, recentRequests.list())
+}
+
+// getHandler serves the API, the dashboard, which holds no data, and the probes, which don't require the token
+func (s *adminAPI) getHandler() http.Handler {
+	api := http.NewServeMux()
+	api.HandleFunc("GET /api/status", s.handleStatus)
+	api.HandleFunc("GET /api/proxies", s.handleProxies)
+	api.HandleFunc("GET /api/connections", s.handleConnections)
+	api.HandleFunc("DELETE /api/connections/{id}", s.handleCloseConnection)
+	api.HandleFunc("GET /api/traffic", s.handleTraffic)
+	api.HandleFunc("GET /api/requests", s.handleRequests)
+	api.HandleFunc("GET /api/clients", s.handleClients)
+	api.HandleFunc("POST /api/reload", s.handleReload)
+	api.HandleFunc("POST /api/select", s.handleSelect)
+
+	mux := http.NewServeMux()
+	mux.Handle("/api/", s.checkHost(checkOrigin(s.authorize(api))))
+	if s.config.Admin.Pprof {
+		profiles := http.NewServeMux()
+		profiles.HandleFunc("/debug/pprof/", pprof.Index)
+		profiles.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		profiles.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		profiles.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		profiles.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		mux.Handle("/debug/pprof/", s.checkHost(s.authorize(profiles)))
+	}
+	mux.HandleFunc("GET /{$}", handleDashboard)
+	newProbes(&s.config).register(mux)
+	return mux
+}
+
+// startAdminServer serves the admin API until the returned server is shut down
+func startAdminServer(s *adminAPI) (*http.Server, error) {
+	listener, err := sharedListeners.listenTCP(s.config.Admin.Listen)
+	if err != nil {
+		return nil, err
+	}
+	server := &http.Server{Handler: s.getHandler()}
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Admin server", "err", err)
+		}
+	}()
+	slog.Info("Admin API is served", "address", "http://"+listener.Addr().String()+"/api/", "dashboard", "http://"+listener.Addr().String()+"/")
+	return server, nil
+}
+
+// stopAdminServer lets the response to a reload request be sent before closing the server
+func stopAdminServer(server *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if server.Shutdown(ctx) != nil {
+		server.Close()
+	}
+}
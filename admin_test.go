@@ -0,0 +1,86 @@
+package proxydialer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminConfValidate(t *testing.T) {
+	tests := []struct {
+		conf    AdminConf
+		wantErr bool
+	}{
+		{AdminConf{}, false},
+		{AdminConf{Listen: "127.0.0.1:9090"}, false},
+		{AdminConf{Listen: "[::1]:9090"}, false},
+		{AdminConf{Listen: "localhost:9090"}, false},
+		{AdminConf{Listen: "0.0.0.0:9090"}, true},
+		{AdminConf{Listen: ":9090"}, true},
+		{AdminConf{Listen: "0.0.0.0:9090", Token: "secret"}, false},
+		{AdminConf{Listen: "9090"}, true},
+	}
+	for _, test := range tests {
+		if err := test.conf.validate(); (err != nil) != test.wantErr {
+			t.Errorf("validate(%+v) = %v, want error %t", test.conf, err, test.wantErr)
+		}
+	}
+}
+
+func TestAdminAccess(t *testing.T) {
+	tests := []struct {
+		name   string
+		listen string
+		token  string
+		method string
+		path   string
+		host   string
+		header map[string]string
+		want   int
+	}{
+		{"loopback", "127.0.0.1:9090", "", "GET", "/api/requests", "127.0.0.1:9090", nil, http.StatusOK},
+		{"localhost", "127.0.0.1:9090", "", "GET", "/api/requests", "localhost:9090", nil, http.StatusOK},
+		{"ipv6 loopback", "127.0.0.1:9090", "", "GET", "/api/requests", "[::1]:9090", nil, http.StatusOK},
+		{"listen address", "192.0.2.1:9090", "secret", "GET", "/api/requests", "192.0.2.1:9090",
+			map[string]string{"Authorization": "Bearer secret"}, http.StatusOK},
+		{"rebound domain", "127.0.0.1:9090", "", "GET", "/api/requests", "evil.example:9090", nil, http.StatusForbidden},
+		{"rebound reload", "127.0.0.1:9090", "", "POST", "/api/reload", "evil.example:9090",
+			map[string]string{"Origin": "http://evil.example:9090"}, http.StatusForbidden},
+		{"valid token", "0.0.0.0:9090", "secret", "GET", "/api/requests", "proxy.example:9090",
+			map[string]string{"Authorization": "Bearer secret"}, http.StatusOK},
+		{"missing token", "0.0.0.0:9090", "secret", "GET", "/api/requests", "proxy.example:9090", nil, http.StatusUnauthorized},
+		{"wrong token", "0.0.0.0:9090", "secret", "GET", "/api/requests", "proxy.example:9090",
+			map[string]string{"Authorization": "Bearer other"}, http.StatusUnauthorized},
+		{"basic credentials", "0.0.0.0:9090", "secret", "GET", "/api/requests", "proxy.example:9090",
+			map[string]string{"Authorization": "Basic c2VjcmV0"}, http.StatusUnauthorized},
+		{"no origin", "127.0.0.1:9090", "", "POST", "/api/reload", "127.0.0.1:9090", nil, http.StatusAccepted},
+		{"same origin", "127.0.0.1:9090", "", "POST", "/api/reload", "127.0.0.1:9090",
+			map[string]string{"Origin": "http://127.0.0.1:9090"}, http.StatusAccepted},
+		{"cross origin", "127.0.0.1:9090", "", "POST", "/api/reload", "127.0.0.1:9090",
+			map[string]string{"Origin": "http://evil.example"}, http.StatusForbidden},
+		{"cross origin with token", "0.0.0.0:9090", "secret", "POST", "/api/reload", "proxy.example:9090",
+			map[string]string{"Origin": "http://evil.example", "Authorization": "Bearer secret"}, http.StatusForbidden},
+		{"invalid origin", "127.0.0.1:9090", "", "POST", "/api/reload", "127.0.0.1:9090",
+			map[string]string{"Origin": "://"}, http.StatusForbidden},
+		{"cross origin read", "127.0.0.1:9090", "", "GET", "/api/requests", "127.0.0.1:9090",
+			map[string]string{"Origin": "http://evil.example"}, http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := &adminAPI{
+				config: Config{Admin: AdminConf{Listen: test.listen, Token: test.token}},
+				reload: func() {},
+			}
+			r := httptest.NewRequest(test.method, test.path, nil)
+			r.Host = test.host
+			for key, value := range test.header {
+				r.Header.Set(key, value)
+			}
+			w := httptest.NewRecorder()
+			s.getHandler().ServeHTTP(w, r)
+			if w.Code != test.want {
+				t.Errorf("%s %s from %s: status %d, want %d", test.method, test.path, test.host, w.Code, test.want)
+			}
+		})
+	}
+}
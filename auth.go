@@ -0,0 +1,136 @@
+package proxydialer
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/proxy"
+)
+
+const PROXY_AUTH_REALM = "proxydialer"
+
+// UserConf is a user allowed to use the local proxy
+type UserConf struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password" secret:"true"`
+	// Names of the proxies the traffic of the user is sent through instead of the ones of the listener
+	Proxies []string `yaml:"proxies"`
+}
+
+// authenticator checks the credentials of the clients of a listener
+type authenticator struct {
+	users map[string]string
+
+	// users of the users file, reloaded when it is modified
+	usersFile string
+	watcher   *configWatcher
+	done      chan struct{}
+	mu        sync.RWMutex
+	hashes    map[string][]byte
+	// keyed hashes of the passwords verified against the hashes, by user
+	verified    map[string][]byte
+	verifiedKey []byte
+}
+
+// newAuthenticator returns nil when the listener doesn't require authentication
+func newAuthenticator(conf DialerConfig) (*authenticator, error) {
+	users := make(map[string]string)
+	if conf.Username != "" {
+		users[conf.Username] = conf.Password
+	}
+	for _, user := range conf.Users {
+		users[user.Username] = user.Password
+	}
+	if len(users) == 0 && conf.UsersFile == "" {
+		return nil, nil
+	}
+	a := &authenticator{users: users, usersFile: conf.UsersFile}
+	if a.usersFile != "" {
+		if err := a.loadUsersFile(); err != nil {
+			return nil, fmt.Errorf("users file: %w", err)
+		}
+	}
+	return a, nil
+}
+
+func (a *authenticator) check(username, password string) bool {
+	expected, ok := a.users[username]
+	if !ok && a.usersFile != "" {
+		return a.checkUsersFile(username, password)
+	}
+	if !ok {
+		// compare anyway so that unknown users take as long as wrong passwords
+		expected = password + "-"
+	}
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(password)) == 1 && ok
+}
+
+// checkRequest verifies the Basic credentials of the Proxy-Authorization header
+func (a *authenticator) checkRequest(r *http.Request) (string, bool) {
+	scheme, encoded, found := strings.Cut(r.Header.Get("Proxy-Authorization"), " ")
+	if !found || !strings.EqualFold(scheme, "Basic") {
+		return "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return "", false
+	}
+	username, password, found := strings.Cut(string(decoded), ":")
+	if !found || !a.check(username, password) {
+		return username, false
+	}
+	return username, true
+}
+
+// authorizeRequest answers 407 Proxy Authentication Required unless the client sent valid credentials,
+// which are removed from the request so that they aren't forwarded
+func (a *authenticator) authorizeRequest(w http.ResponseWriter, r *http.Request) (string, bool) {
+	username, ok := a.checkRequest(r)
+	if !ok {
+		if username != "" {
+			slog.Warn("Invalid credentials", "client", r.RemoteAddr, "method", r.Method, "url", r.URL.String(), "user", username)
+		}
+		w.Header().Set("Proxy-Authenticate", `Basic realm="`+PROXY_AUTH_REALM+`"`)
+		http.Error(w, "Proxy Authentication Required", http.StatusProxyAuthRequired)
+		return "", false
+	}
+	r.Header.Del("Proxy-Authorization")
+	return username, true
+}
+
+type userKey struct{}
+
+// withUser stores the authenticated user a connection is dialed for
+func withUser(ctx context.Context, username string) context.Context {
+	return context.WithValue(ctx, userKey{}, username)
+}
+
+// getUser returns the authenticated user a connection is dialed for, empty if unknown
+func getUser(ctx context.Context) string {
+	username, _ := ctx.Value(userKey{}).(string)
+	return username
+}
+
+// userDialer dials through the proxies of the authenticated user, or the ones of the listener
+type userDialer struct {
+	dialer proxy.Dialer
+	users  map[string]proxy.Dialer
+}
+
+func (d *userDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+func (d *userDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if dialer, ok := d.users[getUser(ctx)]; ok {
+		return dialContext(ctx, dialer, network, address)
+	}
+	return dialContext(ctx, d.dialer, network, address)
+}
@@ -0,0 +1,110 @@
+package proxydialer
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newTestAuthenticator(t *testing.T) *authenticator {
+	t.Helper()
+	auth, err := newAuthenticator(DialerConfig{
+		Username: "alice",
+		Password: "secret",
+		Users:    []UserConf{{Username: "bob", Password: "p:ss word"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return auth
+}
+
+func TestNewAuthenticatorDisabled(t *testing.T) {
+	auth, err := newAuthenticator(DialerConfig{})
+	if err != nil || auth != nil {
+		t.Fatalf("newAuthenticator without users = %v, %v, want nil", auth, err)
+	}
+}
+
+func TestAuthenticatorCheck(t *testing.T) {
+	auth := newTestAuthenticator(t)
+	tests := []struct {
+		username string
+		password string
+		want     bool
+	}{
+		{"alice", "secret", true},
+		{"bob", "p:ss word", true},
+		{"alice", "wrong", false},
+		{"alice", "", false},
+		{"alice", "secret-", false},
+		{"bob", "secret", false},
+		{"carol", "secret", false},
+		{"carol", "", false},
+		{"", "", false},
+	}
+	for _, test := range tests {
+		if got := auth.check(test.username, test.password); got != test.want {
+			t.Errorf("check(%q, %q) = %t, want %t", test.username, test.password, got, test.want)
+		}
+	}
+}
+
+func basicAuth(credentials string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(credentials))
+}
+
+func TestAuthorizeRequest(t *testing.T) {
+	auth := newTestAuthenticator(t)
+	tests := []struct {
+		name   string
+		header string
+		user   string
+		ok     bool
+	}{
+		{"valid", basicAuth("alice:secret"), "alice", true},
+		{"password with colon", basicAuth("bob:p:ss word"), "bob", true},
+		{"lowercase scheme", "basic " + base64.StdEncoding.EncodeToString([]byte("alice:secret")), "alice", true},
+		{"spaces", "Basic  " + base64.StdEncoding.EncodeToString([]byte("alice:secret")) + " ", "alice", true},
+		{"missing", "", "", false},
+		{"wrong password", basicAuth("alice:wrong"), "", false},
+		{"unknown user", basicAuth("carol:secret"), "", false},
+		{"no colon", basicAuth("alice"), "", false},
+		{"invalid base64", "Basic !!!", "", false},
+		{"other scheme", "Bearer " + base64.StdEncoding.EncodeToString([]byte("alice:secret")), "", false},
+		{"no credentials", "Basic", "", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+			if test.header != "" {
+				r.Header.Set("Proxy-Authorization", test.header)
+			}
+			r.Header.Set("Authorization", "Bearer origin")
+			w := httptest.NewRecorder()
+			user, ok := auth.authorizeRequest(w, r)
+			if user != test.user || ok != test.ok {
+				t.Fatalf("authorizeRequest = %q, %t, want %q, %t", user, ok, test.user, test.ok)
+			}
+			if r.Header.Get("Authorization") != "Bearer origin" {
+				t.Errorf("Authorization = %q, the credentials of the origin must be kept", r.Header.Get("Authorization"))
+			}
+			if ok {
+				if got := r.Header.Get("Proxy-Authorization"); got != "" {
+					t.Errorf("Proxy-Authorization = %q, want it removed", got)
+				}
+				if w.Code != http.StatusOK || len(w.Header()) != 0 {
+					t.Errorf("response written for an authorized request: %d %v", w.Code, w.Header())
+				}
+				return
+			}
+			if w.Code != http.StatusProxyAuthRequired {
+				t.Errorf("status %d, want %d", w.Code, http.StatusProxyAuthRequired)
+			}
+			if got, want := w.Header().Get("Proxy-Authenticate"), `Basic realm="`+PROXY_AUTH_REALM+`"`; got != want {
+				t.Errorf("Proxy-Authenticate = %q, want %q", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,542 @@
+package proxydialer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+const (
+	BALANCE_ROUND_ROBIN = "round-robin"
+	BALANCE_FAILOVER    = "failover"
+	BALANCE_URL_TEST    = "url-test"
+	BALANCE_WEIGHTED    = "weighted"
+	BALANCE_CONSISTENT  = "consistent-hash"
+)
+
+const (
+	DEFAULT_FAILOVER_COOLDOWN = 30 * time.Second
+	DEFAULT_FAILOVER_TIMEOUT  = 10 * time.Second
+	DEFAULT_PROBE_URL         = "http://www.gstatic.com/generate_204"
+	DEFAULT_PROBE_INTERVAL    = 5 * time.Minute
+	DEFAULT_PROBE_TOLERANCE   = 50 * time.Millisecond
+	DEFAULT_STICKY_TTL        = 10 * time.Minute
+	DEFAULT_BREAKER_BACKOFF   = 30 * time.Second
+)
+
+var supportedStrategies = map[string]bool{
+	BALANCE_ROUND_ROBIN: true,
+	BALANCE_FAILOVER:    true,
+	BALANCE_URL_TEST:    true,
+	BALANCE_WEIGHTED:    true,
+	BALANCE_CONSISTENT:  true,
+}
+
+// errCircuitOpen fails the dials through a proxy whose circuit breaker is open
+var errCircuitOpen = errors.New("circuit open")
+
+// Points of every upstream on the consistent hash ring, multiplied by its weight
+const hashRingReplicas = 100
+
+type BalancerConf struct {
+	Strategy string `yaml:"strategy"`
+	// How long a proxy is skipped after a failed dial in failover mode
+	Cooldown time.Duration `yaml:"cooldown"`
+	// Dial timeout of a single attempt in failover mode, also the timeout of a latency probe
+	Timeout time.Duration `yaml:"timeout"`
+
+	// Latency probing of the url-test mode
+	ProbeURL  string        `yaml:"probe_url"`
+	Interval  time.Duration `yaml:"interval"`
+	Tolerance time.Duration `yaml:"tolerance"`
+
+	// Keep sending a client through the same proxy in round-robin and weighted modes
+	Sticky    bool          `yaml:"sticky"`
+	StickyTTL time.Duration `yaml:"sticky_ttl"`
+
+	CircuitBreaker CircuitBreakerConf `yaml:"circuit_breaker"`
+}
+
+type CircuitBreakerConf struct {
+	// Consecutive failed dials that open the circuit of a proxy, 0 disables the breaker
+	Failures int `yaml:"failures"`
+	// How long an open circuit fails fast before a dial is attempted again
+	Backoff time.Duration `yaml:"backoff"`
+}
+
+// upstream is a proxy of a balanced group together with its long-lived dialer
+type upstream struct {
+	conf   ProxyConf
+	dialer proxy.Dialer
+	// unix nano time until which the upstream is considered unhealthy
+	unhealthyUntil atomic.Int64
+	// last measured latency, 0 when unknown or the probe failed
+	latency atomic.Int64
+	// set by the health checker
+	down atomic.Bool
+	// circuit breaker: consecutive failed dials, unix nano time until which the circuit is open,
+	// 0 when closed, and whether the dial probing a circuit whose backoff expired is in progress
+	failures  atomic.Int32
+	openUntil atomic.Int64
+	probing   atomic.Bool
+}
+
+// balancer distributes new connections across several upstream proxies
+type balancer struct {
+	upstreams []*upstream
+	strategy  string
+	cooldown  time.Duration
+	timeout   time.Duration
+	next      atomic.Uint32
+
+	probeURL  string
+	interval  time.Duration
+	tolerance time.Duration
+	selected  atomic.Pointer[upstream]
+	done      chan struct{}
+
+	totalWeight int
+
+	sticky     bool
+	stickyTTL  time.Duration
+	stickyMu   sync.Mutex
+	affinities map[string]*affinity
+	lastSweep  time.Time
+
+	breakerFailures int32
+	breakerBackoff  time.Duration
+
+	ring []ringPoint
+
+	// upstream every connection goes through, chosen through the admin API
+	forced atomic.Pointer[upstream]
+}
+
+// ringPoint is a position of an upstream on the consistent hash ring
+type ringPoint struct {
+	hash     uint32
+	upstream *upstream
+}
+
+// affinity binds a client IP to an upstream until it expires
+type affinity struct {
+	upstream *upstream
+	expires  time.Time
+}
+
+// newBalancer creates the dialers of all proxies, they are kept alive for the lifetime of the balancer
+func newBalancer(proxies []ProxyConf, conf BalancerConf, healthConf HealthCheckConf) (*balancer, error) {
+	strategy := conf.Strategy
+	if strategy == "" {
+		strategy = BALANCE_ROUND_ROBIN
+	}
+	if !supportedStrategies[strategy] {
+		return nil, fmt.Errorf("unsupported balancer strategy: %s", strategy)
+	}
+
+	b := &balancer{
+		strategy:  strategy,
+		cooldown:  conf.Cooldown,
+		timeout:   conf.Timeout,
+		probeURL:  conf.ProbeURL,
+		interval:  conf.Interval,
+		tolerance: conf.Tolerance,
+		done:      make(chan struct{}),
+		sticky:    conf.Sticky && (strategy == BALANCE_ROUND_ROBIN || strategy == BALANCE_WEIGHTED),
+		stickyTTL: conf.StickyTTL,
+	}
+	b.breakerFailures = int32(conf.CircuitBreaker.Failures)
+	b.breakerBackoff = conf.CircuitBreaker.Backoff
+	if b.breakerBackoff <= 0 {
+		b.breakerBackoff = DEFAULT_BREAKER_BACKOFF
+	}
+	if b.sticky {
+		b.affinities = make(map[string]*affinity)
+		b.lastSweep = time.Now()
+	}
+	if b.stickyTTL <= 0 {
+		b.stickyTTL = DEFAULT_STICKY_TTL
+	}
+	if b.cooldown <= 0 {
+		b.cooldown = DEFAULT_FAILOVER_COOLDOWN
+	}
+	if b.timeout <= 0 {
+		b.timeout = DEFAULT_FAILOVER_TIMEOUT
+	}
+	if b.probeURL == "" {
+		b.probeURL = DEFAULT_PROBE_URL
+	}
+	if b.interval <= 0 {
+		b.interval = DEFAULT_PROBE_INTERVAL
+	}
+	if b.tolerance <= 0 {
+		b.tolerance = DEFAULT_PROBE_TOLERANCE
+	}
+	for _, proxyConfig := range proxies {
+		dialer, err := getProxyDialer(proxyConfig, directDialer)
+		if err != nil {
+			b.Close()
+			return nil, fmt.Errorf("%s: %w", proxyConfig.getName(), err)
+		}
+		b.upstreams = append(b.upstreams, &upstream{conf: proxyConfig, dialer: dialer})
+		b.totalWeight += proxyConfig.getWeight()
+	}
+
+	if strategy == BALANCE_CONSISTENT {
+		b.buildRing()
+	}
+	if strategy == BALANCE_URL_TEST {
+		b.selected.Store(b.upstreams[0])
+		go b.runURLTest()
+	}
+	if healthConf.Enabled {
+		go newHealthChecker(healthConf).run(b.done, b.upstreams)
+	}
+	return b, nil
+}
+
+func (u *upstream) getName() string {
+	return u.conf.getName()
+}
+
+// isHealthy reports whether the upstream is neither down, cooling down after a failed dial nor behind an open circuit
+func (u *upstream) isHealthy() bool {
+	return !u.down.Load() && !u.isCoolingDown() && !u.isCircuitOpen()
+}
+
+// isCircuitOpen tells whether the dials through the upstream fail fast, a circuit whose backoff expired is
+// half-open and lets a probing dial through
+func (u *upstream) isCircuitOpen() bool {
+	return time.Now().UnixNano() < u.openUntil.Load()
+}
+
+// allowDial tells whether a dial can go through the circuit breaker and whether it is the probe of a
+// half-open circuit, which closes the circuit when it succeeds and opens it again when it fails
+func (u *upstream) allowDial() (allowed, probe bool) {
+	openUntil := u.openUntil.Load()
+	if openUntil == 0 {
+		return true, false
+	}
+	if time.Now().UnixNano() < openUntil || !u.probing.CompareAndSwap(false, true) {
+		return false, false
+	}
+	return true, true
+}
+
+func (u *upstream) isCoolingDown() bool {
+	return time.Now().UnixNano() < u.unhealthyUntil.Load()
+}
+
+func (u *upstream) markUnhealthy(cooldown time.Duration) {
+	u.unhealthyUntil.Store(time.Now().Add(cooldown).UnixNano())
+}
+
+// pick chooses the upstream of a new connection, skipping unhealthy ones unless all of them are
+func (b *balancer) pick() *upstream {
+	for range b.upstreams {
+		n := b.next.Add(1) - 1
+		if u := b.upstreams[n%uint32(len(b.upstreams))]; u.isHealthy() {
+			return u
+		}
+	}
+	n := b.next.Add(1) - 1
+	return b.upstreams[n%uint32(len(b.upstreams))]
+}
+
+// pickWeighted chooses a random healthy upstream with a probability proportional to its weight
+func (b *balancer) pickWeighted() *upstream {
+	candidates := make([]*upstream, 0, len(b.upstreams))
+	totalWeight := 0
+	for _, u := range b.upstreams {
+		if u.isHealthy() {
+			candidates = append(candidates, u)
+			totalWeight += u.conf.getWeight()
+		}
+	}
+	if len(candidates) == 0 {
+		candidates, totalWeight = b.upstreams, b.totalWeight
+	}
+
+	n := rand.IntN(totalWeight)
+	for _, u := range candidates {
+		n -= u.conf.getWeight()
+		if n < 0 {
+			return u
+		}
+	}
+	return candidates[len(candidates)-1]
+}
+
+// pickSticky returns the upstream the client is bound to, binding it to a newly picked one
+// when there is no affinity yet or it expired. The TTL is refreshed on every connection.
+func (b *balancer) pickSticky(clientIP string, pick func() *upstream) *upstream {
+	now := time.Now()
+	b.stickyMu.Lock()
+	defer b.stickyMu.Unlock()
+
+	if now.Sub(b.lastSweep) > b.stickyTTL {
+		for ip, a := range b.affinities {
+			if now.After(a.expires) {
+				delete(b.affinities, ip)
+			}
+		}
+		b.lastSweep = now
+	}
+
+	a, ok := b.affinities[clientIP]
+	if !ok || now.After(a.expires) || !a.upstream.isHealthy() {
+		a = &affinity{upstream: pick()}
+		b.affinities[clientIP] = a
+	}
+	a.expires = now.Add(b.stickyTTL)
+	return a.upstream
+}
+
+// buildRing places every upstream on the hash ring, points depend only on the proxy
+// name so adding or removing a proxy moves only the destinations it owns
+func (b *balancer) buildRing() {
+	for _, u := range b.upstreams {
+		for i := 0; i < hashRingReplicas*u.conf.getWeight(); i++ {
+			b.ring = append(b.ring, ringPoint{
+				hash:     getHash(fmt.Sprintf("%s#%d", u.getName(), i)),
+				upstream: u,
+			})
+		}
+	}
+	sort.Slice(b.ring, func(i, j int) bool {
+		return b.ring[i].hash < b.ring[j].hash
+	})
+}
+
+// pickConsistent maps the destination host to an upstream, walking the ring
+// past unhealthy upstreams so only their destinations move
+func (b *balancer) pickConsistent(address string) *upstream {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	hash := getHash(strings.ToLower(host))
+	start := sort.Search(len(b.ring), func(i int) bool {
+		return b.ring[i].hash >= hash
+	})
+	for i := range b.ring {
+		if u := b.ring[(start+i)%len(b.ring)].upstream; u.isHealthy() {
+			return u
+		}
+	}
+	return b.ring[start%len(b.ring)].upstream
+}
+
+// getFailoverCandidates returns the healthy upstreams in configured order,
+// unhealthy ones are kept at the end as a last resort
+func (b *balancer) getFailoverCandidates() []*upstream {
+	candidates := make([]*upstream, 0, len(b.upstreams))
+	var unhealthy []*upstream
+	for _, u := range b.upstreams {
+		if u.isHealthy() {
+			candidates = append(candidates, u)
+		} else {
+			unhealthy = append(unhealthy, u)
+		}
+	}
+	return append(candidates, unhealthy...)
+}
+
+// dialFailover tries the upstreams one after another until a dial succeeds
+func (b *balancer) dialFailover(ctx context.Context, network, address string) (net.Conn, error) {
+	var lastErr error
+	for _, u := range b.getFailoverCandidates() {
+		attemptCtx, cancel := context.WithTimeout(ctx, b.timeout)
+		conn, err := b.dialUpstream(attemptCtx, u, network, address)
+		cancel()
+		if err == nil {
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		lastErr = err
+		// most proxies don't relay UDP, which says nothing about their health, and an open circuit
+		// already keeps the proxy aside
+		if !isStreamNetwork(network) || errors.Is(err, errCircuitOpen) {
+			continue
+		}
+		if u.isHealthy() {
+			slog.Warn("Proxy failed, skipping it", "proxy", u.getName(), "cooldown", b.cooldown, "err", err)
+		}
+		u.markUnhealthy(b.cooldown)
+	}
+	return nil, lastErr
+}
+
+// probeLatency measures the time to fetch url through the upstream over a fresh connection
+func probeLatency(u *upstream, url string, timeout time.Duration) (time.Duration, error) {
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext:       getDialContext(u.dialer),
+			DisableKeepAlives: true,
+		},
+		Timeout: timeout,
+	}
+	start := time.Now()
+	resp, err := client.Get(url)
+	if err != nil {
+		return 0, err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return time.Since(start), nil
+}
+
+// selectFastest switches to the upstream with the lowest latency, unless the current one is within tolerance
+func (b *balancer) selectFastest() {
+	var fastest *upstream
+	for _, u := range b.upstreams {
+		latency := u.latency.Load()
+		if latency > 0 && !u.down.Load() && (fastest == nil || latency < fastest.latency.Load()) {
+			fastest = u
+		}
+	}
+	if fastest == nil {
+		return
+	}
+	current := b.selected.Load()
+	currentLatency := current.latency.Load()
+	if current == fastest || (currentLatency > 0 && currentLatency <= fastest.latency.Load()+int64(b.tolerance)) {
+		return
+	}
+	b.selected.Store(fastest)
+	slog.Info("Switched to proxy", "proxy", fastest.getName(), "latency", time.Duration(fastest.latency.Load()))
+}
+
+// runURLTest probes every upstream each interval and selects the fastest one
+func (b *balancer) runURLTest() {
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+	for {
+		var wg sync.WaitGroup
+		for _, u := range b.upstreams {
+			wg.Add(1)
+			go func(u *upstream) {
+				defer wg.Done()
+				latency, err := probeLatency(u, b.probeURL, b.timeout)
+				if err != nil {
+					slog.Warn("Probe of proxy failed", "proxy", u.getName(), "err", err)
+				}
+				u.latency.Store(int64(latency))
+			}(u)
+		}
+		wg.Wait()
+		b.selectFastest()
+
+		select {
+		case <-b.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func isStreamNetwork(network string) bool {
+	return network == "tcp" || network == "tcp4" || network == "tcp6"
+}
+
+// dialUpstream dials through u, failing fast while its circuit is open, and feeds the circuit breaker
+func (b *balancer) dialUpstream(ctx context.Context, u *upstream, network, address string) (net.Conn, error) {
+	if b.breakerFailures <= 0 || !isStreamNetwork(network) {
+		return dialContext(ctx, u.dialer, network, address)
+	}
+	allowed, probe := u.allowDial()
+	if !allowed {
+		return nil, fmt.Errorf("proxy %s: %w", u.getName(), errCircuitOpen)
+	}
+	if probe {
+		defer u.probing.Store(false)
+	}
+	conn, err := dialContext(ctx, u.dialer, network, address)
+	if err != nil {
+		// a dial canceled by the client says nothing about the proxy, unlike one running out of time
+		if errors.Is(ctx.Err(), context.Canceled) {
+			return nil, err
+		}
+		if probe {
+			slog.Warn("Proxy still failing, circuit open again", "proxy", u.getName(), "backoff", b.breakerBackoff, "err", err)
+			u.openUntil.Store(time.Now().Add(b.breakerBackoff).UnixNano())
+		} else if u.failures.Add(1) == b.breakerFailures {
+			slog.Warn("Proxy failed too many times in a row, circuit open", "proxy", u.getName(), "failures", b.breakerFailures, "backoff", b.breakerBackoff, "err", err)
+			u.openUntil.Store(time.Now().Add(b.breakerBackoff).UnixNano())
+		}
+		return nil, err
+	}
+	if probe {
+		slog.Info("Proxy recovered, circuit closed", "proxy", u.getName())
+	}
+	u.failures.Store(0)
+	u.openUntil.Store(0)
+	return conn, nil
+}
+
+func (b *balancer) Dial(network, address string) (net.Conn, error) {
+	return b.DialContext(context.Background(), network, address)
+}
+
+func (b *balancer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if u := b.forced.Load(); u != nil {
+		return b.dialUpstream(ctx, u, network, address)
+	}
+	switch b.strategy {
+	case BALANCE_FAILOVER:
+		return b.dialFailover(ctx, network, address)
+	case BALANCE_URL_TEST:
+		return b.dialUpstream(ctx, b.selected.Load(), network, address)
+	case BALANCE_CONSISTENT:
+		return b.dialUpstream(ctx, b.pickConsistent(address), network, address)
+	}
+
+	pick := b.pick
+	if b.strategy == BALANCE_WEIGHTED {
+		pick = b.pickWeighted
+	}
+	if clientIP := getClientIP(ctx); b.sticky && clientIP != "" {
+		return b.dialUpstream(ctx, b.pickSticky(clientIP, pick), network, address)
+	}
+	return b.dialUpstream(ctx, pick(), network, address)
+}
+
+// selectUpstream sends every connection through the named upstream, the strategy applies again when name is empty,
+// false if the balancer has no such upstream
+func (b *balancer) selectUpstream(name string) bool {
+	if name == "" {
+		b.forced.Store(nil)
+		return true
+	}
+	for _, u := range b.upstreams {
+		if u.getName() == name {
+			b.forced.Store(u)
+			return true
+		}
+	}
+	return false
+}
+
+func (b *balancer) Close() error {
+	close(b.done)
+	for _, u := range b.upstreams {
+		if closer, ok := u.dialer.(io.Closer); ok {
+			closer.Close()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package proxydialer
+
+import (
+	"net"
+	"strings"
+)
+
+// newBypassRule converts a NO_PROXY style list into a rule sending the matching destinations directly:
+// "*" matches everything, "example.com" the domain and its subdomains, ".example.com" only the subdomains,
+// IPs and CIDR ranges only match destinations given as IPs, host names are not resolved.
+// The rule is nil when the list only has blank entries, a rule without hosts would match everything
+func newBypassRule(entries []string) (*rule, error) {
+	conf := RuleConf{Action: ACTION_DIRECT}
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		switch {
+		case entry == "":
+		case strings.Contains(entry, "/"):
+			conf.CIDR = append(conf.CIDR, entry)
+		case net.ParseIP(entry) != nil:
+			ip := net.ParseIP(entry)
+			if ip.To4() != nil {
+				conf.CIDR = append(conf.CIDR, entry+"/32")
+			} else {
+				conf.CIDR = append(conf.CIDR, entry+"/128")
+			}
+		case strings.HasPrefix(entry, "."):
+			conf.Domain = append(conf.Domain, "*"+entry)
+		default:
+			conf.Domain = append(conf.Domain, entry)
+		}
+	}
+	if len(conf.Domain) == 0 && len(conf.CIDR) == 0 {
+		return nil, nil
+	}
+	r, err := newRule(conf, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	r.literalOnly = true
+	return r, nil
+}
@@ -0,0 +1,47 @@
+package proxydialer
+
+import (
+	"context"
+	"io"
+	"net"
+
+	"golang.org/x/net/proxy"
+)
+
+// chainDialer dials through every hop of a proxy chain, each hop connecting to the next one
+type chainDialer struct {
+	hops []proxy.Dialer
+}
+
+// getChainDialer creates the dialers of the chain, the first hop is dialed directly
+func getChainDialer(chain []ProxyConf) (proxy.Dialer, error) {
+	d := &chainDialer{}
+	var forward proxy.Dialer = directDialer
+	for _, proxyConfig := range chain {
+		dialer, err := getProxyDialer(proxyConfig, forward)
+		if err != nil {
+			d.Close()
+			return nil, err
+		}
+		d.hops = append(d.hops, dialer)
+		forward = dialer
+	}
+	return d, nil
+}
+
+func (d *chainDialer) Dial(network, address string) (net.Conn, error) {
+	return d.hops[len(d.hops)-1].Dial(network, address)
+}
+
+func (d *chainDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return dialContext(ctx, d.hops[len(d.hops)-1], network, address)
+}
+
+func (d *chainDialer) Close() error {
+	for _, dialer := range d.hops {
+		if closer, ok := dialer.(io.Closer); ok {
+			closer.Close()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package proxydialer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// checkConfig validates configuration files without starting the server, it prints the errors of every file
+// and returns the exit code of the check-config command
+func checkConfig(files []string) int {
+	if len(files) == 0 {
+		files = []string{getConfigFile()}
+	}
+	code := 0
+	for _, file := range files {
+		name := file
+		if name == "" {
+			name = "flags"
+		}
+		errs := checkConfigFile(file)
+		if len(errs) == 0 {
+			fmt.Printf("%s: OK\n", name)
+			continue
+		}
+		code = 1
+		for _, err := range errs {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", name, err)
+		}
+	}
+	return code
+}
+
+// checkConfigFile returns the unknown settings of a file and of the included ones, the error stopping the server from starting with it
+// and the invalid proxies and ports, including the ones the server doesn't use
+func checkConfigFile(configFile string) []string {
+	var errs []string
+	if configFile != "" {
+		errs = checkKnownSettings(configFile)
+	}
+	config, err := getConfig(configFile)
+	if err != nil {
+		return append(errs, err.Error())
+	}
+	included, _ := getIncludedFiles(configFile, config.Include)
+	for _, file := range included {
+		for _, err := range checkKnownSettings(file) {
+			errs = append(errs, file+": "+err)
+		}
+	}
+	if !config.hasUpstreamProxies() {
+		errs = append(errs, "No proxy configured")
+	}
+	names := make(map[string]bool)
+	for _, conf := range config.Proxies {
+		name := conf.getName()
+		if conf.Name != "" && names[conf.Name] {
+			errs = append(errs, fmt.Sprintf("proxy %s: duplicate name", name))
+		}
+		names[conf.Name] = true
+		if !isSupportedProtocol(conf.Protocol) {
+			errs = append(errs, fmt.Sprintf("proxy %s: unsupported protocol %q", name, conf.Protocol))
+		}
+		if conf.Server == "" {
+			errs = append(errs, fmt.Sprintf("proxy %s: server is required", name))
+		}
+		if conf.Port <= 0 || conf.Port > 65535 {
+			errs = append(errs, fmt.Sprintf("proxy %s: port %d out of range", name, conf.Port))
+		}
+	}
+	for _, listener := range config.Dialer {
+		for _, port := range []int{listener.Port, listener.SocksPort, listener.MuxPort, listener.TransparentPort, listener.DNSPort} {
+			if port < 0 || port > 65535 {
+				errs = append(errs, fmt.Sprintf("listener %s: port %d out of range", listener.Server, port))
+			}
+		}
+	}
+	return errs
+}
+
+// checkKnownSettings returns the keys of a file that are no setting, misspelled ones would be ignored otherwise
+func checkKnownSettings(configFile string) []string {
+	data, err := readConfigData(configFile)
+	if err != nil {
+		return nil
+	}
+	data, err = toYAML(getConfigName(configFile), data)
+	if err != nil {
+		return nil
+	}
+	var node yaml.Node
+	if err := yaml.Unmarshal(data, &node); err != nil {
+		return nil
+	}
+	// the lines of a JSON or TOML file are lost with its conversion
+	ext := strings.ToLower(filepath.Ext(getConfigName(configFile)))
+	withLines := ext != ".json" && ext != ".toml"
+	return checkKnownFields(&node, reflect.TypeOf(Config{}), "", withLines)
+}
+
+func checkKnownFields(node *yaml.Node, t reflect.Type, path string, withLines bool) []string {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	var errs []string
+	switch node.Kind {
+	case yaml.DocumentNode:
+		for _, child := range node.Content {
+			errs = append(errs, checkKnownFields(child, t, path, withLines)...)
+		}
+	case yaml.AliasNode:
+		return checkKnownFields(node.Alias, t, path, withLines)
+	case yaml.SequenceNode:
+		if t.Kind() != reflect.Slice {
+			return nil
+		}
+		for i, child := range node.Content {
+			errs = append(errs, checkKnownFields(child, t.Elem(), fmt.Sprintf("%s%d.", path, i), withLines)...)
+		}
+	case yaml.MappingNode:
+		// the keys of a map, like the profiles, are names and its values settings
+		if t.Kind() == reflect.Map {
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				errs = append(errs, checkKnownFields(node.Content[i+1], t.Elem(), path+node.Content[i].Value+".", withLines)...)
+			}
+			return errs
+		}
+		// a list with a single element, like the listeners, can be written without the list
+		if t.Kind() == reflect.Slice {
+			t = t.Elem()
+		}
+		if t.Kind() != reflect.Struct {
+			return nil
+		}
+		fields := make(map[string]reflect.Type)
+		for i := range t.NumField() {
+			if tag, _, _ := strings.Cut(t.Field(i).Tag.Get("yaml"), ","); tag != "" && tag != "-" {
+				fields[tag] = t.Field(i).Type
+			}
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			if key.Value == "<<" {
+				errs = append(errs, checkKnownFields(value, t, path, withLines)...)
+				continue
+			}
+			fieldType, ok := fields[key.Value]
+			if !ok {
+				if withLines {
+					errs = append(errs, fmt.Sprintf("line %d: unknown setting %s%s", key.Line, path, key.Value))
+				} else {
+					errs = append(errs, fmt.Sprintf("unknown setting %s%s", path, key.Value))
+				}
+				continue
+			}
+			errs = append(errs, checkKnownFields(value, fieldType, path+key.Value+".", withLines)...)
+		}
+	}
+	return errs
+}
@@ -0,0 +1,26 @@
+// Command proxydialer runs the proxy of the configuration file, see the README
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+
+	"github.com/alex-pro27/proxydialer"
+)
+
+func main() {
+	if err := proxydialer.Main(); err != nil {
+		var code proxydialer.ExitCode
+		if errors.As(err, &code) {
+			os.Exit(int(code))
+		}
+		fatal(err.Error())
+	}
+}
+
+// fatal logs an error preventing the server from running and exits
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
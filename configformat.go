@@ -0,0 +1,30 @@
+package proxydialer
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// toYAML converts a JSON or TOML configuration, told by the extension of its file, to YAML
+// so that it is decoded with the same names and types, YAML is returned as is
+func toYAML(configFile string, data []byte) ([]byte, error) {
+	var unmarshal func([]byte, any) error
+	switch strings.ToLower(filepath.Ext(configFile)) {
+	case ".json":
+		unmarshal = json.Unmarshal
+	case ".toml":
+		unmarshal = toml.Unmarshal
+	default:
+		return data, nil
+	}
+	var values map[string]any
+	if err := unmarshal(data, &values); err != nil {
+		return nil, fmt.Errorf("%s: %w", configFile, err)
+	}
+	return yaml.Marshal(values)
+}
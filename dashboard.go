@@ -0,0 +1,16 @@
+package proxydialer
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// dashboardHTML is a single page polling the admin API, the API token is asked for when required
+//
+//go:embed dashboard.html
+var dashboardHTML []byte
+
+func handleDashboard(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(dashboardHTML)
+}
@@ -0,0 +1,87 @@
+package proxydialer
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+
+	"golang.org/x/net/proxy"
+)
+
+// embeddedDialer is a dialer of the programs embedding the package, it is closed with io.Closer
+type embeddedDialer struct {
+	dialer proxy.Dialer
+}
+
+func (d embeddedDialer) Dial(network, address string) (net.Conn, error) {
+	return d.dialer.Dial(network, address)
+}
+
+func (d embeddedDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return dialContext(ctx, d.dialer, network, address)
+}
+
+// Close closes the connections held to the proxy, like SSH sessions and pools, once the connections
+// dialed through them are closed
+func (d embeddedDialer) Close() error {
+	if closer, ok := d.dialer.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// NewDialer returns a dialer connecting through the proxy, without running a server. It implements io.Closer
+// to close the connections it holds to the proxy
+func NewDialer(conf ProxyConf) (proxy.ContextDialer, error) {
+	dialer, err := getProxyDialer(conf, directDialer)
+	if err != nil {
+		return nil, err
+	}
+	return embeddedDialer{dialer: dialer}, nil
+}
+
+// NewConfigDialer returns a dialer connecting like the server of the configuration: through the chain
+// or the proxies marked with use, behind the routing rules. It implements io.Closer like NewDialer
+func NewConfigDialer(config Config) (proxy.ContextDialer, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	dialer, err := getDialer(&config)
+	if err != nil {
+		return nil, err
+	}
+	return embeddedDialer{dialer: dialer}, nil
+}
+
+// Transport is an HTTP transport sending the requests through the dialer of a configuration
+type Transport struct {
+	*http.Transport
+	dialer proxy.Dialer
+}
+
+// Close closes the idle connections of the transport and the connections held to the proxies, like
+// SSH sessions and pools, once the connections dialed through them are closed
+func (t *Transport) Close() error {
+	t.CloseIdleConnections()
+	if closer, ok := t.dialer.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// NewTransport returns an HTTP transport sending the requests of an http.Client like the server
+// of the configuration, through its proxies and by its routing rules. It is closed once it isn't used
+func NewTransport(config Config) (*Transport, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	dialer, err := getDialer(&config)
+	if err != nil {
+		return nil, err
+	}
+	transport := newHTTPTransport(dialer, HTTPPoolConf{})
+	// the destinations are reached through the dialer, HTTP/2 is negotiated with them like by default
+	transport.ForceAttemptHTTP2 = true
+	return &Transport{Transport: transport, dialer: dialer}, nil
+}
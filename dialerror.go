@@ -0,0 +1,146 @@
+package proxydialer
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+)
+
+// upstreamError is the error of a dial through a proxy, with the name of the proxy
+type upstreamError struct {
+	upstream string
+	// name told to the client, empty for an unnamed proxy
+	public string
+	err    error
+}
+
+func (e *upstreamError) Error() string {
+	return e.err.Error()
+}
+
+func (e *upstreamError) Unwrap() error {
+	return e.err
+}
+
+// getDialErrorUpstream returns the name of the proxy a dial failed through and the one told to the client,
+// which is empty when the proxy has no name
+func getDialErrorUpstream(err error) (string, string) {
+	var upstreamErr *upstreamError
+	if errors.As(err, &upstreamErr) {
+		return upstreamErr.upstream, upstreamErr.public
+	}
+	return "", ""
+}
+
+// getDialErrorClass returns the kind of a dial error, named like the error types of the Proxy-Status
+// header of RFC 9209
+func getDialErrorClass(err error) string {
+	var dnsErr *net.DNSError
+	var certErr *tls.CertificateVerificationError
+	var alertErr tls.AlertError
+	var recordErr tls.RecordHeaderError
+	switch {
+	case errors.Is(err, errRejected):
+		return "http_request_denied"
+	case errors.Is(err, errTooManyTunnels), errors.Is(err, errTooManyClientTunnels):
+		return "connection_limit_reached"
+	case errors.As(err, &dnsErr):
+		if dnsErr.IsTimeout {
+			return "dns_timeout"
+		}
+		if dnsErr.IsNotFound {
+			return "destination_not_found"
+		}
+		return "dns_error"
+	case isTimeout(err):
+		return "connection_timeout"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "connection_refused"
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		return "destination_ip_unroutable"
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE),
+		errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "connection_terminated"
+	case errors.As(err, &certErr):
+		return "tls_certificate_error"
+	case errors.As(err, &alertErr):
+		return "tls_alert_received"
+	case errors.As(err, &recordErr):
+		return "tls_protocol_error"
+	}
+	return "destination_unavailable"
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// getDialErrorStatus returns the status code answered to the client when dialing failed: 504 when
+// the destination or a proxy didn't answer in time, 502 when they refused or closed the connection
+func getDialErrorStatus(err error) int {
+	switch getDialErrorClass(err) {
+	case "http_request_denied":
+		return http.StatusForbidden
+	case "connection_limit_reached":
+		return http.StatusServiceUnavailable
+	case "connection_timeout", "dns_timeout":
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+// dialErrorBody is the body of the response to a request whose destination couldn't be dialed
+type dialErrorBody struct {
+	Error    string `json:"error"`
+	Upstream string `json:"upstream,omitempty"`
+}
+
+// writeDialError answers a request whose destination couldn't be dialed, the kind of error and the proxy
+// it went through are told by the Proxy-Status header and a JSON body, and returns the status code.
+// The error itself is only logged, it can tell the addresses of the proxies and of the server
+func writeDialError(w http.ResponseWriter, r *http.Request, err error) int {
+	status := getDialErrorStatus(err)
+	class := getDialErrorClass(err)
+	upstream, public := getDialErrorUpstream(err)
+	slog.Warn("Dial failed", "client", r.RemoteAddr, "host", r.Host, "error", class, "upstream", upstream, "err", err)
+	proxyStatus := "proxydialer; error=" + class
+	if public != "" {
+		proxyStatus += "; next-hop=" + quoteStructuredString(public)
+	}
+	w.Header().Set("Proxy-Status", proxyStatus)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(dialErrorBody{Error: class, Upstream: public})
+	return status
+}
+
+// quoteStructuredString quotes a string of a structured header field, RFC 8941, which only allows the printable
+// ASCII characters
+func quoteStructuredString(value string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, c := range value {
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(c)
+		case c < 0x20 || c > 0x7e:
+			b.WriteByte('?')
+		default:
+			b.WriteRune(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
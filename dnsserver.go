@@ -0,0 +1,198 @@
+package proxydialer
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/net/proxy"
+)
+
+const (
+	DEFAULT_DNS_UPSTREAM = "1.1.1.1:53"
+	DEFAULT_DNS_TIMEOUT  = 5 * time.Second
+)
+
+// Largest DNS message, also the limit of DNS over TCP
+const dnsMaxSize = 65535
+
+// dnsForwarder sends DNS queries through the proxies, over TCP to a DNS server
+// or as DNS over HTTPS when the upstream is a URL
+type dnsForwarder struct {
+	dialer   proxy.Dialer
+	upstream string
+	client   *http.Client
+}
+
+func newDNSForwarder(dialer proxy.Dialer, upstream string) *dnsForwarder {
+	if upstream == "" {
+		upstream = DEFAULT_DNS_UPSTREAM
+	}
+	f := &dnsForwarder{dialer: dialer, upstream: upstream}
+	if strings.HasPrefix(upstream, "https://") {
+		f.client = &http.Client{
+			Transport: &http.Transport{
+				DialContext:       getDialContext(dialer),
+				ForceAttemptHTTP2: true,
+			},
+			Timeout: DEFAULT_DNS_TIMEOUT,
+		}
+	}
+	return f
+}
+
+// exchange sends a query and returns the response
+func (f *dnsForwarder) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	if f.client != nil {
+		return f.exchangeHTTPS(ctx, query)
+	}
+	return f.exchangeTCP(ctx, query)
+}
+
+func (f *dnsForwarder) exchangeTCP(ctx context.Context, query []byte) ([]byte, error) {
+	conn, err := dialContext(ctx, f.dialer, "tcp", f.upstream)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(DEFAULT_DNS_TIMEOUT))
+	if err := writeDNSMessage(conn, query); err != nil {
+		return nil, err
+	}
+	return readDNSMessage(conn)
+}
+
+// exchangeHTTPS sends the query as an RFC 8484 POST request
+func (f *dnsForwarder) exchangeHTTPS(ctx context.Context, query []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, f.upstream, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DNS over HTTPS: unexpected status %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, dnsMaxSize))
+}
+
+// readDNSMessage reads a length prefixed message of DNS over TCP
+func readDNSMessage(reader io.Reader) ([]byte, error) {
+	length := make([]byte, 2)
+	if _, err := io.ReadFull(reader, length); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(length))
+	if _, err := io.ReadFull(reader, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func writeDNSMessage(writer io.Writer, msg []byte) error {
+	if len(msg) > dnsMaxSize {
+		return errors.New("DNS message too long")
+	}
+	buf := make([]byte, 2, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	_, err := writer.Write(append(buf, msg...))
+	return err
+}
+
+// getDNSQuestion describes the first question of a query for the logs
+func getDNSQuestion(query []byte) string {
+	var parser dnsmessage.Parser
+	if _, err := parser.Start(query); err != nil {
+		return "invalid query"
+	}
+	question, err := parser.Question()
+	if err != nil {
+		return "no question"
+	}
+	return fmt.Sprintf("%s %s", question.Type, question.Name)
+}
+
+// getDNSFailure builds a SERVFAIL response to a query, nil if the query is too short
+func getDNSFailure(query []byte) []byte {
+	if len(query) < 12 {
+		return nil
+	}
+	resp := append([]byte(nil), query...)
+	// QR set and RCODE 2
+	resp[2] |= 0x80
+	resp[3] = resp[3]&0xf0 | 0x02
+	return resp
+}
+
+// forward answers a query received from a client, with SERVFAIL when the upstream can't be reached
+func (f *dnsForwarder) forward(client string, query []byte) []byte {
+	slog.Info("DNS", "client", client, "question", getDNSQuestion(query))
+	ctx, cancel := context.WithTimeout(withClientAddr(context.Background(), client), DEFAULT_DNS_TIMEOUT)
+	defer cancel()
+	resp, err := f.exchange(ctx, query)
+	if err != nil {
+		slog.Warn("DNS failed", "client", client, "question", getDNSQuestion(query), "err", err)
+		return getDNSFailure(query)
+	}
+	return resp
+}
+
+// serveDNSUDP answers queries received over UDP until the connection is closed
+func serveDNSUDP(conn net.PacketConn, f *dnsForwarder) error {
+	buf := make([]byte, dnsMaxSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		query := append([]byte(nil), buf[:n]...)
+		go func() {
+			if resp := f.forward(addr.String(), query); resp != nil {
+				conn.WriteTo(resp, addr)
+			}
+		}()
+	}
+}
+
+// handleDNSConn answers the queries of a DNS over TCP client one after the other
+func handleDNSConn(conn net.Conn, f *dnsForwarder) {
+	defer conn.Close()
+	for {
+		conn.SetReadDeadline(time.Now().Add(DEFAULT_DNS_TIMEOUT))
+		query, err := readDNSMessage(conn)
+		if err != nil {
+			return
+		}
+		resp := f.forward(conn.RemoteAddr().String(), query)
+		if resp == nil {
+			return
+		}
+		if err := writeDNSMessage(conn, resp); err != nil {
+			return
+		}
+	}
+}
+
+// serveDNSTCP accepts DNS over TCP clients until the listener is closed
+func serveDNSTCP(listener net.Listener, f *dnsForwarder) error {
+	return serveListener(listener, func(conn net.Conn) {
+		handleDNSConn(conn, f)
+	})
+}
@@ -0,0 +1,106 @@
+package proxydialer
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// domainTrie stores domain patterns by label from the top level domain down,
+// so a lookup costs the number of labels of the host whatever the number of patterns
+type domainTrie struct {
+	children map[string]*domainTrie
+	// the domain and all its subdomains match
+	suffix bool
+	// only the subdomains match
+	wildcard bool
+	// only the domain itself matches
+	exact bool
+}
+
+// domainMatcher matches hosts against suffixes, "*." wildcards, "full:" exact names and "regexp:" patterns
+type domainMatcher struct {
+	trie     domainTrie
+	regexps  []*regexp.Regexp
+	patterns []string
+	empty    bool
+}
+
+func splitLabels(domain string) []string {
+	return strings.Split(domain, ".")
+}
+
+func (t *domainTrie) insert(domain string) *domainTrie {
+	node := t
+	labels := splitLabels(domain)
+	for i := len(labels) - 1; i >= 0; i-- {
+		child := node.children[labels[i]]
+		if child == nil {
+			if node.children == nil {
+				node.children = make(map[string]*domainTrie)
+			}
+			child = &domainTrie{}
+			node.children[labels[i]] = child
+		}
+		node = child
+	}
+	return node
+}
+
+func (t *domainTrie) match(host string) bool {
+	node := t
+	labels := splitLabels(host)
+	for i := len(labels) - 1; i >= 0; i-- {
+		if node.suffix || node.wildcard {
+			return true
+		}
+		node = node.children[labels[i]]
+		if node == nil {
+			return false
+		}
+	}
+	return node.suffix || node.exact
+}
+
+func newDomainMatcher(patterns []string) (*domainMatcher, error) {
+	m := &domainMatcher{patterns: patterns, empty: len(patterns) == 0}
+	for _, pattern := range patterns {
+		switch {
+		case strings.HasPrefix(pattern, "regexp:"):
+			re, err := regexp.Compile(strings.TrimPrefix(pattern, "regexp:"))
+			if err != nil {
+				return nil, fmt.Errorf("invalid domain pattern %q: %w", pattern, err)
+			}
+			m.regexps = append(m.regexps, re)
+		case strings.HasPrefix(pattern, "full:"):
+			m.trie.insert(normalizeHost(strings.TrimPrefix(pattern, "full:"))).exact = true
+		case pattern == "*":
+			m.trie.suffix = true
+		case strings.HasPrefix(pattern, "*."):
+			m.trie.insert(normalizeHost(strings.TrimPrefix(pattern, "*."))).wildcard = true
+		default:
+			m.trie.insert(normalizeHost(pattern)).suffix = true
+		}
+	}
+	return m, nil
+}
+
+// len returns the number of patterns
+func (m *domainMatcher) len() int {
+	return len(m.patterns)
+}
+
+func (m *domainMatcher) match(host string) bool {
+	if m.empty {
+		return false
+	}
+	if m.trie.match(host) {
+		return true
+	}
+	for _, re := range m.regexps {
+		if re.MatchString(host) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,198 @@
+package proxydialer
+
+import (
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Prefix of the environment variables overriding the settings of the configuration file
+const ENV_PREFIX = "PROXYDIALER"
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// envOverrides are the variables of the environment with the prefix, by name
+type envOverrides struct {
+	values map[string]string
+	used   map[string]bool
+}
+
+// applyEnv overrides the settings of the configuration with the environment variables named after their path
+// in the file, e.g. PROXYDIALER_DIALER_PORT, PROXYDIALER_PROXIES_0_PASSWORD or PROXYDIALER_PROXIES_VPN_PASSWORD
+func applyEnv(config *Config) error {
+	o := envOverrides{values: make(map[string]string), used: make(map[string]bool)}
+	for _, variable := range os.Environ() {
+		name, value, _ := strings.Cut(variable, "=")
+		if strings.HasPrefix(name, ENV_PREFIX+"_") {
+			o.values[name] = value
+		}
+	}
+	if len(o.values) == 0 {
+		return nil
+	}
+	if err := o.apply(reflect.ValueOf(config).Elem(), ENV_PREFIX); err != nil {
+		return err
+	}
+	// PROXYDIALER_PROXY_* is the proxy marked with use, or the first one, for the configurations with a single proxy
+	if len(config.Proxies) > 0 {
+		i := max(slices.IndexFunc(config.Proxies, func(conf ProxyConf) bool { return conf.Use }), 0)
+		if err := o.apply(reflect.ValueOf(&config.Proxies[i]).Elem(), ENV_PREFIX+"_PROXY"); err != nil {
+			return err
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(o.values)) {
+		if !o.used[name] {
+			slog.Warn("Unknown setting in the environment", "name", name)
+		}
+	}
+	return nil
+}
+
+// getEnvName returns a name in a variable, e.g. "my-vpn" is MY_VPN
+func getEnvName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' {
+			return r - 'a' + 'A'
+		}
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+func (o envOverrides) lookup(name string) (string, bool) {
+	value, ok := o.values[name]
+	if ok {
+		o.used[name] = true
+	}
+	return value, ok
+}
+
+// hasPrefix tells whether a variable sets a setting under name
+func (o envOverrides) hasPrefix(name string) bool {
+	for variable := range o.values {
+		if strings.HasPrefix(variable, name+"_") {
+			return true
+		}
+	}
+	return false
+}
+
+// apply sets the value of the variable name, or its fields and elements from the variables under name
+func (o envOverrides) apply(v reflect.Value, name string) error {
+	if v.Type() == durationType {
+		if value, ok := o.lookup(name); ok {
+			duration, err := time.ParseDuration(value)
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			v.SetInt(int64(duration))
+		}
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Struct:
+		for i := range v.NumField() {
+			tag, _, _ := strings.Cut(v.Type().Field(i).Tag.Get("yaml"), ",")
+			if tag == "" || tag == "-" {
+				continue
+			}
+			if err := o.apply(v.Field(i), name+"_"+getEnvName(tag)); err != nil {
+				return err
+			}
+		}
+	case reflect.Pointer:
+		if v.Type().Elem().Kind() != reflect.Struct {
+			return nil
+		}
+		if v.IsNil() {
+			if !o.hasPrefix(name) {
+				return nil
+			}
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return o.apply(v.Elem(), name)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.String {
+			if value, ok := o.lookup(name); ok {
+				var values []string
+				for _, value := range strings.Split(value, ",") {
+					if value = strings.TrimSpace(value); value != "" {
+						values = append(values, value)
+					}
+				}
+				v.Set(reflect.ValueOf(values).Convert(v.Type()))
+			}
+			return nil
+		}
+		if v.Type().Elem().Kind() != reflect.Struct {
+			return nil
+		}
+		// a single listener can be written without a list, its settings are under DIALER too
+		if v.Type() == reflect.TypeOf(Listeners{}) {
+			if v.Len() == 0 && o.hasPrefix(name) {
+				v.Set(reflect.Append(v, reflect.Zero(v.Type().Elem())))
+			}
+			if v.Len() > 0 {
+				if err := o.apply(v.Index(0), name); err != nil {
+					return err
+				}
+			}
+		}
+		for i := range v.Len() {
+			elem := v.Index(i)
+			if err := o.apply(elem, fmt.Sprintf("%s_%d", name, i)); err != nil {
+				return err
+			}
+			// elements with a name, like the proxies, can be set by name too
+			if field := elem.FieldByName("Name"); field.IsValid() && field.Kind() == reflect.String && field.String() != "" {
+				if err := o.apply(elem, name+"_"+getEnvName(field.String())); err != nil {
+					return err
+				}
+			}
+		}
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String || v.Type().Elem().Kind() != reflect.String {
+			return nil
+		}
+		if value, ok := o.lookup(name); ok {
+			values := reflect.MakeMap(v.Type())
+			for _, pair := range strings.Split(value, ",") {
+				key, value, found := strings.Cut(pair, "=")
+				if !found {
+					return fmt.Errorf("%s: expected key=value pairs", name)
+				}
+				values.SetMapIndex(reflect.ValueOf(strings.TrimSpace(key)), reflect.ValueOf(strings.TrimSpace(value)))
+			}
+			v.Set(values)
+		}
+	case reflect.String:
+		if value, ok := o.lookup(name); ok {
+			v.SetString(value)
+		}
+	case reflect.Int:
+		if value, ok := o.lookup(name); ok {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			v.SetInt(int64(n))
+		}
+	case reflect.Bool:
+		if value, ok := o.lookup(name); ok {
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			v.SetBool(b)
+		}
+	}
+	return nil
+}
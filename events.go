@@ -0,0 +1,86 @@
+package proxydialer
+
+import (
+	"sync"
+	"time"
+)
+
+// Tunnel describes the tunnel of an event
+type Tunnel struct {
+	ID     uint64
+	Client string
+	// user the client authenticated as, empty without authentication
+	User   string
+	Target string
+	// kind of tunnel, "SOCKS5", "FORWARD", "TRANSPARENT" or "TUN", or the HTTP version of a CONNECT request
+	Protocol string
+	// name of the proxy the tunnel goes through, "direct" when dialed directly
+	Upstream string
+	Start    time.Time
+}
+
+// EventHandler receives the lifecycle events of the servers. Its methods are called by the goroutines
+// of the servers and must return quickly, NopEventHandler can be embedded to implement some of them only
+type EventHandler interface {
+	// OnListen is called when a server listens on an address, again after every reload. The network
+	// is "tcp", "udp", "unix" or "tproxy"
+	OnListen(network, address string)
+	OnTunnelOpen(tunnel Tunnel)
+	// OnTunnelClose is called once both ways of a tunnel are closed, sent is the bytes sent to the client
+	// and received the ones received from it
+	OnTunnelClose(tunnel Tunnel, sent, received int64)
+	// OnUpstreamDown and OnUpstreamUp are called when the health check of a proxy changes its state
+	OnUpstreamDown(name string, err error)
+	OnUpstreamUp(name string)
+	// OnReload is called once a modified configuration replaced the running one
+	OnReload()
+}
+
+// NopEventHandler ignores all the events
+type NopEventHandler struct{}
+
+func (NopEventHandler) OnListen(network, address string)                  {}
+func (NopEventHandler) OnTunnelOpen(tunnel Tunnel)                        {}
+func (NopEventHandler) OnTunnelClose(tunnel Tunnel, sent, received int64) {}
+func (NopEventHandler) OnUpstreamDown(name string, err error)             {}
+func (NopEventHandler) OnUpstreamUp(name string)                          {}
+func (NopEventHandler) OnReload()                                         {}
+
+var eventHandlers struct {
+	sync.RWMutex
+	next     uint64
+	handlers map[uint64]EventHandler
+}
+
+// Subscribe adds a handler of the events until the function returned is called
+func Subscribe(handler EventHandler) (unsubscribe func()) {
+	eventHandlers.Lock()
+	defer eventHandlers.Unlock()
+	if eventHandlers.handlers == nil {
+		eventHandlers.handlers = make(map[uint64]EventHandler)
+	}
+	eventHandlers.next++
+	id := eventHandlers.next
+	eventHandlers.handlers[id] = handler
+	return func() {
+		eventHandlers.Lock()
+		defer eventHandlers.Unlock()
+		delete(eventHandlers.handlers, id)
+	}
+}
+
+// hasEventHandlers tells whether the events are subscribed to, so that the tunnels are described
+func hasEventHandlers() bool {
+	eventHandlers.RLock()
+	defer eventHandlers.RUnlock()
+	return len(eventHandlers.handlers) > 0
+}
+
+// emitEvent calls every handler with event
+func emitEvent(event func(EventHandler)) {
+	eventHandlers.RLock()
+	defer eventHandlers.RUnlock()
+	for _, handler := range eventHandlers.handlers {
+		event(handler)
+	}
+}
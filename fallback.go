@@ -0,0 +1,116 @@
+package proxydialer
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+const (
+	// How often the proxies are checked again while dialing directly
+	DEFAULT_FALLBACK_RETRY   = 10 * time.Second
+	DEFAULT_FALLBACK_TIMEOUT = 5 * time.Second
+)
+
+// fallbackDialer dials directly while none of the proxies can be reached, which is checked in the background
+type fallbackDialer struct {
+	upstream proxy.Dialer
+	direct   proxy.Dialer
+	// proxies connected to by this server, only the first hop of a chain
+	proxies []ProxyConf
+
+	// set while none of the proxies accepts connections
+	active atomic.Bool
+	// asks for a check of the proxies after a failed dial
+	check     chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newFallbackDialer(config *Config, upstream proxy.Dialer) *fallbackDialer {
+	proxies := config.getUpstreamProxies()
+	if len(config.Chain) > 0 {
+		proxies = proxies[:1]
+	}
+	d := &fallbackDialer{
+		upstream: upstream,
+		direct:   directDialer,
+		proxies:  proxies,
+		check:    make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+	go d.run()
+	return d
+}
+
+// probeUpstream returns nil when one of the proxies accepts connections, the error of the last one otherwise
+func (d *fallbackDialer) probeUpstream() error {
+	var err error
+	for _, conf := range d.proxies {
+		if err = probeHandshake(conf, DEFAULT_FALLBACK_TIMEOUT); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// run checks the proxies after a failed dial, and once per retry interval while dialing directly,
+// until the dialer is closed
+func (d *fallbackDialer) run() {
+	ticker := time.NewTicker(DEFAULT_FALLBACK_RETRY)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.done:
+			return
+		case <-d.check:
+		case <-ticker.C:
+			if !d.active.Load() {
+				continue
+			}
+		}
+		if err := d.probeUpstream(); err != nil {
+			if !d.active.Swap(true) {
+				slog.Warn("Upstream proxy is unreachable, dialing directly", "err", err)
+			}
+		} else if d.active.Swap(false) {
+			slog.Info("Upstream proxy is reachable again, dialing through it")
+		}
+	}
+}
+
+func (d *fallbackDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+func (d *fallbackDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if d.active.Load() {
+		return dialContext(ctx, d.direct, network, address)
+	}
+	conn, err := dialContext(ctx, d.upstream, network, address)
+	if err != nil {
+		// the proxy may have failed to reach the destination rather than being down, which the check tells
+		select {
+		case d.check <- struct{}{}:
+		default:
+		}
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (d *fallbackDialer) Close() error {
+	d.closeOnce.Do(func() {
+		close(d.done)
+	})
+	if closer, ok := d.upstream.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package proxydialer
+
+import (
+	"context"
+	"log/slog"
+	"net"
+
+	"golang.org/x/net/proxy"
+)
+
+// ForwardConf forwards the connections of a local address to a fixed destination, like ssh -L
+type ForwardConf struct {
+	Listen string `yaml:"listen"`
+	Remote string `yaml:"remote"`
+	// Names of the proxies used instead of the ones marked with use
+	Proxies []string `yaml:"proxies"`
+}
+
+// handleForwardConn connects a local client to the remote address
+func handleForwardConn(client_conn net.Conn, dialer proxy.Dialer, remote string) {
+	slog.Info("FORWARD", "client", client_conn.RemoteAddr().String(), "remote", remote)
+	ctx := withClientAddr(context.Background(), client_conn.RemoteAddr().String())
+	ctx, entry := newAccessEntry(ctx, "CONNECT", remote, "FORWARD")
+	dest_conn, err := dialTunnel(ctx, dialer, "tcp", remote)
+	if err != nil {
+		slog.Warn("FORWARD failed", "client", client_conn.RemoteAddr().String(), "remote", remote, "err", err)
+		entry.finish(getDialErrorStatus(err), 0, 0)
+		client_conn.Close()
+		return
+	}
+	entry.setUpstream(dest_conn)
+	relay(client_conn, dest_conn, entry)
+}
+
+// serveForward accepts the clients of a forward until the listener is closed
+func serveForward(listener net.Listener, dialer proxy.Dialer, remote string) error {
+	return serveListener(listener, func(conn net.Conn) {
+		handleForwardConn(conn, dialer, remote)
+	})
+}
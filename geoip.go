@@ -0,0 +1,113 @@
+package proxydialer
+
+import (
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+const DEFAULT_GEOIP_RELOAD_INTERVAL = time.Minute
+
+type GeoIPConf struct {
+	// Path of a MaxMind country or city MMDB database
+	Database string `yaml:"database"`
+	// How often the database file is checked for changes
+	ReloadInterval time.Duration `yaml:"reload_interval"`
+}
+
+// geoIPDB opens the database on the first lookup and reopens it when the file changes
+type geoIPDB struct {
+	path     string
+	interval time.Duration
+
+	// mu protects the reader from being closed during a lookup
+	mu     sync.RWMutex
+	reader *maxminddb.Reader
+
+	reloadMu  sync.Mutex
+	modTime   time.Time
+	checkedAt time.Time
+}
+
+type geoIPRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+}
+
+func newGeoIPDB(conf GeoIPConf) *geoIPDB {
+	if conf.Database == "" {
+		return nil
+	}
+	db := &geoIPDB{
+		path:     conf.Database,
+		interval: conf.ReloadInterval,
+	}
+	if db.interval <= 0 {
+		db.interval = DEFAULT_GEOIP_RELOAD_INTERVAL
+	}
+	return db
+}
+
+// reload opens the database when it is not open yet or the file was modified,
+// the file is checked at most once per interval
+func (db *geoIPDB) reload() {
+	db.reloadMu.Lock()
+	defer db.reloadMu.Unlock()
+	if !db.checkedAt.IsZero() && time.Since(db.checkedAt) < db.interval {
+		return
+	}
+	db.checkedAt = time.Now()
+
+	info, err := os.Stat(db.path)
+	if err != nil {
+		slog.Warn("GeoIP database", "err", err)
+		return
+	}
+	if info.ModTime().Equal(db.modTime) {
+		return
+	}
+	reader, err := maxminddb.Open(db.path)
+	if err != nil {
+		slog.Warn("GeoIP database", "err", err)
+		return
+	}
+
+	db.mu.Lock()
+	previous := db.reader
+	db.reader = reader
+	db.mu.Unlock()
+	if previous != nil {
+		slog.Info("GeoIP database reloaded", "file", db.path)
+		previous.Close()
+	}
+	db.modTime = info.ModTime()
+}
+
+// getCountry returns the ISO country code of ip, empty when unknown
+func (db *geoIPDB) getCountry(ip net.IP) string {
+	db.reload()
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.reader == nil {
+		return ""
+	}
+	var record geoIPRecord
+	if err := db.reader.Lookup(ip, &record); err != nil {
+		return ""
+	}
+	return record.Country.ISOCode
+}
+
+func (db *geoIPDB) Close() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.reader == nil {
+		return nil
+	}
+	return db.reader.Close()
+}
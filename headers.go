@@ -0,0 +1,106 @@
+package proxydialer
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Name of the proxy in the Via header by default, a pseudonym rather than the host name
+const DEFAULT_VIA = "proxydialer"
+
+// HeadersConf sets the headers identifying the proxy and its clients in the plain HTTP requests
+type HeadersConf struct {
+	// Neither add Via and X-Forwarded-For nor forward the ones of the clients, hiding them from the origins
+	Anonymous bool `yaml:"anonymous"`
+	// Name of the proxy in the Via header, default "proxydialer"
+	Via string `yaml:"via"`
+}
+
+// forwardedHeaders are the headers telling the origins about the clients and the proxies the requests went through
+var forwardedHeaders = []string{
+	"Via",
+	"Forwarded",
+	"X-Forwarded-For",
+	"X-Forwarded-Host",
+	"X-Forwarded-Proto",
+	"X-Real-Ip",
+}
+
+// hopHeaders are the headers of a single connection, RFC 7230 section 6.1, which a proxy doesn't forward
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopHeaders removes the hop-by-hop headers and the ones named by the Connection header
+func removeHopHeaders(header http.Header) {
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	// "TE: trailers" is kept, gRPC origins require it and the transport supports trailers
+	trailers := false
+	for _, value := range header.Values("Te") {
+		for _, name := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(name), "trailers") {
+				trailers = true
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+	if trailers {
+		header.Set("Te", "trailers")
+	}
+}
+
+// getVia returns the entry of the proxy in the Via header of a message of the protocol, e.g. "1.1 proxydialer"
+func (conf HeadersConf) getVia(major, minor int) string {
+	via := conf.Via
+	if via == "" {
+		via = DEFAULT_VIA
+	}
+	if major >= 2 {
+		return fmt.Sprintf("%d %s", major, via)
+	}
+	return fmt.Sprintf("%d.%d %s", major, minor, via)
+}
+
+// setForwardedHeaders appends the proxy to the Via header of a request and its client to X-Forwarded-For,
+// or removes the forwarded headers in anonymous mode
+func (conf HeadersConf) setForwardedHeaders(req *http.Request) {
+	if conf.Anonymous {
+		for _, name := range forwardedHeaders {
+			req.Header.Del(name)
+		}
+		return
+	}
+	req.Header.Add("Via", conf.getVia(req.ProtoMajor, req.ProtoMinor))
+	// the clients of a unix socket have no address
+	if ip, _, err := net.SplitHostPort(req.RemoteAddr); err == nil && ip != "" {
+		if prior := req.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+			ip = strings.Join(prior, ", ") + ", " + ip
+		}
+		req.Header.Set("X-Forwarded-For", ip)
+	}
+}
+
+// setVia appends the proxy to the Via header of a response, unless in anonymous mode
+func (conf HeadersConf) setVia(resp *http.Response) {
+	if !conf.Anonymous {
+		resp.Header.Add("Via", conf.getVia(resp.ProtoMajor, resp.ProtoMinor))
+	}
+}
@@ -0,0 +1,143 @@
+package proxydialer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_HEALTH_INTERVAL  = 30 * time.Second
+	DEFAULT_HEALTH_TIMEOUT   = 5 * time.Second
+	DEFAULT_HEALTH_THRESHOLD = 3
+)
+
+type HealthCheckConf struct {
+	Enabled bool `yaml:"enabled"`
+	// URL fetched through every proxy, only the proxy handshake is checked when empty
+	URL      string        `yaml:"url"`
+	Interval time.Duration `yaml:"interval"`
+	Timeout  time.Duration `yaml:"timeout"`
+	// Consecutive failed probes before a proxy is considered down
+	FailureThreshold int `yaml:"failure_threshold"`
+}
+
+// healthChecker periodically probes the upstreams of a balancer and marks them up or down
+type healthChecker struct {
+	url       string
+	interval  time.Duration
+	timeout   time.Duration
+	threshold int
+	failures  map[*upstream]int
+}
+
+func newHealthChecker(conf HealthCheckConf) *healthChecker {
+	checker := &healthChecker{
+		url:       conf.URL,
+		interval:  conf.Interval,
+		timeout:   conf.Timeout,
+		threshold: conf.FailureThreshold,
+		failures:  make(map[*upstream]int),
+	}
+	if checker.interval <= 0 {
+		checker.interval = DEFAULT_HEALTH_INTERVAL
+	}
+	if checker.timeout <= 0 {
+		checker.timeout = DEFAULT_HEALTH_TIMEOUT
+	}
+	if checker.threshold <= 0 {
+		checker.threshold = DEFAULT_HEALTH_THRESHOLD
+	}
+	return checker
+}
+
+// probeHandshake checks that the proxy server accepts connections, for SOCKS5 servers
+// the method negotiation is performed as well
+func probeHandshake(conf ProxyConf, timeout time.Duration) error {
+	if conf.Protocol == WIREGUARD || conf.Protocol == HTTP3 {
+		// UDP based protocols have no handshake that can be checked without a destination
+		return nil
+	}
+	conn, err := net.DialTimeout("tcp", conf.getProxyAddr(), timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if conf.Protocol != SOCKS5 || conf.Transport != nil || (conf.TLS != nil && conf.TLS.Enabled) {
+		return nil
+	}
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	// VER, NMETHODS, NO AUTHENTICATION, USERNAME/PASSWORD
+	if _, err := conn.Write([]byte{0x05, 0x02, 0x00, 0x02}); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != 0x05 {
+		return fmt.Errorf("unexpected SOCKS version %d", reply[0])
+	}
+	if reply[1] == 0xff {
+		return errors.New("no acceptable SOCKS authentication method")
+	}
+	return nil
+}
+
+// probe checks a single upstream
+func (c *healthChecker) probe(u *upstream) error {
+	if c.url == "" {
+		return probeHandshake(u.conf, c.timeout)
+	}
+	_, err := probeLatency(u, c.url, c.timeout)
+	return err
+}
+
+// check probes all upstreams at once and updates their state
+func (c *healthChecker) check(upstreams []*upstream) {
+	errs := make([]error, len(upstreams))
+	var wg sync.WaitGroup
+	for i, u := range upstreams {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = c.probe(u)
+		}()
+	}
+	wg.Wait()
+
+	for i, u := range upstreams {
+		if errs[i] == nil {
+			c.failures[u] = 0
+			if u.down.Swap(false) {
+				slog.Info("Proxy is up", "proxy", u.getName())
+				emitEvent(func(h EventHandler) { h.OnUpstreamUp(u.getName()) })
+			}
+			continue
+		}
+		c.failures[u]++
+		if c.failures[u] >= c.threshold && !u.down.Swap(true) {
+			slog.Warn("Proxy is down", "proxy", u.getName(), "err", errs[i])
+			emitEvent(func(h EventHandler) { h.OnUpstreamDown(u.getName(), errs[i]) })
+		}
+	}
+}
+
+// run checks the upstreams every interval until done is closed
+func (c *healthChecker) run(done chan struct{}, upstreams []*upstream) {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		c.check(upstreams)
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package proxydialer
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+)
+
+const (
+	LOG_OUTPUT_SYSLOG   = "syslog"
+	LOG_OUTPUT_EVENTLOG = "eventlog"
+)
+
+// SyslogConf configures the logs sent to the log of the host
+type SyslogConf struct {
+	// Syslog server like "udp://logs.example.com:514" or "tcp://...", the local syslog when empty
+	Address string `yaml:"address"`
+	// Syslog facility, "daemon" (default), "user" or "local0" to "local7"
+	Facility string `yaml:"facility"`
+	// Syslog tag and Windows event source, default "proxydialer"
+	Tag string `yaml:"tag"`
+}
+
+func (conf SyslogConf) getTag() string {
+	if conf.Tag == "" {
+		return "proxydialer"
+	}
+	return conf.Tag
+}
+
+// hostLog is the syslog or the Windows event log
+type hostLog interface {
+	write(level slog.Level, msg string) error
+	Close() error
+}
+
+// hostLogOutput writes the record being handled with the severity of its level
+type hostLogOutput struct {
+	mu    sync.Mutex
+	level slog.Level
+	log   hostLog
+}
+
+func (o *hostLogOutput) Write(b []byte) (int, error) {
+	if err := o.log.write(o.level, string(b)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// hostLogHandler formats the records with the handler writing to out
+type hostLogHandler struct {
+	slog.Handler
+	out *hostLogOutput
+}
+
+func (h hostLogHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.out.mu.Lock()
+	defer h.out.mu.Unlock()
+	h.out.level = r.Level
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h hostLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return hostLogHandler{h.Handler.WithAttrs(attrs), h.out}
+}
+
+func (h hostLogHandler) WithGroup(name string) slog.Handler {
+	return hostLogHandler{h.Handler.WithGroup(name), h.out}
+}
+
+// withoutTime leaves the time out of the records, the host log adds its own
+func withoutTime(groups []string, a slog.Attr) slog.Attr {
+	if len(groups) == 0 && a.Key == slog.TimeKey {
+		return slog.Attr{}
+	}
+	return a
+}
@@ -0,0 +1,73 @@
+//go:build !windows
+
+package proxydialer
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"log/syslog"
+	"net/url"
+)
+
+var syslogFacilities = map[string]syslog.Priority{
+	"":       syslog.LOG_DAEMON,
+	"daemon": syslog.LOG_DAEMON,
+	"user":   syslog.LOG_USER,
+	"local0": syslog.LOG_LOCAL0,
+	"local1": syslog.LOG_LOCAL1,
+	"local2": syslog.LOG_LOCAL2,
+	"local3": syslog.LOG_LOCAL3,
+	"local4": syslog.LOG_LOCAL4,
+	"local5": syslog.LOG_LOCAL5,
+	"local6": syslog.LOG_LOCAL6,
+	"local7": syslog.LOG_LOCAL7,
+}
+
+func (conf SyslogConf) validate() error {
+	if _, ok := syslogFacilities[conf.Facility]; !ok {
+		return fmt.Errorf("unknown syslog facility: %s", conf.Facility)
+	}
+	if conf.Address != "" {
+		if _, err := url.Parse(conf.Address); err != nil {
+			return fmt.Errorf("syslog address: %w", err)
+		}
+	}
+	return nil
+}
+
+type syslogOutput struct {
+	*syslog.Writer
+}
+
+func (o syslogOutput) write(level slog.Level, msg string) error {
+	switch {
+	case level >= slog.LevelError:
+		return o.Err(msg)
+	case level >= slog.LevelWarn:
+		return o.Warning(msg)
+	case level >= slog.LevelInfo:
+		return o.Info(msg)
+	}
+	return o.Debug(msg)
+}
+
+func openSyslog(conf SyslogConf) (hostLog, error) {
+	var network, address string
+	if conf.Address != "" {
+		u, err := url.Parse(conf.Address)
+		if err != nil {
+			return nil, err
+		}
+		network, address = u.Scheme, u.Host
+	}
+	writer, err := syslog.Dial(network, address, syslogFacilities[conf.Facility]|syslog.LOG_INFO, conf.getTag())
+	if err != nil {
+		return nil, err
+	}
+	return syslogOutput{writer}, nil
+}
+
+func openEventLog(conf SyslogConf) (hostLog, error) {
+	return nil, errors.New("the event log is only available on Windows")
+}
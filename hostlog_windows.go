@@ -0,0 +1,45 @@
+package proxydialer
+
+import (
+	"errors"
+	"log/slog"
+
+	"golang.org/x/sys/windows/svc/eventlog"
+)
+
+// Event ID of the records, EventCreate accepts 1 to 1000
+const eventLogID = 1
+
+func (conf SyslogConf) validate() error {
+	return nil
+}
+
+type eventLogOutput struct {
+	*eventlog.Log
+}
+
+func (o eventLogOutput) write(level slog.Level, msg string) error {
+	switch {
+	case level >= slog.LevelError:
+		return o.Error(eventLogID, msg)
+	case level >= slog.LevelWarn:
+		return o.Warning(eventLogID, msg)
+	}
+	return o.Info(eventLogID, msg)
+}
+
+func openSyslog(conf SyslogConf) (hostLog, error) {
+	return nil, errors.New("syslog isn't available on Windows, use the event log")
+}
+
+// openEventLog registers the tag as an event source, which requires the rights of an administrator
+// the first time, and opens the event log
+func openEventLog(conf SyslogConf) (hostLog, error) {
+	// the source is already registered by a previous run
+	eventlog.InstallAsEventCreate(conf.getTag(), eventlog.Error|eventlog.Warning|eventlog.Info)
+	log, err := eventlog.Open(conf.getTag())
+	if err != nil {
+		return nil, err
+	}
+	return eventLogOutput{log}, nil
+}
@@ -0,0 +1,136 @@
+package proxydialer
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// dummyHash is compared with the passwords of unknown users, so that they take as long as wrong passwords
+var dummyHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("proxydialer"), bcrypt.DefaultCost)
+	return hash
+})
+
+// readHtpasswd reads the bcrypt hashes of an htpasswd file (htpasswd -B), lines with other hashes are skipped
+func readHtpasswd(path string) (map[string][]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	hashes := make(map[string][]byte)
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		username, hash, found := strings.Cut(text, ":")
+		if !found || username == "" {
+			return nil, fmt.Errorf("%s:%d: expected username:hash", path, line)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			slog.Warn("User skipped, only bcrypt hashes are supported", "file", path, "line", line, "user", username)
+			continue
+		}
+		hashes[username] = []byte(hash)
+	}
+	return hashes, scanner.Err()
+}
+
+// loadUsersFile replaces the users of the users file, the previous ones are kept if it can't be read
+func (a *authenticator) loadUsersFile() error {
+	hashes, err := readHtpasswd(a.usersFile)
+	if err != nil {
+		return err
+	}
+	// hashed now rather than on the first unknown user
+	dummyHash()
+	a.mu.Lock()
+	a.hashes = hashes
+	a.verified = make(map[string][]byte)
+	if a.verifiedKey == nil {
+		a.verifiedKey = make([]byte, 32)
+		rand.Read(a.verifiedKey)
+	}
+	a.mu.Unlock()
+	return nil
+}
+
+// getVerifiedMAC returns the keyed hash of a verified password remembered in place of the password
+func (a *authenticator) getVerifiedMAC(password string) []byte {
+	mac := hmac.New(sha256.New, a.verifiedKey)
+	mac.Write([]byte(password))
+	return mac.Sum(nil)
+}
+
+// watchUsersFile reloads the users file when it is modified
+func (a *authenticator) watchUsersFile() error {
+	modify := make(chan int)
+	watcher, err := newConfigWatcher(modify)
+	if err != nil {
+		return err
+	}
+	a.watcher = watcher
+	a.done = make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-a.done:
+				return
+			case <-modify:
+			}
+			if err := a.loadUsersFile(); err != nil {
+				slog.Error("Cannot load the users file", "file", a.usersFile, "err", err)
+				continue
+			}
+			a.mu.RLock()
+			slog.Info("Users file loaded", "file", a.usersFile, "users", len(a.hashes))
+			a.mu.RUnlock()
+		}
+	}()
+	return watcher.watch([]string{a.usersFile})
+}
+
+// checkUsersFile verifies credentials against the users file, a keyed hash of the passwords already
+// verified is remembered since bcrypt is too slow for every request
+func (a *authenticator) checkUsersFile(username, password string) bool {
+	a.mu.RLock()
+	hash, ok := a.hashes[username]
+	verified, cached := a.verified[username]
+	a.mu.RUnlock()
+	if !ok {
+		// compare anyway so that unknown users take as long as wrong passwords
+		bcrypt.CompareHashAndPassword(dummyHash(), []byte(password))
+		return false
+	}
+	mac := a.getVerifiedMAC(password)
+	if cached && hmac.Equal(verified, mac) {
+		return true
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return false
+	}
+	a.mu.Lock()
+	a.verified[username] = mac
+	a.mu.Unlock()
+	return true
+}
+
+func (a *authenticator) Close() error {
+	if a.watcher == nil {
+		return nil
+	}
+	close(a.done)
+	return a.watcher.Close()
+}
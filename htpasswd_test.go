@@ -0,0 +1,144 @@
+package proxydialer
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// bcryptHash hashes the password with the minimum cost to keep the tests fast
+func bcryptHash(t *testing.T, password string) string {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(hash)
+}
+
+func writeUsersFile(t *testing.T, path string, lines ...string) {
+	t.Helper()
+	var data []byte
+	for _, line := range lines {
+		data = append(data, line+"\n"...)
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadHtpasswd(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users")
+	writeUsersFile(t, path,
+		"# users of the proxy",
+		"",
+		"alice:"+bcryptHash(t, "secret"),
+		"  bob:"+bcryptHash(t, "hunter2")+"  ",
+		"md5:$apr1$salt$0123456789abcdefghijkl",
+		"sha:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=",
+		"plain:password",
+	)
+	hashes, err := readHtpasswd(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hashes) != 2 {
+		t.Fatalf("read %d users, want alice and bob only", len(hashes))
+	}
+	if bcrypt.CompareHashAndPassword(hashes["alice"], []byte("secret")) != nil {
+		t.Error("hash of alice doesn't match her password")
+	}
+	if bcrypt.CompareHashAndPassword(hashes["bob"], []byte("hunter2")) != nil {
+		t.Error("hash of bob doesn't match his password")
+	}
+}
+
+func TestReadHtpasswdInvalid(t *testing.T) {
+	dir := t.TempDir()
+	for _, line := range []string{"no separator", ":" + bcryptHash(t, "secret")} {
+		path := filepath.Join(dir, "users")
+		writeUsersFile(t, path, line)
+		if _, err := readHtpasswd(path); err == nil {
+			t.Errorf("readHtpasswd(%q) succeeded, want an error", line)
+		}
+	}
+	if _, err := readHtpasswd(filepath.Join(dir, "missing")); err == nil {
+		t.Error("readHtpasswd of a missing file succeeded")
+	}
+}
+
+func TestUsersFileReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users")
+	writeUsersFile(t, path, "alice:"+bcryptHash(t, "secret"), "bob:"+bcryptHash(t, "hunter2"))
+	auth, err := newAuthenticator(DialerConfig{UsersFile: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !auth.check("alice", "secret") || !auth.check("bob", "hunter2") {
+		t.Fatal("users of the file rejected")
+	}
+	if auth.check("alice", "wrong") || auth.check("carol", "secret") {
+		t.Fatal("wrong password or unknown user accepted")
+	}
+	if _, ok := auth.verified["alice"]; !ok {
+		t.Fatal("verified password of alice not remembered")
+	}
+
+	// the password of alice changes and bob is removed
+	writeUsersFile(t, path, "alice:"+bcryptHash(t, "changed"))
+	if err := auth.loadUsersFile(); err != nil {
+		t.Fatal(err)
+	}
+	if len(auth.verified) != 0 {
+		t.Errorf("%d verified passwords kept after a reload", len(auth.verified))
+	}
+	if auth.check("alice", "secret") {
+		t.Error("previous password of alice accepted after a reload")
+	}
+	if !auth.check("alice", "changed") {
+		t.Error("new password of alice rejected")
+	}
+	if auth.check("bob", "hunter2") {
+		t.Error("removed user accepted after a reload")
+	}
+
+	// a file that can't be read keeps the previous users
+	writeUsersFile(t, path, "invalid")
+	if err := auth.loadUsersFile(); err == nil {
+		t.Fatal("invalid users file loaded")
+	}
+	if !auth.check("alice", "changed") {
+		t.Error("users lost with an invalid users file")
+	}
+}
+
+func TestWatchUsersFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users")
+	writeUsersFile(t, path, "alice:"+bcryptHash(t, "secret"), "bob:"+bcryptHash(t, "hunter2"))
+	auth, err := newAuthenticator(DialerConfig{UsersFile: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := auth.watchUsersFile(); err != nil {
+		t.Fatal(err)
+	}
+	defer auth.Close()
+	if !auth.check("bob", "hunter2") {
+		t.Fatal("bob rejected before the reload")
+	}
+
+	writeUsersFile(t, path, "alice:"+bcryptHash(t, "secret"))
+	deadline := time.Now().Add(5 * time.Second)
+	for auth.check("bob", "hunter2") {
+		if time.Now().After(deadline) {
+			t.Fatal("removed user still accepted after the users file was modified")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if !auth.check("alice", "secret") {
+		t.Error("alice rejected after the reload")
+	}
+}
@@ -0,0 +1,145 @@
+package proxydialer
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/net/proxy"
+)
+
+// http3ProxyDialer tunnels TCP with CONNECT requests over a single HTTP/3 connection to the proxy
+type http3ProxyDialer struct {
+	addr       string
+	auth       string
+	tlsConfig  *tls.Config
+	quicConfig *quic.Config
+	h3         *http3.Transport
+
+	mu   sync.Mutex
+	conn quic.Connection
+	cc   *http3.ClientConn
+}
+
+// http3StreamConn is a CONNECT stream of an HTTP/3 connection
+type http3StreamConn struct {
+	http3.RequestStream
+	localAddr  net.Addr
+	remoteAddr net.Addr
+}
+
+// establishHTTP3Proxy prepares an experimental dialer doing CONNECT over HTTP/3 (QUIC)
+func establishHTTP3Proxy(conf ProxyConf) (proxy.Dialer, error) {
+	tlsConfig, err := conf.TLS.getTLSConfig(conf.getServerHost())
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.NextProtos = []string{http3.NextProtoH3}
+	var auth string
+	if conf.Username != "" || conf.Password != "" {
+		auth = "Basic " + base64.StdEncoding.EncodeToString([]byte(conf.Username+":"+conf.Password))
+	}
+	return &http3ProxyDialer{
+		addr:       conf.getProxyAddr(),
+		auth:       auth,
+		tlsConfig:  tlsConfig,
+		quicConfig: &quic.Config{KeepAlivePeriod: 15 * time.Second},
+		h3:         &http3.Transport{},
+	}, nil
+}
+
+// getClientConn returns the shared HTTP/3 connection, reconnecting when it was closed
+func (d *http3ProxyDialer) getClientConn(ctx context.Context) (*http3.ClientConn, quic.Connection, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.cc != nil && d.conn.Context().Err() == nil {
+		return d.cc, d.conn, nil
+	}
+	conn, err := quic.DialAddr(ctx, d.addr, d.tlsConfig, d.quicConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	d.conn = conn
+	d.cc = d.h3.NewClientConn(conn)
+	return d.cc, d.conn, nil
+}
+
+func (d *http3ProxyDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+func (d *http3ProxyDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
+		return nil, errors.New("h3 proxy: unsupported network " + network)
+	}
+	cc, conn, err := d.getClientConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	str, err := cc.OpenRequestStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// abort the stream if ctx is done before the tunnel is established
+	stop := context.AfterFunc(ctx, func() {
+		str.CancelRead(quic.StreamErrorCode(http3.ErrCodeRequestCanceled))
+		str.CancelWrite(quic.StreamErrorCode(http3.ErrCodeRequestCanceled))
+	})
+	defer stop()
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Host: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if d.auth != "" {
+		req.Header.Set("Proxy-Authorization", d.auth)
+	}
+	if err := str.SendRequestHeader(req); err != nil {
+		str.Close()
+		return nil, err
+	}
+	resp, err := str.ReadResponse()
+	if err != nil {
+		str.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		str.CancelRead(quic.StreamErrorCode(http3.ErrCodeNoError))
+		str.Close()
+		return nil, fmt.Errorf("h3 proxy: CONNECT %s: %s", address, resp.Status)
+	}
+	return &http3StreamConn{
+		RequestStream: str,
+		localAddr:     conn.LocalAddr(),
+		remoteAddr:    tunnelAddr(address),
+	}, nil
+}
+
+func (d *http3ProxyDialer) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.conn == nil {
+		return nil
+	}
+	return d.conn.CloseWithError(quic.ApplicationErrorCode(http3.ErrCodeNoError), "")
+}
+
+// Close closes both directions, closing a QUIC stream only finishes its write side
+func (c *http3StreamConn) Close() error {
+	c.CancelRead(quic.StreamErrorCode(http3.ErrCodeNoError))
+	return c.RequestStream.Close()
+}
+
+func (c *http3StreamConn) LocalAddr() net.Addr  { return c.localAddr }
+func (c *http3StreamConn) RemoteAddr() net.Addr { return c.remoteAddr }
@@ -0,0 +1,91 @@
+package proxydialer
+
+import (
+	"net/http"
+	"runtime"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+const (
+	DEFAULT_HTTP_POOL_MAX_IDLE_CONNS    = 100
+	DEFAULT_HTTP_POOL_IDLE_CONN_TIMEOUT = 60 * time.Second
+	DEFAULT_EXPECT_CONTINUE_TIMEOUT     = time.Second
+)
+
+// HTTPPoolConf sizes the pools of connections reused by the plain HTTP requests of a listener
+type HTTPPoolConf struct {
+	// Idle connections kept, default 100
+	MaxIdleConns int `yaml:"max_idle_conns"`
+	// Idle connections kept per host, default the number of CPUs + 1
+	MaxIdleConnsPerHost int `yaml:"max_idle_conns_per_host"`
+	// Connections per host, no limit when 0
+	MaxConnsPerHost int `yaml:"max_conns_per_host"`
+	// How long an idle connection is kept, default "60s"
+	IdleConnTimeout time.Duration `yaml:"idle_conn_timeout"`
+	// How long the body of an "Expect: 100-continue" request waits for the 100 Continue of the origin
+	// before being sent anyway, default "1s"
+	ExpectContinueTimeout time.Duration `yaml:"expect_continue_timeout"`
+}
+
+func newHTTPTransport(dialer proxy.Dialer, conf HTTPPoolConf) *http.Transport {
+	transport := &http.Transport{
+		DialContext:           getDialContext(dialer),
+		MaxIdleConns:          conf.MaxIdleConns,
+		IdleConnTimeout:       conf.IdleConnTimeout,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: conf.ExpectContinueTimeout,
+		MaxIdleConnsPerHost:   conf.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       conf.MaxConnsPerHost,
+	}
+	if transport.MaxIdleConns <= 0 {
+		transport.MaxIdleConns = DEFAULT_HTTP_POOL_MAX_IDLE_CONNS
+	}
+	if transport.IdleConnTimeout <= 0 {
+		transport.IdleConnTimeout = DEFAULT_HTTP_POOL_IDLE_CONN_TIMEOUT
+	}
+	if transport.ExpectContinueTimeout <= 0 {
+		transport.ExpectContinueTimeout = DEFAULT_EXPECT_CONTINUE_TIMEOUT
+	}
+	if transport.MaxIdleConnsPerHost <= 0 {
+		transport.MaxIdleConnsPerHost = runtime.GOMAXPROCS(0) + 1
+	}
+	return transport
+}
+
+// httpTransports send the plain HTTP requests of a listener, with a transport per dialer
+// so that a connection dialed through a proxy isn't reused by the users of another one
+type httpTransports struct {
+	transport *http.Transport
+	users     map[string]*http.Transport
+}
+
+func newHTTPTransports(dialer proxy.Dialer, conf HTTPPoolConf) *httpTransports {
+	t := &httpTransports{users: make(map[string]*http.Transport)}
+	if d, ok := dialer.(*userDialer); ok {
+		for user, userDialer := range d.users {
+			t.users[user] = newHTTPTransport(userDialer, conf)
+		}
+		dialer = d.dialer
+	}
+	t.transport = newHTTPTransport(dialer, conf)
+	return t
+}
+
+// get returns the transport of the user of a request
+func (t *httpTransports) get(req *http.Request) *http.Transport {
+	if transport, ok := t.users[getUser(req.Context())]; ok {
+		return transport
+	}
+	return t.transport
+}
+
+// Close closes the idle connections once the listener is stopped
+func (t *httpTransports) Close() error {
+	t.transport.CloseIdleConnections()
+	for _, transport := range t.users {
+		transport.CloseIdleConnections()
+	}
+	return nil
+}
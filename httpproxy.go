@@ -0,0 +1,317 @@
+package proxydialer
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/proxy"
+)
+
+// httpProxyDialer opens tunnels with CONNECT requests to an HTTP(S) proxy, one connection per tunnel
+type httpProxyDialer struct {
+	transport *transportDialer
+	auth      string
+}
+
+// http2ProxyDialer multiplexes CONNECT streams over a single HTTP/2 connection to the proxy
+type http2ProxyDialer struct {
+	transport *transportDialer
+	auth      string
+	h2        *http2.Transport
+
+	mu sync.Mutex
+	// the connections still carrying streams, a new one is added when none can take more
+	conns []*http2.ClientConn
+}
+
+// bufferedConn reads the bytes already buffered while parsing the CONNECT response first
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+// http2StreamConn is a CONNECT stream of an HTTP/2 connection
+type http2StreamConn struct {
+	body       io.ReadCloser
+	writer     *io.PipeWriter
+	cancel     context.CancelFunc
+	localAddr  net.Addr
+	remoteAddr net.Addr
+
+	mu         sync.Mutex
+	readTimer  *time.Timer
+	writeTimer *time.Timer
+	expired    atomic.Bool
+}
+
+// tunnelAddr is a tunnel destination address that is never resolved locally
+type tunnelAddr string
+
+func (a tunnelAddr) Network() string { return "tcp" }
+func (a tunnelAddr) String() string  { return string(a) }
+
+// establishHTTPProxy prepares a dialer for HTTP and HTTPS proxies
+func establishHTTPProxy(conf ProxyConf, forward proxy.Dialer) (proxy.Dialer, error) {
+	useTLS := conf.Protocol == HTTPS
+	if conf.HTTP2 && !useTLS {
+		return nil, errors.New("http2 requires https protocol")
+	}
+	transport, err := newTransportDialer(conf, useTLS, forward)
+	if err != nil {
+		return nil, err
+	}
+	var auth string
+	if conf.Username != "" || conf.Password != "" {
+		auth = "Basic " + base64.StdEncoding.EncodeToString([]byte(conf.Username+":"+conf.Password))
+	}
+	if !conf.HTTP2 {
+		return &httpProxyDialer{transport: transport, auth: auth}, nil
+	}
+
+	transport.tlsConfig.NextProtos = []string{http2.NextProtoTLS}
+	return &http2ProxyDialer{
+		transport: transport,
+		auth:      auth,
+		h2:        &http2.Transport{ReadIdleTimeout: 30 * time.Second},
+	}, nil
+}
+
+func (d *httpProxyDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+func (d *httpProxyDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
+		return nil, errors.New("http proxy: unsupported network " + network)
+	}
+	conn, err := d.transport.dialContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if d.auth != "" {
+		req.Header.Set("Proxy-Authorization", d.auth)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// The body of a successful CONNECT response is the tunnel itself, it must not be drained
+	if resp.StatusCode/100 != 2 {
+		conn.Close()
+		return nil, fmt.Errorf("http proxy: CONNECT %s: %s", address, resp.Status)
+	}
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	if c.reader.Buffered() > 0 {
+		return c.reader.Read(b)
+	}
+	return c.Conn.Read(b)
+}
+
+// getClientConn returns a shared HTTP/2 connection, establishing a new one when none can take more streams.
+// The other connections are closed once their streams are over
+func (d *http2ProxyDialer) getClientConn(ctx context.Context) (*http2.ClientConn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	conns := d.conns[:0]
+	var available *http2.ClientConn
+	for _, cc := range d.conns {
+		if available == nil && cc.CanTakeNewRequest() {
+			available = cc
+			conns = append(conns, cc)
+			continue
+		}
+		if state := cc.State(); !state.Closed && (state.StreamsActive > 0 || state.StreamsPending > 0) {
+			conns = append(conns, cc)
+			continue
+		}
+		cc.Close()
+	}
+	clear(d.conns[len(conns):])
+	d.conns = conns
+	if available != nil {
+		return available, nil
+	}
+	conn, err := d.transport.dialContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cc, err := d.h2.NewClientConn(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	d.conns = append(d.conns, cc)
+	return cc, nil
+}
+
+func (d *http2ProxyDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+func (d *http2ProxyDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
+		return nil, errors.New("http proxy: unsupported network " + network)
+	}
+	cc, err := d.getClientConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	reader, writer := io.Pipe()
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Host: address},
+		Host:   address,
+		Header: make(http.Header),
+		Body:   reader,
+	}
+	if d.auth != "" {
+		req.Header.Set("Proxy-Authorization", d.auth)
+	}
+	// The stream lives as long as the request context, so ctx may only cancel it until the tunnel is established
+	streamCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	stop := context.AfterFunc(ctx, cancel)
+	resp, err := cc.RoundTrip(req.WithContext(streamCtx))
+	if !stop() && err == nil {
+		resp.Body.Close()
+		err = ctx.Err()
+	}
+	if err != nil {
+		cancel()
+		writer.Close()
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		cancel()
+		resp.Body.Close()
+		writer.Close()
+		return nil, fmt.Errorf("http proxy: CONNECT %s: %s", address, resp.Status)
+	}
+	return &http2StreamConn{
+		body:       resp.Body,
+		writer:     writer,
+		cancel:     cancel,
+		localAddr:  tunnelAddr(""),
+		remoteAddr: tunnelAddr(address),
+	}, nil
+}
+
+func (d *http2ProxyDialer) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var errs []error
+	for _, cc := range d.conns {
+		errs = append(errs, cc.Close())
+	}
+	d.conns = nil
+	return errors.Join(errs...)
+}
+
+func (c *http2StreamConn) Read(b []byte) (int, error) {
+	n, err := c.body.Read(b)
+	if err != nil && c.expired.Load() {
+		err = os.ErrDeadlineExceeded
+	}
+	return n, err
+}
+
+func (c *http2StreamConn) Write(b []byte) (int, error) {
+	n, err := c.writer.Write(b)
+	if err != nil && c.expired.Load() {
+		err = os.ErrDeadlineExceeded
+	}
+	return n, err
+}
+
+func (c *http2StreamConn) Close() error {
+	defer c.cancel()
+	c.mu.Lock()
+	c.stopTimer(&c.readTimer)
+	c.stopTimer(&c.writeTimer)
+	c.mu.Unlock()
+	c.writer.Close()
+	return c.body.Close()
+}
+
+func (c *http2StreamConn) LocalAddr() net.Addr  { return c.localAddr }
+func (c *http2StreamConn) RemoteAddr() net.Addr { return c.remoteAddr }
+
+// A stream can't be interrupted and used again, so it is canceled when a deadline is reached: the reads
+// and writes return os.ErrDeadlineExceeded from then on, even if the deadline is extended
+func (c *http2StreamConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.setTimer(&c.readTimer, t)
+	c.setTimer(&c.writeTimer, t)
+	return nil
+}
+
+func (c *http2StreamConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.setTimer(&c.readTimer, t)
+	return nil
+}
+
+func (c *http2StreamConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.setTimer(&c.writeTimer, t)
+	return nil
+}
+
+// setTimer cancels the stream at t, no deadline is set when t is zero
+func (c *http2StreamConn) setTimer(timer **time.Timer, t time.Time) {
+	c.stopTimer(timer)
+	if !t.IsZero() {
+		*timer = time.AfterFunc(time.Until(t), c.expire)
+	}
+}
+
+func (c *http2StreamConn) stopTimer(timer **time.Timer) {
+	if *timer != nil {
+		(*timer).Stop()
+		*timer = nil
+	}
+}
+
+func (c *http2StreamConn) expire() {
+	c.expired.Store(true)
+	c.cancel()
+	c.writer.CloseWithError(os.ErrDeadlineExceeded)
+}
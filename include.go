@@ -0,0 +1,156 @@
+package proxydialer
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// includedExtensions are the files of an included directory merged into the configuration
+var includedExtensions = []string{".yaml", ".yml", ".json", ".toml"}
+
+// getIncludeDir returns the directory the included files are relative to, the working directory
+// for a configuration given by a URL
+func getIncludeDir(configFile string) string {
+	if isConfigURL(configFile) {
+		return "."
+	}
+	return filepath.Dir(configFile)
+}
+
+func resolveInclude(configFile, pattern string) string {
+	if filepath.IsAbs(pattern) {
+		return pattern
+	}
+	return filepath.Join(getIncludeDir(configFile), pattern)
+}
+
+// getIncludedFiles returns the files of the include directive in the order they are merged: a file, the files
+// matching a pattern like "proxies/*.yaml" or the configuration files of a directory like "conf.d", sorted by name
+func getIncludedFiles(configFile string, include []string) ([]string, error) {
+	var files []string
+	for _, pattern := range include {
+		path := resolveInclude(configFile, pattern)
+		if info, err := os.Stat(path); err == nil && info.IsDir() {
+			entries, err := os.ReadDir(path)
+			if err != nil {
+				return nil, err
+			}
+			for _, entry := range entries {
+				ext := strings.ToLower(filepath.Ext(entry.Name()))
+				if !entry.IsDir() && slices.Contains(includedExtensions, ext) {
+					files = append(files, filepath.Join(path, entry.Name()))
+				}
+			}
+			continue
+		}
+		matches, err := filepath.Glob(path)
+		if err != nil {
+			return nil, fmt.Errorf("include %s: %w", pattern, err)
+		}
+		// a pattern may match no file, a file must exist
+		if len(matches) == 0 && !hasGlobMeta(pattern) {
+			return nil, fmt.Errorf("include %s: no such file", pattern)
+		}
+		files = append(files, matches...)
+	}
+	return files, nil
+}
+
+func hasGlobMeta(pattern string) bool {
+	return strings.ContainsAny(pattern, "*?[")
+}
+
+// getWatchedPaths returns the configuration file and the included ones, with the directories and the ones
+// of the patterns so that the files added are merged too
+func getWatchedPaths(configFile string, include []string) []string {
+	var paths []string
+	if !isConfigURL(configFile) {
+		paths = append(paths, configFile)
+	}
+	for _, pattern := range include {
+		path := resolveInclude(configFile, pattern)
+		if hasGlobMeta(pattern) {
+			path = filepath.Dir(path)
+		}
+		if !slices.Contains(paths, path) {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// readConfigValues returns the settings of a configuration file decoded without their types, to be merged
+func readConfigValues(configFile string) (map[string]any, error) {
+	data, err := readConfigData(configFile)
+	if err != nil {
+		return nil, err
+	}
+	data, err = toYAML(getConfigName(configFile), data)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]any)
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		return nil, fmt.Errorf("%s: %w", configFile, err)
+	}
+	return values, nil
+}
+
+// includeConfig merges the included files into the configuration, data converted to YAML, in order
+// and returns it as YAML
+func includeConfig(configFile string, data []byte, include []string) ([]byte, error) {
+	values := make(map[string]any)
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		return nil, err
+	}
+	files, err := getIncludedFiles(configFile, include)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		included, err := readConfigValues(file)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := included["include"]; ok {
+			return nil, errors.New(file + ": include is only supported in the main configuration file")
+		}
+		mergeValues(values, included)
+	}
+	return yaml.Marshal(values)
+}
+
+// mergeValues merges src into dst: lists are concatenated, maps merged and the other values of src override
+// the ones of dst
+func mergeValues(dst, src map[string]any) {
+	for key, value := range src {
+		switch value := value.(type) {
+		case map[string]any:
+			if current, ok := dst[key].(map[string]any); ok {
+				mergeValues(current, value)
+				continue
+			}
+			// a list with a single element, like the listeners, can be written without the list
+			if current, ok := dst[key].([]any); ok {
+				dst[key] = append(current, value)
+				continue
+			}
+		case []any:
+			switch current := dst[key].(type) {
+			case []any:
+				dst[key] = append(current, value...)
+				continue
+			case map[string]any:
+				dst[key] = append([]any{current}, value...)
+				continue
+			}
+		}
+		dst[key] = value
+	}
+}
@@ -0,0 +1,36 @@
+package proxydialer
+
+import (
+	_ "embed"
+	"fmt"
+	"os"
+)
+
+// exampleConfig is the commented configuration written by the init command
+//
+//go:embed config.yaml.dist
+var exampleConfig []byte
+
+// initConfig writes the example configuration to the file given, or to the one the server reads,
+// and returns the exit code of the init command, an existing file is not overwritten
+func initConfig(args []string) int {
+	configFile := getConfigFile()
+	if len(args) > 0 {
+		configFile = args[0]
+	}
+	if configFile == "" {
+		configFile = DEFAULT_CONFIG_FILE_NAME
+	}
+	file, err := os.OpenFile(configFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot write the configuration: %s\n", err)
+		return 1
+	}
+	defer file.Close()
+	if _, err := file.Write(exampleConfig); err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot write the configuration: %s\n", err)
+		return 1
+	}
+	fmt.Printf("Configuration written to %s\n", configFile)
+	return 0
+}
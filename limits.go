@@ -0,0 +1,152 @@
+package proxydialer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/net/proxy"
+)
+
+var (
+	errTooManyTunnels       = errors.New("too many open tunnels")
+	errTooManyClientTunnels = errors.New("too many open tunnels for this client")
+)
+
+// LimitsConf caps the tunnels open at the same time and their throughput,
+// the CONNECT requests over a limit are answered with 503
+type LimitsConf struct {
+	// Tunnels of all the clients, no limit when 0
+	MaxTunnels int `yaml:"max_tunnels"`
+	// Tunnels of a client IP, no limit when 0
+	MaxTunnelsPerClient int `yaml:"max_tunnels_per_client"`
+	// Throughput of all the tunnels from the clients in kilobits per second, no limit when 0
+	MaxUpload int `yaml:"max_upload"`
+	// Throughput of all the tunnels to the clients in kilobits per second, no limit when 0
+	MaxDownload int `yaml:"max_download"`
+	// Throughput from each client in kilobits per second, no limit when 0
+	MaxClientUpload int `yaml:"max_client_upload"`
+	// Throughput to each client in kilobits per second, no limit when 0
+	MaxClientDownload int `yaml:"max_client_download"`
+	// Limits of some clients instead of the ones of every client
+	ClientBandwidth []ClientBandwidthConf `yaml:"client_bandwidth"`
+}
+
+func (conf LimitsConf) validate() error {
+	if conf.MaxTunnels < 0 || conf.MaxTunnelsPerClient < 0 || conf.MaxUpload < 0 || conf.MaxDownload < 0 ||
+		conf.MaxClientUpload < 0 || conf.MaxClientDownload < 0 {
+		return errors.New("negative limit")
+	}
+	_, err := newClientBandwidthRules(conf)
+	return err
+}
+
+// tunnelLimiter counts the tunnels of the process by client IP, the counts are kept across reloads
+type tunnelLimiter struct {
+	maxTunnels          atomic.Int64
+	maxTunnelsPerClient atomic.Int64
+
+	mu      sync.Mutex
+	total   int64
+	clients map[string]int64
+}
+
+var tunnelLimits = &tunnelLimiter{clients: make(map[string]int64)}
+
+func (l *tunnelLimiter) setLimits(conf LimitsConf) {
+	l.maxTunnels.Store(int64(conf.MaxTunnels))
+	l.maxTunnelsPerClient.Store(int64(conf.MaxTunnelsPerClient))
+}
+
+// acquire counts a tunnel of the client until the returned function is called, nil when there is no limit
+func (l *tunnelLimiter) acquire(client string) (func(), error) {
+	maxTunnels, maxTunnelsPerClient := l.maxTunnels.Load(), l.maxTunnelsPerClient.Load()
+	if maxTunnels == 0 && maxTunnelsPerClient == 0 {
+		return nil, nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if maxTunnels > 0 && l.total >= maxTunnels {
+		return nil, errTooManyTunnels
+	}
+	if maxTunnelsPerClient > 0 && l.clients[client] >= maxTunnelsPerClient {
+		return nil, errTooManyClientTunnels
+	}
+	l.total++
+	l.clients[client]++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			l.total--
+			if l.clients[client]--; l.clients[client] <= 0 {
+				delete(l.clients, client)
+			}
+		})
+	}, nil
+}
+
+// limitedConn gives the slot of its tunnel and the limiters of its client back when it is closed
+type limitedConn struct {
+	net.Conn
+	// nil when the tunnels aren't limited
+	release   func()
+	bandwidth *clientBandwidth
+	closed    sync.Once
+}
+
+func (c *limitedConn) Close() error {
+	c.closed.Do(func() {
+		if c.release != nil {
+			c.release()
+		}
+		clientBandwidths.release(c.bandwidth)
+	})
+	return c.Conn.Close()
+}
+
+// dialTunnel dials the destination of a tunnel of the client of ctx, within the limits and the dial timeout
+func dialTunnel(ctx context.Context, dialer proxy.Dialer, network, address string) (net.Conn, error) {
+	release, err := tunnelLimits.acquire(getClientIP(ctx))
+	if err != nil {
+		return nil, err
+	}
+	bandwidth := clientBandwidths.acquire(ctx)
+	ctx, cancel := withDialTimeout(ctx)
+	defer cancel()
+	dial := withTunnelMiddlewares(func(ctx context.Context, network, address string) (net.Conn, error) {
+		return dialContext(ctx, dialer, network, address)
+	})
+	conn, err := dial(ctx, network, address)
+	if err != nil {
+		if release != nil {
+			release()
+		}
+		clientBandwidths.release(bandwidth)
+		return nil, err
+	}
+	if release == nil && bandwidth == nil {
+		return conn, nil
+	}
+	return &limitedConn{Conn: conn, release: release, bandwidth: bandwidth}, nil
+}
+
+// getClientBandwidth returns the limiters of the client a tunnel was dialed for, nil when it isn't limited
+func getClientBandwidth(conn net.Conn) *clientBandwidth {
+	if limited, ok := conn.(*limitedConn); ok {
+		return limited.bandwidth
+	}
+	return nil
+}
+
+// getMeteredConn returns the connection dialed through a proxy under the wrappers of a tunnel
+func getMeteredConn(conn net.Conn) (*meteredConn, bool) {
+	if limited, ok := conn.(*limitedConn); ok {
+		conn = limited.Conn
+	}
+	metered, ok := conn.(*meteredConn)
+	return metered, ok
+}
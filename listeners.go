@@ -0,0 +1,421 @@
+package proxydialer
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	MIN_ACCEPT_RETRY_DELAY = 5 * time.Millisecond
+	MAX_ACCEPT_RETRY_DELAY = time.Second
+)
+
+// acceptResult is a connection accepted by a shared listener, or the error of the accept
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+// sharedListener is a socket kept open across reloads, its connections are accepted by the servers
+// of the configuration running, the ones arriving during a reload wait in the backlog
+type sharedListener struct {
+	addr net.Addr
+	// the socket is replaced when it is bound again, under the mutex of the registry
+	socket net.Listener
+	open   func() (net.Listener, error)
+	conns  chan acceptResult
+	done   chan struct{}
+	// listened by the configuration running
+	used bool
+	// closed to free the port for a configuration being started, and bound again if it fails
+	suspended bool
+}
+
+func (l *sharedListener) run(socket net.Listener) {
+	for {
+		conn, err := socket.Accept()
+		if err != nil && errors.Is(err, net.ErrClosed) {
+			return
+		}
+		select {
+		case l.conns <- acceptResult{conn: conn, err: err}:
+		case <-l.done:
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		}
+	}
+}
+
+func (l *sharedListener) Addr() net.Addr {
+	return l.addr
+}
+
+// listenerHandle accepts the connections of a shared listener until it is closed, the socket stays open
+type listenerHandle struct {
+	*sharedListener
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (h *listenerHandle) Accept() (net.Conn, error) {
+	select {
+	case result := <-h.conns:
+		return result.conn, result.err
+	case <-h.closed:
+	case <-h.done:
+	}
+	return nil, net.ErrClosed
+}
+
+func (h *listenerHandle) Close() error {
+	h.once.Do(func() { close(h.closed) })
+	return nil
+}
+
+// packet is a datagram received by a shared packet connection
+type packet struct {
+	data []byte
+	addr net.Addr
+	err  error
+}
+
+// sharedPacketConn is a UDP socket kept open across reloads like sharedListener
+type sharedPacketConn struct {
+	addr net.Addr
+	// the socket is replaced when it is bound again, the servers of the configuration write to it meanwhile
+	mu        sync.RWMutex
+	socket    net.PacketConn
+	open      func() (net.PacketConn, error)
+	packets   chan packet
+	done      chan struct{}
+	used      bool
+	suspended bool
+}
+
+func (c *sharedPacketConn) run(socket net.PacketConn) {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := socket.ReadFrom(buf)
+		if err != nil && errors.Is(err, net.ErrClosed) {
+			return
+		}
+		select {
+		case c.packets <- packet{data: append([]byte(nil), buf[:n]...), addr: addr, err: err}:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *sharedPacketConn) getSocket() net.PacketConn {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.socket
+}
+
+func (c *sharedPacketConn) setSocket(socket net.PacketConn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.socket = socket
+}
+
+func (c *sharedPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return c.getSocket().WriteTo(b, addr)
+}
+
+func (c *sharedPacketConn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+func (c *sharedPacketConn) SetDeadline(t time.Time) error {
+	return c.getSocket().SetDeadline(t)
+}
+
+func (c *sharedPacketConn) SetReadDeadline(t time.Time) error {
+	return c.getSocket().SetReadDeadline(t)
+}
+
+func (c *sharedPacketConn) SetWriteDeadline(t time.Time) error {
+	return c.getSocket().SetWriteDeadline(t)
+}
+
+// packetConnHandle reads the datagrams of a shared packet connection until it is closed
+type packetConnHandle struct {
+	*sharedPacketConn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (h *packetConnHandle) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case p := <-h.packets:
+		return copy(b, p.data), p.addr, p.err
+	case <-h.closed:
+	case <-h.done:
+	}
+	return 0, nil, net.ErrClosed
+}
+
+func (h *packetConnHandle) Close() error {
+	h.once.Do(func() { close(h.closed) })
+	return nil
+}
+
+// listenerRegistry keeps the sockets of the servers across reloads, a socket is only closed and bound again
+// when the address of its server changes
+type listenerRegistry struct {
+	mu          sync.Mutex
+	listeners   map[string]*sharedListener
+	packetConns map[string]*sharedPacketConn
+}
+
+var sharedListeners = &listenerRegistry{
+	listeners:   make(map[string]*sharedListener),
+	packetConns: make(map[string]*sharedPacketConn),
+}
+
+// begin marks the sockets unused before a configuration is started, it returns the keys of the ones
+// the running configuration uses
+func (r *listenerRegistry) begin() map[string]bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	running := make(map[string]bool)
+	for key, l := range r.listeners {
+		running[key] = l.used
+		l.used = false
+	}
+	for key, c := range r.packetConns {
+		running[key] = c.used
+		c.used = false
+	}
+	return running
+}
+
+// abort closes the sockets opened for a configuration that couldn't be started, the running configuration
+// keeps its own and gets back the ones closed to free their port
+func (r *listenerRegistry) abort(running map[string]bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for key, l := range r.listeners {
+		l.used = running[key]
+	}
+	for key, c := range r.packetConns {
+		c.used = running[key]
+	}
+	r.sweepLocked()
+	for key, l := range r.listeners {
+		if l.suspended {
+			if err := r.resumeListenerLocked(key, l); err != nil {
+				slog.Error("Cannot listen again on the address of the running configuration", "address", key, "err", err)
+				close(l.done)
+				delete(r.listeners, key)
+			}
+		}
+	}
+	for key, c := range r.packetConns {
+		if c.suspended {
+			if err := r.resumePacketConnLocked(key, c); err != nil {
+				slog.Error("Cannot listen again on the address of the running configuration", "address", key, "err", err)
+				close(c.done)
+				delete(r.packetConns, key)
+			}
+		}
+	}
+}
+
+// sweep closes the sockets the configuration running doesn't use
+func (r *listenerRegistry) sweep() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sweepLocked()
+}
+
+func (r *listenerRegistry) sweepLocked() {
+	for key, l := range r.listeners {
+		if !l.used {
+			close(l.done)
+			l.socket.Close()
+			delete(r.listeners, key)
+		}
+	}
+	for key, c := range r.packetConns {
+		if !c.used {
+			close(c.done)
+			c.socket.Close()
+			delete(r.packetConns, key)
+		}
+	}
+}
+
+// getKeyPort returns the port of the address of a socket key, empty for a unix socket
+func getKeyPort(key string) string {
+	_, address, _ := strings.Cut(key, ":")
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return ""
+	}
+	return port
+}
+
+// suspendPortLocked closes the unused sockets of the port of key, which are kept until the configuration
+// being started takes over: the running configuration gets them back when it fails
+func (r *listenerRegistry) suspendPortLocked(key string) {
+	port := getKeyPort(key)
+	if port == "" {
+		return
+	}
+	for k, l := range r.listeners {
+		if !l.used && !l.suspended && getKeyPort(k) == port {
+			l.socket.Close()
+			l.suspended = true
+		}
+	}
+	for k, c := range r.packetConns {
+		if !c.used && !c.suspended && getKeyPort(k) == port {
+			c.socket.Close()
+			c.suspended = true
+		}
+	}
+}
+
+// openListenerLocked binds the socket of key, after freeing its port when it is held by a socket of the
+// running configuration bound to another address
+func (r *listenerRegistry) openListenerLocked(key string, open func() (net.Listener, error)) (net.Listener, error) {
+	socket, err := open()
+	if err != nil {
+		r.suspendPortLocked(key)
+		return open()
+	}
+	return socket, nil
+}
+
+func (r *listenerRegistry) resumeListenerLocked(key string, l *sharedListener) error {
+	socket, err := r.openListenerLocked(key, l.open)
+	if err != nil {
+		return err
+	}
+	l.socket = socket
+	l.suspended = false
+	go l.run(socket)
+	return nil
+}
+
+// listen returns a handle of the socket of key, like "tcp:127.0.0.1:8080", opened by open when the previous
+// configuration didn't have it
+func (r *listenerRegistry) listen(key string, open func() (net.Listener, error)) (net.Listener, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	l, ok := r.listeners[key]
+	if ok && l.used {
+		return nil, errors.New("address already in use: " + key)
+	}
+	if ok && l.suspended {
+		if err := r.resumeListenerLocked(key, l); err != nil {
+			return nil, err
+		}
+	}
+	if !ok {
+		socket, err := r.openListenerLocked(key, open)
+		if err != nil {
+			return nil, err
+		}
+		l = &sharedListener{addr: socket.Addr(), socket: socket, open: open, conns: make(chan acceptResult), done: make(chan struct{})}
+		go l.run(socket)
+		r.listeners[key] = l
+	}
+	l.used = true
+	network, address, _ := strings.Cut(key, ":")
+	emitEvent(func(h EventHandler) { h.OnListen(network, address) })
+	return &listenerHandle{sharedListener: l, closed: make(chan struct{})}, nil
+}
+
+// listenTCP returns a handle of a shared TCP socket
+func (r *listenerRegistry) listenTCP(address string) (net.Listener, error) {
+	return r.listen("tcp:"+address, func() (net.Listener, error) {
+		return net.Listen("tcp", address)
+	})
+}
+
+// openPacketConnLocked binds the socket of key like openListenerLocked
+func (r *listenerRegistry) openPacketConnLocked(key string, open func() (net.PacketConn, error)) (net.PacketConn, error) {
+	socket, err := open()
+	if err != nil {
+		r.suspendPortLocked(key)
+		return open()
+	}
+	return socket, nil
+}
+
+func (r *listenerRegistry) resumePacketConnLocked(key string, c *sharedPacketConn) error {
+	socket, err := r.openPacketConnLocked(key, c.open)
+	if err != nil {
+		return err
+	}
+	c.setSocket(socket)
+	c.suspended = false
+	go c.run(socket)
+	return nil
+}
+
+// listenPacket returns a handle of a shared UDP socket
+func (r *listenerRegistry) listenPacket(address string) (net.PacketConn, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := "udp:" + address
+	c, ok := r.packetConns[key]
+	if ok && c.used {
+		return nil, errors.New("address already in use: " + key)
+	}
+	if ok && c.suspended {
+		if err := r.resumePacketConnLocked(key, c); err != nil {
+			return nil, err
+		}
+	}
+	if !ok {
+		open := func() (net.PacketConn, error) {
+			return net.ListenPacket("udp", address)
+		}
+		socket, err := r.openPacketConnLocked(key, open)
+		if err != nil {
+			return nil, err
+		}
+		c = &sharedPacketConn{addr: socket.LocalAddr(), socket: socket, open: open, packets: make(chan packet), done: make(chan struct{})}
+		go c.run(socket)
+		r.packetConns[key] = c
+	}
+	c.used = true
+	emitEvent(func(h EventHandler) { h.OnListen("udp", address) })
+	return &packetConnHandle{sharedPacketConn: c, closed: make(chan struct{})}, nil
+}
+
+// serveListener serves each connection accepted by the listener in a goroutine of its own until the
+// listener is closed. The temporary errors, like running out of file descriptors, are retried after
+// a delay growing up to MAX_ACCEPT_RETRY_DELAY like http.Server, the other ones are logged and returned
+func serveListener(listener net.Listener, handle func(conn net.Conn)) error {
+	var delay time.Duration
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && (netErr.Timeout() || netErr.Temporary()) {
+				delay = min(max(2*delay, MIN_ACCEPT_RETRY_DELAY), MAX_ACCEPT_RETRY_DELAY)
+				slog.Warn("Cannot accept a connection, retrying", "address", listener.Addr().String(), "delay", delay, "err", err)
+				time.Sleep(delay)
+				continue
+			}
+			slog.Error("Cannot accept connections", "address", listener.Addr().String(), "err", err)
+			return err
+		}
+		delay = 0
+		go handle(conn)
+	}
+}
@@ -0,0 +1,113 @@
+package proxydialer
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+)
+
+const (
+	LOG_FORMAT_TEXT = "text"
+	LOG_FORMAT_JSON = "json"
+)
+
+// LogConf configures the logger
+type LogConf struct {
+	// "debug", "info", "warn" or "error", default "info"
+	Level string `yaml:"level"`
+	// "text" or "json", default "text"
+	Format string `yaml:"format"`
+	// "stderr", "stdout", "syslog", "eventlog" on Windows or a file the logs are appended to, default "stderr"
+	Output string `yaml:"output"`
+	// Rotation of the output file
+	Rotate RotateConf `yaml:"rotate"`
+	// Syslog or event log settings
+	Syslog SyslogConf `yaml:"syslog"`
+}
+
+func (conf LogConf) getLevel() (slog.Level, error) {
+	var level slog.Level
+	if conf.Level == "" {
+		return slog.LevelInfo, nil
+	}
+	if err := level.UnmarshalText([]byte(conf.Level)); err != nil {
+		return level, fmt.Errorf("log level: %w", err)
+	}
+	return level, nil
+}
+
+func (conf LogConf) validate() error {
+	if _, err := conf.getLevel(); err != nil {
+		return err
+	}
+	if err := conf.Rotate.validate(); err != nil {
+		return fmt.Errorf("log rotate: %w", err)
+	}
+	if err := conf.Syslog.validate(); err != nil {
+		return err
+	}
+	switch conf.Format {
+	case "", LOG_FORMAT_TEXT, LOG_FORMAT_JSON:
+		return nil
+	}
+	return fmt.Errorf("unknown log format: %s", conf.Format)
+}
+
+// nopCloser is the output of loggers writing to the standard streams
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+func openLogOutput(conf LogConf) (io.WriteCloser, error) {
+	switch conf.Output {
+	case "", "stderr":
+		return nopCloser{os.Stderr}, nil
+	case "stdout":
+		return nopCloser{os.Stdout}, nil
+	}
+	return openAppendFile(conf.Output, conf.Rotate)
+}
+
+// setupLogging makes the configured logger the default one, also used by the log package,
+// the returned output is closed when the logger is replaced
+func setupLogging(conf LogConf) (io.Closer, error) {
+	if err := conf.validate(); err != nil {
+		return nil, err
+	}
+	level, _ := conf.getLevel()
+	options := &slog.HandlerOptions{Level: level}
+	var log hostLog
+	var err error
+	switch conf.Output {
+	case LOG_OUTPUT_SYSLOG:
+		log, err = openSyslog(conf.Syslog)
+	case LOG_OUTPUT_EVENTLOG:
+		log, err = openEventLog(conf.Syslog)
+	default:
+		output, err := openLogOutput(conf)
+		if err != nil {
+			return nil, err
+		}
+		slog.SetDefault(slog.New(newLogHandler(conf.Format, output, options)))
+		return output, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	out := &hostLogOutput{log: log}
+	options.ReplaceAttr = withoutTime
+	slog.SetDefault(slog.New(hostLogHandler{newLogHandler(conf.Format, out, options), out}))
+	return log, nil
+}
+
+func newLogHandler(format string, output io.Writer, options *slog.HandlerOptions) slog.Handler {
+	if format == LOG_FORMAT_JSON {
+		return slog.NewJSONHandler(output, options)
+	}
+	return slog.NewTextHandler(output, options)
+}
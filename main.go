@@ -1,21 +1,30 @@
-package main
+package proxydialer
 
 import (
 	"context"
 	"crypto/tls"
+	"errors"
+	"flag"
 	"fmt"
 	"hash/fnv"
 	"io"
-	"log"
+	"log/slog"
+	"mime"
 	"net"
 	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
 	"os"
 	"os/signal"
 	"path"
 	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/fsnotify/fsnotify"
 	"golang.org/x/net/proxy"
 	"gopkg.in/yaml.v3"
 )
@@ -23,9 +32,31 @@ import (
 type Protocol string
 
 const (
-	SOCKS5 Protocol = "socks5"
+	SOCKS5    Protocol = "socks5"
+	SOCKS5TLS Protocol = "socks5-tls"
+	SSH       Protocol = "ssh"
+	WIREGUARD Protocol = "wireguard"
+	TROJAN    Protocol = "trojan"
+	VMESS     Protocol = "vmess"
+	VLESS     Protocol = "vless"
+	HTTP      Protocol = "http"
+	HTTPS     Protocol = "https"
+	HTTP3     Protocol = "h3"
 )
 
+var supportedProtocols = map[Protocol]bool{
+	SOCKS5:    true,
+	SOCKS5TLS: true,
+	SSH:       true,
+	WIREGUARD: true,
+	TROJAN:    true,
+	VMESS:     true,
+	VLESS:     true,
+	HTTP:      true,
+	HTTPS:     true,
+	HTTP3:     true,
+}
+
 const DEFAULT_CONFIG_FILE_NAME = "config.yaml"
 
 func getHash(s string) uint32 {
@@ -37,6 +68,40 @@ func getHash(s string) uint32 {
 type DialerConfig struct {
 	Server string `yaml:"server"`
 	Port   int    `yaml:"port"`
+	// Route CONNECT tunnels by the server name of their TLS ClientHello
+	SniffSNI bool `yaml:"sniff_sni"`
+	// Port of a SOCKS5 server listening next to the HTTP proxy, disabled when 0
+	SocksPort int `yaml:"socks_port"`
+	// Port of a SOCKS5 server multiplexed over smux, for the proxies of other instances with mux, disabled when 0
+	MuxPort int `yaml:"mux_port"`
+	// Port receiving connections redirected by iptables, disabled when 0
+	TransparentPort int `yaml:"transparent_port"`
+	// Receive connections diverted by iptables TPROXY instead of REDIRECT
+	TProxy bool `yaml:"tproxy"`
+	// Port of a DNS server resolving through the proxies, disabled when 0
+	DNSPort int `yaml:"dns_port"`
+	// DNS server (host:port) or DNS over HTTPS URL the queries are sent to
+	DNSUpstream string `yaml:"dns_upstream"`
+	// Serve the HTTP proxy over TLS
+	TLS *ServerTLSConf `yaml:"tls"`
+	// Unix socket the HTTP proxy listens on instead of the port
+	Socket     string `yaml:"socket"`
+	SocketMode string `yaml:"socket_mode"`
+	// Client IPs or ranges allowed to use this listener, and the ones refused
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+	// Credentials required from the clients of the HTTP and SOCKS5 servers
+	Username string     `yaml:"username"`
+	Password string     `yaml:"password" secret:"true"`
+	Users    []UserConf `yaml:"users"`
+	// htpasswd file of more users with bcrypt hashes, reloaded when modified
+	UsersFile string `yaml:"users_file"`
+	// Names of the proxies used by this listener instead of the ones marked with use
+	Proxies []string `yaml:"proxies"`
+	// Connections reused by the plain HTTP requests
+	HTTPPool HTTPPoolConf `yaml:"http_pool"`
+	// Via and X-Forwarded-For headers of the plain HTTP requests
+	Headers HeadersConf `yaml:"headers"`
 }
 
 func (config *DialerConfig) getDialerConfHash() uint32 {
@@ -44,29 +109,219 @@ func (config *DialerConfig) getDialerConfHash() uint32 {
 	return getHash(str)
 }
 
+// Listeners are the local servers, a single one can be configured without a list
+type Listeners []DialerConfig
+
+func (listeners *Listeners) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.MappingNode {
+		var conf DialerConfig
+		if err := value.Decode(&conf); err != nil {
+			return err
+		}
+		*listeners = Listeners{conf}
+		return nil
+	}
+	var list []DialerConfig
+	if err := value.Decode(&list); err != nil {
+		return err
+	}
+	*listeners = list
+	return nil
+}
+
 type ProxyConf struct {
+	Name     string   `yaml:"name"`
 	Protocol Protocol `yaml:"protocol"`
 	Server   string   `yaml:"server"`
 	Port     int      `yaml:"port"`
 	Username string   `yaml:"username"`
-	Password string   `yaml:"password"`
+	Password string   `yaml:"password" secret:"true"`
 	Use      bool     `yaml:"use"`
+	// Share of connections in weighted balancing, 1 when not set
+	Weight int `yaml:"weight"`
+
+	// SOCKS5 specific settings
+	Pool PoolConf `yaml:"pool"`
+	// Share a few connections between the tunnels, the proxy must be the mux_port of a listener of this tool
+	Mux MuxConf `yaml:"mux"`
+
+	// SSH specific settings
+	PrivateKey           string `yaml:"private_key"`
+	PrivateKeyPassphrase string `yaml:"private_key_passphrase" secret:"true"`
+	KnownHosts           string `yaml:"known_hosts"`
+	// Don't verify the host key of the server, anyone on the path can then read the tunnels
+	InsecureSkipHostKey bool `yaml:"insecure_skip_host_key"`
+
+	WireGuard *WireGuardConf `yaml:"wireguard"`
+
+	// VMess and VLESS specific settings
+	UUID     string `yaml:"uuid"`
+	Security string `yaml:"security"`
+
+	// Multiplex CONNECT streams over a single HTTP/2 connection to an https proxy
+	HTTP2 bool `yaml:"http2"`
+
+	TLS       *TLSConf       `yaml:"tls"`
+	Transport *TransportConf `yaml:"transport"`
+
+	// Settings of a protocol added with RegisterProtocol
+	Options map[string]string `yaml:"options"`
 }
 
-func (config *ProxyConf) getProxyConfHash() uint32 {
-	str := fmt.Sprintf("%s//:%s:%s@%s:%d", config.Protocol, config.Username, config.Password, config.Server, config.Port)
-	return getHash(str)
+// getName returns the configured name, or the proxy URL when it has no name
+func (config *ProxyConf) getName() string {
+	if config.Name != "" {
+		return config.Name
+	}
+	return fmt.Sprintf("%s://%s", config.Protocol, config.getProxyAddr())
+}
+
+func (config *ProxyConf) getWeight() int {
+	if config.Weight <= 0 {
+		return 1
+	}
+	return config.Weight
+}
+
+// getServerHost returns the host of the server, an IPv6 server can be written with or without brackets
+func (config *ProxyConf) getServerHost() string {
+	return strings.TrimSuffix(strings.TrimPrefix(config.Server, "["), "]")
+}
+
+func (config *ProxyConf) getProxyAddr() string {
+	return net.JoinHostPort(config.getServerHost(), strconv.Itoa(config.Port))
 }
 
 type Config struct {
-	Version string       `yaml:"version"`
-	Dialer  DialerConfig `yaml:"dialer"`
-	Proxies []ProxyConf  `yaml:"proxies"`
+	Version string `yaml:"version"`
+	// Files, patterns and directories merged into the configuration in order
+	Include  []string      `yaml:"include"`
+	Dialer   Listeners     `yaml:"dialer"`
+	Proxies  []ProxyConf   `yaml:"proxies"`
+	Chain    []string      `yaml:"chain"`
+	Balancer BalancerConf  `yaml:"balancer"`
+	Rules    []RuleConf    `yaml:"rules"`
+	GeoIP    GeoIPConf     `yaml:"geoip"`
+	RuleSets []RuleSetConf `yaml:"rule_sets"`
+	PAC      PACConf       `yaml:"pac"`
+	Tun      TunConf       `yaml:"tun"`
+	Forwards []ForwardConf `yaml:"forwards"`
+	Reverse  []ReverseConf `yaml:"reverse"`
+	Metrics  MetricsConf   `yaml:"metrics"`
+	Statsd   StatsdConf    `yaml:"statsd"`
+	Admin    AdminConf     `yaml:"admin"`
+	Log      LogConf       `yaml:"log"`
+	Tracing  TracingConf   `yaml:"tracing"`
+	// Traffic per client
+	Accounting AccountingConf `yaml:"accounting"`
+	// Size in kilobytes of the buffers tunnels are copied through, default 32
+	BufferSize int `yaml:"buffer_size"`
+	// Tunnels open at the same time
+	Limits LimitsConf `yaml:"limits"`
+	// Options of the TCP connections
+	TCP TCPConf `yaml:"tcp"`
+	// Time a destination is dialed for at most, through the proxies, default "30s"
+	DialTimeout time.Duration `yaml:"dial_timeout"`
+	// How often a configuration given by a URL is checked for changes, default "1m"
+	ConfigPollInterval time.Duration `yaml:"config_poll_interval"`
+	// Time without traffic either way after which a tunnel is closed, never when 0
+	IdleTimeout time.Duration `yaml:"idle_timeout"`
+	// File the requests and tunnels are appended to, disabled when empty
+	AccessLog       string     `yaml:"access_log"`
+	AccessLogRotate RotateConf `yaml:"access_log_rotate"`
+	// Settings applied over the other ones by -profile, by name
+	Profiles map[string]Config `yaml:"profiles"`
+
+	// Destinations dialed directly, with NO_PROXY semantics
+	Bypass []string `yaml:"bypass"`
+	// Dial directly while the proxies can't be reached
+	FallbackDirect bool `yaml:"fallback_direct"`
+
+	HealthCheck HealthCheckConf `yaml:"health_check"`
+}
+
+func (config *Config) getConfHash() uint32 {
+	data, _ := yaml.Marshal(config)
+	return getHash(string(data))
+}
+
+func (config *Config) getProxy(name string) *ProxyConf {
+	for i := range config.Proxies {
+		if config.Proxies[i].Name == name {
+			return &config.Proxies[i]
+		}
+	}
+	return nil
+}
+
+// getUpstreamProxies returns the hops of the chain when configured, otherwise the enabled proxies
+func (config *Config) getUpstreamProxies() []ProxyConf {
+	var proxies []ProxyConf
+	if len(config.Chain) > 0 {
+		for _, name := range config.Chain {
+			if conf := config.getProxy(name); conf != nil {
+				proxies = append(proxies, *conf)
+			}
+		}
+		return proxies
+	}
+	for _, conf := range config.Proxies {
+		if conf.Use {
+			proxies = append(proxies, conf)
+		}
+	}
+	return proxies
+}
+
+// getListenerConfig returns the config a listener or forward dials with,
+// the named proxies replace the used ones and the chain
+func (config *Config) getListenerConfig(proxies []string) *Config {
+	if len(proxies) == 0 {
+		return config
+	}
+	listenerConfig := *config
+	listenerConfig.Chain = nil
+	listenerConfig.Proxies = make([]ProxyConf, len(config.Proxies))
+	for i, conf := range config.Proxies {
+		conf.Use = slices.Contains(proxies, conf.Name)
+		listenerConfig.Proxies[i] = conf
+	}
+	return &listenerConfig
+}
+
+// hasUpstreamProxies tells whether every listener and forward has proxies to send traffic through
+func (config *Config) hasUpstreamProxies() bool {
+	for _, listener := range config.Dialer {
+		if len(config.getListenerConfig(listener.Proxies).getUpstreamProxies()) == 0 {
+			return false
+		}
+	}
+	for _, forward := range config.Forwards {
+		if len(config.getListenerConfig(forward.Proxies).getUpstreamProxies()) == 0 {
+			return false
+		}
+	}
+	for _, reverse := range config.Reverse {
+		if len(config.getListenerConfig(reverse.Proxies).getUpstreamProxies()) == 0 {
+			return false
+		}
+	}
+	if config.Tun.Enabled && len(config.getUpstreamProxies()) == 0 {
+		return false
+	}
+	return len(config.Dialer) > 0 || len(config.Forwards) > 0 || len(config.Reverse) > 0
 }
 
 type DialContext func(ctx context.Context, network, address string) (net.Conn, error)
 
+// getConfigFile returns the configuration file, empty when the server is configured by the flags only
 func getConfigFile() string {
+	if !cli.hasConfigFile() {
+		return ""
+	}
+	if cli.config != "" {
+		return cli.config
+	}
 	configFile, ok := os.LookupEnv("PROXY_DEALER_CONFIG_FILE")
 	if !ok {
 		_, filename, _, _ := runtime.Caller(1)
@@ -75,62 +330,376 @@ func getConfigFile() string {
 	return configFile
 }
 
-func parseConfig(configFile string) Config {
+func parseConfig(configFile string) (Config, error) {
 	conf := Config{}
-	data, err := os.ReadFile(configFile)
+	if configFile == "" {
+		return conf, nil
+	}
+	data, err := readConfigData(configFile)
+	if err != nil {
+		return conf, err
+	}
+	data, err = toYAML(getConfigName(configFile), data)
 	if err != nil {
-		panic(err)
+		return conf, err
 	}
-	err1 := yaml.Unmarshal(data, &conf)
-	if err1 != nil {
-		panic(err1)
+	if yaml.Unmarshal(data, &conf) == nil && len(conf.Include) > 0 {
+		if data, err = includeConfig(configFile, data, conf.Include); err != nil {
+			return conf, err
+		}
+		conf = Config{}
 	}
-	return conf
+	if cli.profile != "" {
+		if data, err = selectProfile(data, cli.profile); err != nil {
+			return conf, err
+		}
+	}
+	if err := yaml.Unmarshal(data, &conf); err != nil {
+		return conf, err
+	}
+	return conf, nil
 }
 
-func getProxyConfig(configFile string) (*DialerConfig, *ProxyConf) {
-	config := parseConfig(configFile)
+// getConfig parses the config file and validates the proxies traffic is sent through
+func getConfig(configFile string) (*Config, error) {
+	config, err := parseConfig(configFile)
+	if err != nil {
+		return nil, err
+	}
+	if err := applyEnv(&config); err != nil {
+		return nil, fmt.Errorf("Invalid environment: %w", err)
+	}
+	cli.apply(&config)
+	if err := resolveSecrets(&config); err != nil {
+		return nil, fmt.Errorf("Invalid secret: %w", err)
+	}
 
-	var proxyConf *ProxyConf = nil
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
 
+// Validate returns the first invalid setting of the configuration, the proxies it references included
+func (config *Config) Validate() error {
+	if err := config.Log.validate(); err != nil {
+		return err
+	}
+	if config.BufferSize != 0 && (config.BufferSize < MIN_BUFFER_SIZE || config.BufferSize > MAX_BUFFER_SIZE) {
+		return fmt.Errorf("buffer_size must be between %d and %d kilobytes", MIN_BUFFER_SIZE, MAX_BUFFER_SIZE)
+	}
+	if err := config.AccessLogRotate.validate(); err != nil {
+		return fmt.Errorf("access_log_rotate: %s", err)
+	}
+	if err := config.TCP.validate(); err != nil {
+		return fmt.Errorf("tcp: %s", err)
+	}
+	if config.DialTimeout < 0 {
+		return errors.New("dial_timeout must not be negative")
+	}
+	if config.ConfigPollInterval < 0 {
+		return errors.New("config_poll_interval must not be negative")
+	}
+	if config.IdleTimeout < 0 {
+		return errors.New("idle_timeout must not be negative")
+	}
+	if err := config.Limits.validate(); err != nil {
+		return fmt.Errorf("limits: %s", err)
+	}
 	for _, conf := range config.Proxies {
-		if conf.Use {
-			if conf.Protocol != SOCKS5 {
-				panic("Only SOCKS5 protocol is supported")
+		if err := conf.Pool.validate(); err != nil {
+			return fmt.Errorf("Invalid pool of proxy %s: %s", conf.getName(), err)
+		}
+		if err := conf.Mux.validate(); err != nil {
+			return fmt.Errorf("Invalid mux of proxy %s: %s", conf.getName(), err)
+		}
+		if conf.Mux.Enabled && conf.Pool.Size > 0 {
+			return fmt.Errorf("Proxy %s cannot use both pool and mux", conf.getName())
+		}
+	}
+	for _, name := range config.Chain {
+		if config.getProxy(name) == nil {
+			return fmt.Errorf("Unknown proxy in chain: %s", name)
+		}
+	}
+	for _, listener := range config.Dialer {
+		if listener.Port == 0 && listener.Socket == "" && listener.SocksPort == 0 && listener.MuxPort == 0 && listener.TransparentPort == 0 && listener.DNSPort == 0 {
+			return fmt.Errorf("No port configured for listener %s", listener.Server)
+		}
+		for _, name := range listener.Proxies {
+			if config.getProxy(name) == nil {
+				return fmt.Errorf("Unknown proxy in listener %s: %s", listener.Server, name)
+			}
+		}
+		if listener.UsersFile != "" {
+			if _, err := readHtpasswd(listener.UsersFile); err != nil {
+				return fmt.Errorf("Invalid users file of listener %s: %s", listener.Server, err)
+			}
+		}
+		if _, err := newClientACL(listener); err != nil {
+			return fmt.Errorf("Invalid client ACL of listener %s: %s", listener.Server, err)
+		}
+		for _, user := range listener.Users {
+			for _, name := range user.Proxies {
+				if config.getProxy(name) == nil {
+					return fmt.Errorf("Unknown proxy of user %s: %s", user.Username, name)
+				}
+			}
+			for _, conf := range config.getListenerConfig(user.Proxies).getUpstreamProxies() {
+				if !isSupportedProtocol(conf.Protocol) {
+					return fmt.Errorf("Unsupported protocol: %s", conf.Protocol)
+				}
+			}
+		}
+		for _, conf := range config.getListenerConfig(listener.Proxies).getUpstreamProxies() {
+			if !isSupportedProtocol(conf.Protocol) {
+				return fmt.Errorf("Unsupported protocol: %s", conf.Protocol)
 			}
-			proxyConf = &conf
 		}
 	}
-
-	return &config.Dialer, proxyConf
+	for _, forward := range config.Forwards {
+		if forward.Listen == "" || forward.Remote == "" {
+			return errors.New("Forward requires listen and remote")
+		}
+		for _, name := range forward.Proxies {
+			if config.getProxy(name) == nil {
+				return fmt.Errorf("Unknown proxy in forward %s: %s", forward.Listen, name)
+			}
+		}
+		for _, conf := range config.getListenerConfig(forward.Proxies).getUpstreamProxies() {
+			if !isSupportedProtocol(conf.Protocol) {
+				return fmt.Errorf("Unsupported protocol: %s", conf.Protocol)
+			}
+		}
+	}
+	for _, reverse := range config.Reverse {
+		if reverse.Remote == "" || reverse.Local == "" {
+			return errors.New("Reverse tunnel requires remote and local")
+		}
+		if conf := config.getProxy(reverse.Proxy); conf == nil || conf.Protocol != SSH {
+			return fmt.Errorf("Reverse tunnel %s requires an ssh proxy: %s", reverse.Remote, reverse.Proxy)
+		}
+		for _, name := range reverse.Proxies {
+			if config.getProxy(name) == nil {
+				return fmt.Errorf("Unknown proxy in reverse tunnel %s: %s", reverse.Remote, name)
+			}
+		}
+		for _, conf := range config.getListenerConfig(reverse.Proxies).getUpstreamProxies() {
+			if !isSupportedProtocol(conf.Protocol) {
+				return fmt.Errorf("Unsupported protocol: %s", conf.Protocol)
+			}
+		}
+	}
+	if err := config.Admin.validate(); err != nil {
+		return fmt.Errorf("admin: %s", err)
+	}
+	return nil
 }
 
 // establishSOCKS5Proxy establishes a connection to the SOCKS5 proxy server
-func establishSOCKS5Proxy(socks5Addr string, auth *proxy.Auth) (proxy.Dialer, error) {
+func establishSOCKS5Proxy(socks5Addr string, auth *proxy.Auth, forward proxy.Dialer, pool PoolConf, mux MuxConf) (proxy.Dialer, error) {
+	if mux.Enabled {
+		return newMuxDialer(socks5Addr, auth, forward, mux), nil
+	}
+	if pool.Size > 0 {
+		return newSocksPoolDialer(socks5Addr, auth, forward, pool), nil
+	}
 	// Create a socks5 dialer
-	return proxy.SOCKS5("tcp", socks5Addr, auth, proxy.Direct)
+	return proxy.SOCKS5("tcp", socks5Addr, auth, forward)
+}
+
+// getProxyDialer creates the upstream dialer for the configured protocol, its traffic is counted in the metrics,
+// connections to the proxy server are made through forward
+func getProxyDialer(proxyConfig ProxyConf, forward proxy.Dialer) (proxy.Dialer, error) {
+	dialer, err := establishProxy(proxyConfig, forward)
+	if err != nil {
+		return nil, err
+	}
+	metered := newMeteredDialer(proxyConfig.getName(), dialer)
+	metered.public = proxyConfig.Name
+	return metered, nil
+}
+
+func establishProxy(proxyConfig ProxyConf, forward proxy.Dialer) (proxy.Dialer, error) {
+	switch proxyConfig.Protocol {
+	case SOCKS5, SOCKS5TLS:
+		var auth *proxy.Auth
+		if proxyConfig.Username != "" && proxyConfig.Password != "" {
+			auth = &proxy.Auth{
+				User:     proxyConfig.Username,
+				Password: proxyConfig.Password,
+			}
+		}
+		// The SOCKS5 stream may be wrapped in TLS and WebSocket
+		transport, err := newTransportDialer(proxyConfig, proxyConfig.Protocol == SOCKS5TLS, forward)
+		if err != nil {
+			return nil, err
+		}
+		return establishSOCKS5Proxy(proxyConfig.getProxyAddr(), auth, transport, proxyConfig.Pool, proxyConfig.Mux)
+	case SSH:
+		return establishSSHProxy(proxyConfig, forward)
+	case WIREGUARD:
+		if forward != directDialer {
+			return nil, errors.New("wireguard can only be the first hop of a chain")
+		}
+		return establishWireGuardProxy(proxyConfig)
+	case TROJAN:
+		return establishTrojanProxy(proxyConfig, forward)
+	case VMESS:
+		return establishVMessProxy(proxyConfig, forward)
+	case VLESS:
+		return establishVLESSProxy(proxyConfig, forward)
+	case HTTP, HTTPS:
+		return establishHTTPProxy(proxyConfig, forward)
+	case HTTP3:
+		if forward != directDialer {
+			return nil, errors.New("h3 can only be the first hop of a chain")
+		}
+		return establishHTTP3Proxy(proxyConfig)
+	}
+	if factory, ok := getDialerFactory(proxyConfig.Protocol); ok {
+		return factory(proxyConfig, forward)
+	}
+	return nil, fmt.Errorf("unsupported protocol: %s", proxyConfig.Protocol)
+}
+
+// dialContext dials with the context when the dialer supports it
+func dialContext(ctx context.Context, dialer proxy.Dialer, network, address string) (net.Conn, error) {
+	if contextDialer, ok := dialer.(proxy.ContextDialer); ok {
+		return contextDialer.DialContext(ctx, network, address)
+	}
+	return dialer.Dial(network, address)
+}
+
+// getUpstreamDialer creates the dialer traffic is sent through: the chain when configured,
+// otherwise the enabled proxies, balanced when there are several of them
+func getUpstreamDialer(config *Config) (proxy.Dialer, error) {
+	proxies := config.getUpstreamProxies()
+	if len(config.Chain) > 0 {
+		return getChainDialer(proxies)
+	}
+	return newBalancer(proxies, config.Balancer, config.HealthCheck)
+}
+
+// getDialer creates the dialer used by the handlers: the upstream dialer behind the routing rules
+func getDialer(config *Config) (proxy.Dialer, error) {
+	upstream, err := getUpstreamDialer(config)
+	if err != nil {
+		return nil, err
+	}
+	if config.FallbackDirect {
+		upstream = newFallbackDialer(config, upstream)
+	}
+	dialer, err := newRouter(config, upstream)
+	if err != nil {
+		if closer, ok := upstream.(io.Closer); ok {
+			closer.Close()
+		}
+		return nil, err
+	}
+	return dialer, nil
+}
+
+type clientAddrKey struct{}
+
+// withClientAddr stores the address of the client a connection is dialed for
+func withClientAddr(ctx context.Context, addr string) context.Context {
+	return context.WithValue(ctx, clientAddrKey{}, addr)
+}
+
+// getClientIP returns the IP of the client a connection is dialed for, empty if unknown
+func getClientIP(ctx context.Context) string {
+	addr, _ := ctx.Value(clientAddrKey{}).(string)
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// dialTimeout is the time in nanoseconds a destination is dialed for at most, through the proxies
+var dialTimeout atomic.Int64
+
+// withDialTimeout returns the context of a dial, canceled with ctx or after the dial timeout,
+// the default one when no server set it
+func withDialTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	timeout := time.Duration(dialTimeout.Load())
+	if timeout == 0 {
+		timeout = DEFAULT_DIAL_TIMEOUT
+	}
+	return context.WithTimeout(ctx, timeout)
 }
 
 func getDialContext(dialer proxy.Dialer) DialContext {
 	return func(ctx context.Context, network, address string) (net.Conn, error) {
-		return dialer.Dial(network, address)
+		ctx, cancel := withDialTimeout(ctx)
+		defer cancel()
+		return dialContext(ctx, dialer, network, address)
 	}
 }
 
+// handleSniffedTunneling answers a CONNECT request before dialing,
+// so that the destination is routed by the server name of the TLS ClientHello sent by the client
+func handleSniffedTunneling(w http.ResponseWriter, r *http.Request, dialer proxy.Dialer) {
+	w.WriteHeader(http.StatusOK)
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	ctx, entry := newRequestAccessEntry(r)
+	sni, client_conn := peekSNI(conn, rw.Reader)
+	if sni != "" {
+		slog.Info("CONNECT SNI", "client", r.RemoteAddr, "host", r.Host, "sni", sni)
+		ctx = withSNI(ctx, sni)
+	}
+	dest_conn, err := dialTunnel(ctx, dialer, "tcp", r.Host)
+	if err != nil {
+		// the client was already told the tunnel is established
+		slog.Warn("CONNECT failed", "client", r.RemoteAddr, "host", r.Host, "err", err)
+		entry.finish(getDialErrorStatus(err), 0, 0)
+		client_conn.Close()
+		return
+	}
+	entry.setUpstream(dest_conn)
+	relay(client_conn, dest_conn, entry)
+}
+
+// getConnectAddress returns the destination of a CONNECT request as host:port, an IPv6 literal in brackets.
+// A target without port is the HTTPS one, and an IPv6 literal without brackets is taken whole
+func getConnectAddress(r *http.Request) string {
+	if _, _, err := net.SplitHostPort(r.Host); err == nil {
+		return r.Host
+	}
+	return net.JoinHostPort(strings.TrimSuffix(strings.TrimPrefix(r.Host, "["), "]"), "443")
+}
+
 // getHandleTunneling handles CONNECT requests
-func getHandleTunneling(dialer proxy.Dialer) func(w http.ResponseWriter, r *http.Request) {
+func getHandleTunneling(dialer proxy.Dialer, sniffSNI bool) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
+		r.Host = getConnectAddress(r)
+		if sniffSNI {
+			handleSniffedTunneling(w, r, dialer)
+			return
+		}
 		//dest_conn, err := net.DialTimeout("tcp", r.Host, 10*time.Second)
 		//if err != nil {
 		//	http.Error(w, err.Error(), http.StatusServiceUnavailable)
 		//	return
 		//}
-		dest_conn, err := dialer.Dial("tcp", r.Host)
+		ctx, entry := newRequestAccessEntry(r)
+		dest_conn, err := dialTunnel(ctx, dialer, "tcp", r.Host)
 
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			entry.finish(writeDialError(w, r, err), 0, 0)
 			return
 		}
+		entry.setUpstream(dest_conn)
 
 		w.WriteHeader(http.StatusOK)
 		hijacker, ok := w.(http.Hijacker)
@@ -138,18 +707,59 @@ func getHandleTunneling(dialer proxy.Dialer) func(w http.ResponseWriter, r *http
 			http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
 			return
 		}
-		client_conn, _, err := hijacker.Hijack()
+		client_conn, rw, err := hijacker.Hijack()
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			dest_conn.Close()
+			return
 		}
-		go transfer(dest_conn, client_conn)
-		go transfer(client_conn, dest_conn)
+		relay(withBuffered(client_conn, rw.Reader), dest_conn, entry)
 	}
 }
 
+const DEFAULT_DIAL_TIMEOUT = 30 * time.Second
+
+const (
+	DEFAULT_BUFFER_SIZE = 32
+	MIN_BUFFER_SIZE     = 4
+	MAX_BUFFER_SIZE     = 4096
+)
+
+// copyBufferSize is the size in bytes of the buffers tunnels are copied through
+var copyBufferSize atomic.Int64
+
+// tunnelIdleTimeout is the time in nanoseconds the tunnels opened next are closed after without traffic, never when 0
+var tunnelIdleTimeout atomic.Int64
+
+// copyBuffers are shared by the tunnels instead of allocating two buffers for each of them
+var copyBuffers = sync.Pool{
+	New: func() any {
+		buf := make([]byte, copyBufferSize.Load())
+		return &buf
+	},
+}
+
+// getCopyBuffer returns a pooled buffer, buffers of a previous size are dropped
+func getCopyBuffer() *[]byte {
+	buf := copyBuffers.Get().(*[]byte)
+	if int64(len(*buf)) != copyBufferSize.Load() {
+		return copyBuffers.New().(*[]byte)
+	}
+	return buf
+}
+
+// writerOnly hides the ReadFrom method of a connection, which would copy through a buffer of its own
+type writerOnly struct {
+	io.Writer
+}
+
 func transfer(destination io.WriteCloser, source io.ReadCloser) {
 	if destination != nil && source != nil {
-		io.Copy(destination, source)
+		buf := getCopyBuffer()
+		if !splice(destination, source, *buf) {
+			io.CopyBuffer(writerOnly{destination}, source, *buf)
+		}
+		copyBuffers.Put(buf)
 	}
 	if destination != nil {
 		destination.Close()
@@ -159,34 +769,129 @@ func transfer(destination io.WriteCloser, source io.ReadCloser) {
 	}
 }
 
-// getHandleHTTP handles normal HTTP requests
-func getHandleHTTP(dialer proxy.Dialer) func(w http.ResponseWriter, req *http.Request) {
+// relay copies the data of a tunnel both ways in the background, until either side closes it,
+// the tunnel is listed by the admin API meanwhile and the access log entry is written when it is done
+func relay(client_conn, dest_conn net.Conn, entry *accessEntry) {
+	metrics.activeTunnels.Add(1)
+	received := &countingReader{ReadCloser: client_conn}
+	sent := &countingReader{ReadCloser: dest_conn}
+	tunnel := openTunnels.add(client_conn, dest_conn, entry, received, sent)
+	event := tunnel.event()
+	emitEvent(func(h EventHandler) { h.OnTunnelOpen(event) })
+	upload, download := getLimiters(getClientBandwidth(dest_conn))
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		transfer(dest_conn, throttle(received, upload...))
+	}()
+	go func() {
+		defer wg.Done()
+		transfer(client_conn, throttle(sent, download...))
+	}()
+	span := entry.startSpan("transfer")
+	done := make(chan struct{})
+	if timeout := time.Duration(tunnelIdleTimeout.Load()); timeout > 0 {
+		go tunnel.closeIdle(timeout, done)
+	}
+	go func() {
+		wg.Wait()
+		close(done)
+		openTunnels.remove(tunnel)
+		metrics.activeTunnels.Add(-1)
+		span.finish()
+		entry.finish(http.StatusOK, sent.n.Load(), received.n.Load())
+		emitEvent(func(h EventHandler) { h.OnTunnelClose(event, sent.n.Load(), received.n.Load()) })
+	}()
+}
+
+// getHandleHTTP handles normal HTTP requests, sent through the transports created with the listener
+func getHandleHTTP(dialer proxy.Dialer, transports *httpTransports, headers HeadersConf) func(w http.ResponseWriter, req *http.Request) {
 	return func(w http.ResponseWriter, req *http.Request) {
+		if isUpgradeRequest(req) {
+			handleUpgrade(w, req, dialer, headers)
+			return
+		}
 		//resp, err := http.DefaultTransport.RoundTrip(req)
 		//if err != nil {
 		//	http.Error(w, err.Error(), http.StatusServiceUnavailable)
 		//	return
 		//}
-		transport := &http.Transport{
-			DialContext:           getDialContext(dialer),
-			MaxIdleConns:          100,
-			IdleConnTimeout:       60 * time.Second,
-			TLSHandshakeTimeout:   10 * time.Second,
-			ExpectContinueTimeout: 1 * time.Second,
-			MaxIdleConnsPerHost:   runtime.GOMAXPROCS(0) + 1,
-		}
-		resp, err := transport.RoundTrip(req)
+		ctx, entry := newRequestAccessEntry(req)
+		trace := &httptrace.ClientTrace{
+			// the interim responses, like 103 Early Hints, are relayed to the client. The 100 Continue of an
+			// "Expect: 100-continue" request is sent by the server when the transport reads the body,
+			// once the origin sent its own or after the expect continue timeout
+			Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+				if code == http.StatusContinue {
+					return nil
+				}
+				clear(w.Header())
+				copyHeader(w.Header(), http.Header(header))
+				w.WriteHeader(code)
+				clear(w.Header())
+				return nil
+			},
+		}
+		if entry != nil {
+			trace.GotConn = func(info httptrace.GotConnInfo) {
+				entry.setUpstream(info.Conn)
+			}
+		}
+		req = req.WithContext(httptrace.WithClientTrace(ctx, trace))
+		// the connection to the client is not the one to the origin, which is kept open for the next requests
+		req.Header = req.Header.Clone()
+		removeHopHeaders(req.Header)
+		headers.setForwardedHeaders(req)
+		req.Close = false
+		bandwidth := clientBandwidths.acquire(req.Context())
+		defer clientBandwidths.release(bandwidth)
+		upload, download := getLimiters(bandwidth)
+		body := &countingReader{ReadCloser: req.Body}
+		if req.Body != nil {
+			req.Body = throttle(body, upload...)
+		}
+		resp, err := transports.get(req).RoundTrip(req)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			entry.finish(writeDialError(w, req, err), 0, body.n.Load())
 			return
 		}
 		defer resp.Body.Close()
+		removeHopHeaders(resp.Header)
+		headers.setVia(resp)
 		copyHeader(w.Header(), resp.Header)
 		w.WriteHeader(resp.StatusCode)
-		io.Copy(w, resp.Body)
+		var dst io.Writer = w
+		if flusher, ok := w.(http.Flusher); ok && isStreamingResponse(resp) {
+			dst = flushWriter{w: w, flusher: flusher}
+		}
+		sent, _ := io.Copy(dst, throttle(resp.Body, download...))
+		entry.finish(resp.StatusCode, sent, body.n.Load())
 	}
 }
 
+// isStreamingResponse tells whether the body of a response is sent as it is produced, like Server-Sent Events
+// or a chunked long poll, rather than once complete
+func isStreamingResponse(resp *http.Response) bool {
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return mediaType == "text/event-stream" || resp.ContentLength == -1
+}
+
+// flushWriter sends every chunk of a streamed body to the client when it's received, instead of once
+// the buffer of the response is full
+type flushWriter struct {
+	w       io.Writer
+	flusher http.Flusher
+}
+
+func (f flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	if n > 0 {
+		f.flusher.Flush()
+	}
+	return n, err
+}
+
 func copyHeader(dst, src http.Header) {
 	for k, vv := range src {
 		for _, v := range vv {
@@ -195,96 +900,479 @@ func copyHeader(dst, src http.Header) {
 	}
 }
 
-func runServer(dialerConfig DialerConfig, proxyConfig ProxyConf, stop chan int) {
-
-	var auth *proxy.Auth
-	proxyAddr := fmt.Sprintf("%s:%d", proxyConfig.Server, proxyConfig.Port)
-	if proxyConfig.Username != "" && proxyConfig.Password != "" {
-		auth = &proxy.Auth{
-			User:     proxyConfig.Username,
-			Password: proxyConfig.Password,
-		}
+// startListener starts the servers of a listener, the HTTP server is nil when it has no HTTP port
+// userDialers are the dialers of the users with their own proxies
+func startListener(dialerConfig DialerConfig, dialer proxy.Dialer, userDialers map[string]proxy.Dialer) (*http.Server, []io.Closer, error) {
+	auth, err := newAuthenticator(dialerConfig)
+	if err != nil {
+		return nil, nil, fmt.Errorf("users: %w", err)
 	}
-
-	dialer, err := establishSOCKS5Proxy(proxyAddr, auth)
+	acl, err := newClientACL(dialerConfig)
 	if err != nil {
-		log.Fatalf("Error: %s", err.Error())
-		return
+		return nil, nil, fmt.Errorf("client ACL: %w", err)
+	}
+	// the PAC file describes the rules of the listener
+	pacDialer := dialer
+	if len(userDialers) > 0 {
+		dialer = &userDialer{dialer: dialer, users: userDialers}
+	}
+	// listeners served next to the HTTP proxy
+	var listeners []io.Closer
+	if auth != nil && auth.usersFile != "" {
+		if err := auth.watchUsersFile(); err != nil {
+			auth.Close()
+			return nil, nil, fmt.Errorf("users file: %w", err)
+		}
+		listeners = append(listeners, auth)
+	}
+	if dialerConfig.SocksPort > 0 {
+		socksAddr := fmt.Sprintf("%s:%d", dialerConfig.Server, dialerConfig.SocksPort)
+		socksListener, err := sharedListeners.listenTCP(socksAddr)
+		if err != nil {
+			return nil, listeners, fmt.Errorf("SOCKS5 server: %w", err)
+		}
+		slog.Info("SOCKS5 server is running", "address", "socks5://"+socksAddr)
+		socksListener = withACL(withTCPOptions(socksListener), acl)
+		listeners = append(listeners, socksListener)
+		go serveSOCKS5(socksListener, dialer, auth)
+	}
+	if dialerConfig.MuxPort > 0 {
+		muxAddr := fmt.Sprintf("%s:%d", dialerConfig.Server, dialerConfig.MuxPort)
+		muxListener, err := sharedListeners.listenTCP(muxAddr)
+		if err != nil {
+			return nil, listeners, fmt.Errorf("mux server: %w", err)
+		}
+		slog.Info("Mux server is running", "address", muxAddr)
+		muxListener = withACL(withTCPOptions(muxListener), acl)
+		listeners = append(listeners, muxListener)
+		go serveMux(muxListener, dialer, auth)
+	}
+	if dialerConfig.TransparentPort > 0 {
+		transparentAddr := fmt.Sprintf("%s:%d", dialerConfig.Server, dialerConfig.TransparentPort)
+		var transparentListener net.Listener
+		var err error
+		if dialerConfig.TProxy {
+			transparentListener, err = sharedListeners.listen("tproxy:"+transparentAddr, func() (net.Listener, error) {
+				return listenTransparent(transparentAddr)
+			})
+		} else {
+			transparentListener, err = sharedListeners.listenTCP(transparentAddr)
+		}
+		if err != nil {
+			return nil, listeners, fmt.Errorf("transparent proxy: %w", err)
+		}
+		slog.Info("Transparent proxy is running", "address", transparentAddr)
+		transparentListener = withACL(withTCPOptions(transparentListener), acl)
+		listeners = append(listeners, transparentListener)
+		go serveTransparent(transparentListener, dialer, dialerConfig.TProxy)
 	}
-	handleTunneling := getHandleTunneling(dialer)
-	handleHTTP := getHandleHTTP(dialer)
+	if dialerConfig.DNSPort > 0 {
+		dnsAddr := fmt.Sprintf("%s:%d", dialerConfig.Server, dialerConfig.DNSPort)
+		dnsConn, err := sharedListeners.listenPacket(dnsAddr)
+		if err != nil {
+			return nil, listeners, fmt.Errorf("DNS server: %w", err)
+		}
+		dnsListener, err := sharedListeners.listenTCP(dnsAddr)
+		if err != nil {
+			dnsConn.Close()
+			return nil, listeners, fmt.Errorf("DNS server: %w", err)
+		}
+		if acl != nil {
+			dnsConn = &aclPacketConn{PacketConn: dnsConn, acl: acl}
+		}
+		dnsListener = withACL(dnsListener, acl)
+		forwarder := newDNSForwarder(dialer, dialerConfig.DNSUpstream)
+		slog.Info("DNS server is running", "address", dnsAddr, "upstream", forwarder.upstream)
+		listeners = append(listeners, dnsConn, dnsListener)
+		go serveDNSUDP(dnsConn, forwarder)
+		go serveDNSTCP(dnsListener, forwarder)
+	}
+	if dialerConfig.Port == 0 && dialerConfig.Socket == "" {
+		return nil, listeners, nil
+	}
+
+	handleTunneling := getHandleTunneling(dialer, dialerConfig.SniffSNI)
+	transports := newHTTPTransports(dialer, dialerConfig.HTTPPool)
+	listeners = append(listeners, transports)
+	handleHTTP := getHandleHTTP(dialer, transports, dialerConfig.Headers)
+	handlePAC := getHandlePAC(pacDialer)
+	handler := withHTTPMiddlewares(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		if r.Method == http.MethodConnect {
+			handleTunneling(w, r)
+			metrics.observeRequest("connect", time.Since(start))
+		} else if isPACRequest(r) {
+			// requests to the server itself rather than proxied ones
+			handlePAC(w, r)
+		} else {
+			handleHTTP(w, r)
+			metrics.observeRequest("http", time.Since(start))
+		}
+	}))
 	serverAddr := fmt.Sprintf("%s:%d", dialerConfig.Server, dialerConfig.Port)
 	server := &http.Server{
 		Addr: serverAddr,
 		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			log.Printf("%s %s %s", r.RemoteAddr, r.Method, r.URL)
-			if r.Method == http.MethodConnect {
-				handleTunneling(w, r)
-			} else {
-				handleHTTP(w, r)
+			slog.Info("Request", "client", r.RemoteAddr, "method", r.Method, "url", r.URL.String())
+			r = r.WithContext(withClientAddr(r.Context(), r.RemoteAddr))
+			// the PAC file is fetched before the client knows it needs a proxy
+			if auth != nil && !isPACRequest(r) {
+				username, ok := auth.authorizeRequest(w, r)
+				if !ok {
+					return
+				}
+				r = r.WithContext(withUser(r.Context(), username))
 			}
+			handler.ServeHTTP(w, r)
 		}),
 		// Disable HTTP/2.
 		TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
 	}
 
-	go func() {
-		<-stop
-		server.Shutdown(context.Background())
-	}()
+	scheme := "http"
+	if dialerConfig.TLS != nil {
+		tlsConfig, err := dialerConfig.TLS.getTLSConfig()
+		if err != nil {
+			return nil, listeners, fmt.Errorf("TLS: %w", err)
+		}
+		server.TLSConfig = tlsConfig
+		scheme = "https"
+	}
+	var listener net.Listener
+	if dialerConfig.Socket != "" {
+		listener, err = sharedListeners.listen("unix:"+dialerConfig.Socket, func() (net.Listener, error) {
+			return listenUnix(dialerConfig.Socket, dialerConfig.SocketMode)
+		})
+		serverAddr = dialerConfig.Socket
+		scheme += "+unix"
+	} else {
+		listener, err = sharedListeners.listenTCP(serverAddr)
+	}
+	if err != nil {
+		return nil, listeners, fmt.Errorf("server: %w", err)
+	}
+	slog.Info("Server is running", "address", scheme+"://"+serverAddr)
+	listener = withACL(withTCPOptions(listener), acl)
+	listeners = append(listeners, listener)
+	if server.TLSConfig != nil {
+		go server.ServeTLS(listener, "", "")
+	} else {
+		go server.Serve(listener)
+	}
+	return server, listeners, nil
+}
 
-	log.Println("Server is running on http://" + serverAddr)
-	log.Println("Dialer to on socks5://" + proxyAddr)
-	server.ListenAndServe()
+// serverInstance is a configuration started, serving until it is stopped
+type serverInstance struct {
+	config Config
+	// dialers of the listeners, by their proxies
+	dialers        map[string]proxy.Dialer
+	servers        []*http.Server
+	listeners      []io.Closer
+	logger         *accessLogger
+	exporter       *otlpExporter
+	bandwidthRules *clientBandwidthRules
+	metricsServer  *http.Server
+	statsd         *statsdExporter
+	adminServer    *http.Server
+	accountingDone chan struct{}
+	tunDev         *tunDevice
+	// the TUN device is taken over from the previous configuration, it can't be created twice
+	tunTaken bool
 }
 
-func watchConfigModify(watcher *fsnotify.Watcher, configFile string, notify chan int) {
-	go func() {
-		for {
-			select {
-			case event, ok := <-watcher.Events:
-				if !ok {
-					return
-				}
-				if event.Has(fsnotify.Write) {
-					time.Sleep(100 * time.Millisecond)
-					log.Println("modified file:", event.Name)
-					notify <- 1
+// startMu serializes the starts of the configurations, which share the sockets
+var startMu sync.Mutex
+
+// startServer starts config next to the previous configuration, which keeps serving until it is stopped.
+// The dialers, sockets and services are all started before it takes over: a configuration that can't
+// be started returns the error and the previous one is left running. reload asks the owner of the
+// server to read the configuration again
+func startServer(config Config, reload chan int, previous *serverInstance) (*serverInstance, error) {
+	startMu.Lock()
+	defer startMu.Unlock()
+	// the servers take over the sockets of the previous configuration listening on the same addresses
+	running := sharedListeners.begin()
+	s := &serverInstance{config: config, dialers: make(map[string]proxy.Dialer)}
+	if err := s.start(reload, previous); err != nil {
+		s.stop()
+		sharedListeners.abort(running)
+		return nil, err
+	}
+	s.commit(previous)
+	// the sockets the previous configuration listened on alone are closed
+	sharedListeners.sweep()
+	return s, nil
+}
+
+// getListenerDialer returns the dialer through proxies, listeners with the same proxies share a dialer
+func (s *serverInstance) getListenerDialer(proxies []string) (proxy.Dialer, error) {
+	key := strings.Join(proxies, ",")
+	if dialer, ok := s.dialers[key]; ok {
+		return dialer, nil
+	}
+	listenerConfig := s.config.getListenerConfig(proxies)
+	dialer, err := getDialer(listenerConfig)
+	if err != nil {
+		return nil, fmt.Errorf("dialer: %w", err)
+	}
+	for _, proxyConfig := range listenerConfig.getUpstreamProxies() {
+		slog.Info("Dialer to proxy", "proxy", fmt.Sprintf("%s://%s", proxyConfig.Protocol, proxyConfig.getProxyAddr()))
+	}
+	s.dialers[key] = dialer
+	return dialer, nil
+}
+
+// start opens what the configuration needs, the settings shared by the servers of the process are only
+// changed by commit
+func (s *serverInstance) start(reload chan int, previous *serverInstance) error {
+	config := &s.config
+	var err error
+	if config.AccessLog != "" {
+		if s.logger, err = openAccessLog(config.AccessLog, config.AccessLogRotate); err != nil {
+			return fmt.Errorf("access log: %w", err)
+		}
+	}
+	if s.bandwidthRules, err = newClientBandwidthRules(config.Limits); err != nil {
+		return fmt.Errorf("client bandwidth: %w", err)
+	}
+	for _, dialerConfig := range config.Dialer {
+		dialer, err := s.getListenerDialer(dialerConfig.Proxies)
+		if err != nil {
+			return err
+		}
+		userDialers := make(map[string]proxy.Dialer)
+		for _, user := range dialerConfig.Users {
+			if len(user.Proxies) > 0 {
+				if userDialers[user.Username], err = s.getListenerDialer(user.Proxies); err != nil {
+					return err
 				}
-			case err, ok := <-watcher.Errors:
-				if !ok {
-					return
+			}
+		}
+		server, serverListeners, err := startListener(dialerConfig, dialer, userDialers)
+		s.listeners = append(s.listeners, serverListeners...)
+		if err != nil {
+			return err
+		}
+		if server != nil {
+			s.servers = append(s.servers, server)
+		}
+	}
+	for _, forward := range config.Forwards {
+		dialer, err := s.getListenerDialer(forward.Proxies)
+		if err != nil {
+			return err
+		}
+		listener, err := sharedListeners.listenTCP(forward.Listen)
+		if err != nil {
+			return fmt.Errorf("forward %s: %w", forward.Listen, err)
+		}
+		slog.Info("Forwarding", "listen", forward.Listen, "remote", forward.Remote)
+		listener = withTCPOptions(listener)
+		s.listeners = append(s.listeners, listener)
+		go serveForward(listener, dialer, forward.Remote)
+	}
+	for _, reverse := range config.Reverse {
+		dialer, err := s.getListenerDialer(reverse.Proxies)
+		if err != nil {
+			return err
+		}
+		tunnel, err := startReverseTunnel(config, reverse, dialer)
+		if err != nil {
+			return fmt.Errorf("reverse tunnel %s: %w", reverse.Remote, err)
+		}
+		s.listeners = append(s.listeners, tunnel)
+	}
+	if config.Metrics.Listen != "" {
+		if s.metricsServer, err = startMetricsServer(config.Metrics, newProbes(config)); err != nil {
+			return fmt.Errorf("metrics server: %w", err)
+		}
+	}
+	if config.Statsd.Address != "" {
+		if s.statsd, err = newStatsdExporter(config.Statsd); err != nil {
+			return fmt.Errorf("statsd: %w", err)
+		}
+	}
+	if config.Admin.Listen != "" {
+		s.adminServer, err = startAdminServer(&adminAPI{
+			config:  *config,
+			dialers: s.dialers,
+			reload: func() {
+				if reload != nil {
+					reload <- 1
 				}
-				log.Println("watch file error:", err)
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("admin API: %w", err)
+		}
+	}
+	if config.Accounting.Enabled && config.Accounting.File != "" {
+		if err := clientAccounts.load(config.Accounting.File); err != nil {
+			return fmt.Errorf("client traffic %s: %w", config.Accounting.File, err)
+		}
+	}
+	if config.Tun.Enabled {
+		dialer, err := s.getListenerDialer(nil)
+		if err != nil {
+			return err
+		}
+		if previous != nil && previous.tunDev != nil && previous.config.Tun == config.Tun {
+			s.tunDev, s.tunTaken = previous.tunDev, true
+		} else {
+			if previous != nil && previous.tunDev != nil {
+				// the device of the previous settings may have the same name
+				previous.tunDev.Close()
+				previous.tunDev = nil
+			}
+			if s.tunDev, err = startTun(config.Tun, dialer); err != nil {
+				return fmt.Errorf("TUN device: %w", err)
 			}
+		}
+	}
+	if config.Tracing.Endpoint != "" {
+		s.exporter = newOTLPExporter(config.Tracing)
+	}
+	return nil
+}
 
+// commit applies the settings of the configuration started to the servers of the process
+func (s *serverInstance) commit(previous *serverInstance) {
+	config := &s.config
+	accessLog.Store(s.logger)
+	bufferSize := config.BufferSize
+	if bufferSize == 0 {
+		bufferSize = DEFAULT_BUFFER_SIZE
+	}
+	copyBufferSize.Store(int64(bufferSize) << 10)
+	tunnelLimits.setLimits(config.Limits)
+	tunnelIdleTimeout.Store(int64(config.IdleTimeout))
+	tcpOptions.Store(&config.TCP)
+	timeout := config.DialTimeout
+	if timeout == 0 {
+		timeout = DEFAULT_DIAL_TIMEOUT
+	}
+	dialTimeout.Store(int64(timeout))
+	clientBandwidths.setRules(s.bandwidthRules)
+	setBandwidth(bandwidthLimits.upload, config.Limits.MaxUpload)
+	setBandwidth(bandwidthLimits.download, config.Limits.MaxDownload)
+	spanTracer.Store(s.exporter)
+	statsdClient.Store(s.statsd)
+	// the dashboard lists the last requests
+	recentRequests.enabled.Store(config.Admin.Listen != "")
+	clientAccounts.enabled.Store(config.Accounting.Enabled)
+	s.accountingDone = make(chan struct{})
+	if config.Accounting.Enabled && config.Accounting.File != "" {
+		go clientAccounts.run(config.Accounting.SaveInterval, s.accountingDone)
+	}
+	if s.tunTaken {
+		s.tunDev.setDialer(s.dialers[""])
+		previous.tunDev = nil
+		s.tunTaken = false
+	}
+}
+
+// stop closes the listeners and services of the configuration, the tunnels and requests in progress
+// finish through its proxies, which are closed after them
+func (s *serverInstance) stop() {
+	for _, listener := range s.listeners {
+		listener.Close()
+	}
+	if s.tunDev != nil && !s.tunTaken {
+		s.tunDev.Close()
+	}
+	if s.metricsServer != nil {
+		s.metricsServer.Close()
+	}
+	if s.statsd != nil {
+		statsdClient.CompareAndSwap(s.statsd, nil)
+		s.statsd.Close()
+	}
+	if s.adminServer != nil {
+		stopAdminServer(s.adminServer)
+	}
+	if s.accountingDone != nil {
+		close(s.accountingDone)
+	}
+	if s.logger != nil {
+		// tunnels still open are left out of the log
+		accessLog.CompareAndSwap(s.logger, nil)
+		s.logger.Close()
+	}
+	if s.exporter != nil {
+		spanTracer.CompareAndSwap(s.exporter, nil)
+		s.exporter.Close()
+	}
+	for _, server := range s.servers {
+		go server.Shutdown(context.Background())
+	}
+	// the proxies are closed once the tunnels and requests still open through them are done
+	for _, dialer := range s.dialers {
+		if closer, ok := dialer.(io.Closer); ok {
+			closer.Close()
 		}
-	}()
-	err := watcher.Add(configFile)
-	if err != nil {
-		log.Fatal(err)
 	}
 }
 
-func main() {
+// ExitCode is returned by Main when the command ends with an exit status and no error to log,
+// like check-config finding an invalid file
+type ExitCode int
 
+func (code ExitCode) Error() string {
+	return fmt.Sprintf("exit status %d", int(code))
+}
+
+// exitCode returns the error of a command ending with code, nil when it succeeded
+func exitCode(code int) error {
+	if code == 0 {
+		return nil
+	}
+	return ExitCode(code)
+}
+
+// Main runs the command line tool: the server of the configuration file, reloaded when it changes,
+// or the check-config and init commands. It returns when the process is interrupted, or the error
+// stopping the server from starting
+func Main() error {
+	if err := parseFlags(); err != nil {
+		return err
+	}
+	if flag.Arg(0) == "check-config" {
+		return exitCode(checkConfig(flag.Args()[1:]))
+	}
+	if flag.Arg(0) == "init" {
+		return exitCode(initConfig(flag.Args()[1:]))
+	}
 	configFile := getConfigFile()
 
-	stop := make(chan int)
 	modify := make(chan int)
 
-	dialerConfig, proxyConfig := getProxyConfig(configFile)
-	if proxyConfig == nil {
-		log.Fatal("No proxy configured")
+	config, err := getConfig(configFile)
+	if err != nil {
+		return fmt.Errorf("Invalid configuration: %w", err)
 	}
-	go runServer(*dialerConfig, *proxyConfig, stop)
+	logOutput, err := setupLogging(config.Log)
+	if err != nil {
+		return fmt.Errorf("Cannot open the log output: %w", err)
+	}
+	if !config.hasUpstreamProxies() {
+		return errors.New("No proxy configured")
+	}
+	configPollInterval.Store(int64(config.ConfigPollInterval))
+	server := newServer(*config, modify)
+	served := make(chan error, 1)
+	go func() {
+		served <- server.ListenAndServe(context.Background())
+	}()
 
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, os.Interrupt)
+	go logStatsOnSignal()
+	go reloadOnSignal(modify)
 
-	watcher, err := fsnotify.NewWatcher()
+	watcher, err := newConfigWatcher(modify)
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("Cannot watch the configuration: %w", err)
 	}
 
 	defer watcher.Close()
@@ -292,26 +1380,60 @@ func main() {
 	go func() {
 		for {
 			<-modify
-			nextDialerConfig, nextProxyConfig := getProxyConfig(configFile)
-			if nextProxyConfig == nil {
-				log.Println("No found proxy configured")
+			// the file may be saved in the middle of an edit, the server keeps running until it is valid
+			nextConfig, err := getConfig(configFile)
+			if err != nil {
+				slog.Error("Invalid configuration, the running one is kept", "err", err)
 				continue
 			}
-			if nextDialerConfig.getDialerConfHash() != dialerConfig.getDialerConfHash() ||
-				nextProxyConfig.getProxyConfHash() != proxyConfig.getProxyConfHash() {
-				stop <- 1
-				go runServer(*nextDialerConfig, *nextProxyConfig, stop)
-				dialerConfig = nextDialerConfig
-				proxyConfig = nextProxyConfig
+			if !nextConfig.hasUpstreamProxies() {
+				slog.Warn("No found proxy configured")
+				continue
+			}
+			if configFile != "" {
+				if err := watcher.watch(getWatchedPaths(configFile, nextConfig.Include)); err != nil {
+					slog.Warn("Cannot watch the configuration", "err", err)
+				}
+			}
+			if nextConfig.getConfHash() != config.getConfHash() {
+				if err := server.Apply(*nextConfig); err != nil {
+					slog.Error("Cannot start the configuration, the running one is kept", "err", err)
+					continue
+				}
+				if nextConfig.Log != config.Log {
+					// the previous logger is kept when the new output can't be opened
+					if output, err := setupLogging(nextConfig.Log); err != nil {
+						slog.Error("Cannot open the log output", "err", err)
+					} else {
+						logOutput.Close()
+						logOutput = output
+					}
+				}
+				configPollInterval.Store(int64(nextConfig.ConfigPollInterval))
+				config = nextConfig
 			} else {
-				log.Println("No change in proxy configuration")
+				slog.Info("No change in proxy configuration")
 			}
 		}
 	}()
 
-	watchConfigModify(watcher, configFile, modify)
+	if isConfigURL(configFile) {
+		go pollConfigURL(configFile, modify)
+	}
+	if configFile != "" {
+		if err := watcher.watch(getWatchedPaths(configFile, config.Include)); err != nil {
+			return fmt.Errorf("Cannot watch the configuration: %w", err)
+		}
+	}
 
 	fmt.Printf("For exit press ctrl + C again.\n")
 
-	<-sigs
+	select {
+	case <-sigs:
+	case err := <-served:
+		return fmt.Errorf("Cannot start the server: %w", err)
+	}
+	// the traffic since the last save
+	clientAccounts.save()
+	return nil
 }
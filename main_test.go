@@ -0,0 +1,150 @@
+package proxydialer
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+func TestGetConnectAddress(t *testing.T) {
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"example.com:443", "example.com:443"},
+		{"example.com", "example.com:443"},
+		{"10.0.0.1:8443", "10.0.0.1:8443"},
+		{"[::1]:443", "[::1]:443"},
+		{"[::1]", "[::1]:443"},
+		{"::1", "[::1]:443"},
+		{"[2001:db8::1]:8443", "[2001:db8::1]:8443"},
+		{"[fe80::1%eth0]:443", "[fe80::1%eth0]:443"},
+		{"[fe80::1%eth0]", "[fe80::1%eth0]:443"},
+		{"fe80::1%eth0", "[fe80::1%eth0]:443"},
+	}
+	for _, test := range tests {
+		r := &http.Request{Method: http.MethodConnect, Host: test.host}
+		if got := getConnectAddress(r); got != test.want {
+			t.Errorf("getConnectAddress(%q) = %q, want %q", test.host, got, test.want)
+		}
+	}
+}
+
+func TestGetProxyAddr(t *testing.T) {
+	tests := []struct {
+		server string
+		port   int
+		want   string
+	}{
+		{"10.0.0.1", 1080, "10.0.0.1:1080"},
+		{"proxy.example.com", 8080, "proxy.example.com:8080"},
+		{"::1", 1080, "[::1]:1080"},
+		{"[::1]", 1080, "[::1]:1080"},
+		{"2001:db8::1", 3128, "[2001:db8::1]:3128"},
+		{"[fe80::1%eth0]", 1080, "[fe80::1%eth0]:1080"},
+	}
+	for _, test := range tests {
+		conf := ProxyConf{Server: test.server, Port: test.port}
+		if got := conf.getProxyAddr(); got != test.want {
+			t.Errorf("getProxyAddr(%q, %d) = %q, want %q", test.server, test.port, got, test.want)
+		}
+	}
+}
+
+func TestWebSocketLocation(t *testing.T) {
+	tests := []struct {
+		server     string
+		port       int
+		transport  TransportConf
+		location   string
+		serverName string
+	}{
+		{"example.com", 443, TransportConf{Type: TRANSPORT_WEBSOCKET, Path: "/ws"}, "wss://example.com:443/ws", "example.com"},
+		{"example.com", 443, TransportConf{Type: TRANSPORT_WEBSOCKET, Host: "cdn.example.com"}, "wss://cdn.example.com/", "example.com"},
+		{"::1", 8443, TransportConf{Type: TRANSPORT_WEBSOCKET, Path: "/ws?ed=2048"}, "wss://[::1]:8443/ws?ed=2048", "::1"},
+		{"[2001:db8::1]", 443, TransportConf{Type: TRANSPORT_WEBSOCKET}, "wss://[2001:db8::1]:443/", "2001:db8::1"},
+	}
+	for _, test := range tests {
+		conf := ProxyConf{Server: test.server, Port: test.port, Transport: &test.transport}
+		d, err := newTransportDialer(conf, true, proxy.Direct)
+		if err != nil {
+			t.Errorf("newTransportDialer(%q): %v", test.server, err)
+			continue
+		}
+		if got := d.wsConfig.Location.String(); got != test.location {
+			t.Errorf("location of %q = %q, want %q", test.server, got, test.location)
+		}
+		if got := d.tlsConfig.ServerName; got != test.serverName {
+			t.Errorf("server name of %q = %q, want %q", test.server, got, test.serverName)
+		}
+	}
+}
+
+// listenIPv6 listens on the IPv6 loopback, the test is skipped without IPv6
+func listenIPv6(t *testing.T) net.Listener {
+	t.Helper()
+	listener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 loopback unavailable: %v", err)
+	}
+	return listener
+}
+
+func TestConnectIPv6(t *testing.T) {
+	// the destination echoes what it receives
+	origin := listenIPv6(t)
+	defer origin.Close()
+	go func() {
+		for {
+			conn, err := origin.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(getHandleTunneling(proxy.Direct, false)))
+	server.Listener = listenIPv6(t)
+	server.Start()
+	defer server.Close()
+
+	conn, err := net.DialTimeout("tcp", server.Listener.Addr().String(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	target := origin.Addr().String()
+	if _, err := io.WriteString(conn, "CONNECT "+target+" HTTP/1.1\r\nHost: "+target+"\r\n\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT %s: status %d", target, resp.StatusCode)
+	}
+	if _, err := io.WriteString(conn, "ping"); err != nil {
+		t.Fatal(err)
+	}
+	echo := make([]byte, 4)
+	if _, err := io.ReadFull(reader, echo); err != nil {
+		t.Fatal(err)
+	}
+	if string(echo) != "ping" {
+		t.Fatalf("echo %q, want %q", echo, "ping")
+	}
+}
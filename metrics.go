@@ -0,0 +1,421 @@
+package proxydialer
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+const (
+	METRICS_PATH                     = "/metrics"
+	DEFAULT_METRICS_TOP_DESTINATIONS = 20
+)
+
+// Destinations whose latencies are recorded, the ones used the least recently are dropped for the next ones
+const maxTrackedDestinations = 1000
+
+// Upper bounds in seconds of the buckets of the latency histograms
+var latencyBuckets = [...]float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// MetricsConf is the HTTP server exposing the metrics in the Prometheus text format
+type MetricsConf struct {
+	// Address of the server, e.g. "127.0.0.1:9100", disabled when not set
+	Listen string `yaml:"listen"`
+	// Destinations with the most connections whose latencies are exported, default 20
+	TopDestinations int `yaml:"top_destinations"`
+}
+
+func (conf MetricsConf) getTopDestinations() int {
+	if conf.TopDestinations <= 0 {
+		return DEFAULT_METRICS_TOP_DESTINATIONS
+	}
+	return conf.TopDestinations
+}
+
+// histogram counts durations in the latency buckets
+type histogram struct {
+	buckets [len(latencyBuckets) + 1]atomic.Uint64
+	count   atomic.Uint64
+	// nanoseconds
+	sum atomic.Uint64
+}
+
+func (h *histogram) observe(duration time.Duration) {
+	i := 0
+	for i < len(latencyBuckets) && duration.Seconds() > latencyBuckets[i] {
+		i++
+	}
+	h.buckets[i].Add(1)
+	h.count.Add(1)
+	h.sum.Add(uint64(duration))
+}
+
+// latencyStats are the time taken to dial and then to receive the first byte
+type latencyStats struct {
+	dial      histogram
+	firstByte histogram
+	// unix nano time of the last dial, for the destinations
+	lastUsed atomic.Int64
+}
+
+type destinationKey struct {
+	host     string
+	upstream string
+}
+
+// upstreamStats are the counters of the traffic sent through a proxy
+type upstreamStats struct {
+	received    atomic.Uint64
+	sent        atomic.Uint64
+	connections atomic.Uint64
+	open        atomic.Int64
+	dialErrors  atomic.Uint64
+	latency     latencyStats
+}
+
+// durationStats sums the durations of the requests of a type
+type durationStats struct {
+	count atomic.Uint64
+	// nanoseconds
+	sum atomic.Uint64
+}
+
+// proxyMetrics are kept for the lifetime of the process, across reloads
+type proxyMetrics struct {
+	activeTunnels atomic.Int64
+	reloads       atomic.Uint64
+
+	mu           sync.Mutex
+	upstreams    map[string]*upstreamStats
+	requests     map[string]*durationStats
+	destinations map[destinationKey]*latencyStats
+}
+
+var metrics = &proxyMetrics{
+	upstreams:    make(map[string]*upstreamStats),
+	requests:     make(map[string]*durationStats),
+	destinations: make(map[destinationKey]*latencyStats),
+}
+
+func (m *proxyMetrics) getUpstream(name string) *upstreamStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stats, ok := m.upstreams[name]
+	if !ok {
+		stats = &upstreamStats{}
+		m.upstreams[name] = stats
+	}
+	return stats
+}
+
+// observeRequest records the time taken by a request, until the tunnel is established for CONNECT
+func (m *proxyMetrics) observeRequest(requestType string, duration time.Duration) {
+	m.mu.Lock()
+	stats, ok := m.requests[requestType]
+	if !ok {
+		stats = &durationStats{}
+		m.requests[requestType] = stats
+	}
+	m.mu.Unlock()
+	stats.count.Add(1)
+	stats.sum.Add(uint64(duration))
+	sendTiming("request.duration", duration, "type:"+requestType)
+}
+
+// getDestination returns the latencies of a host reached through a proxy, a tenth of the destinations,
+// the ones used the least recently, are dropped when too many are recorded
+func (m *proxyMetrics) getDestination(host, upstream string) *latencyStats {
+	key := destinationKey{host, upstream}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stats, ok := m.destinations[key]
+	if !ok {
+		if len(m.destinations) >= maxTrackedDestinations {
+			m.dropDestinationsLocked(maxTrackedDestinations / 10)
+		}
+		stats = &latencyStats{}
+		m.destinations[key] = stats
+	}
+	stats.lastUsed.Store(time.Now().UnixNano())
+	return stats
+}
+
+// dropDestinationsLocked drops the n destinations used the least recently
+func (m *proxyMetrics) dropDestinationsLocked(n int) {
+	keys := slices.Collect(maps.Keys(m.destinations))
+	slices.SortFunc(keys, func(a, b destinationKey) int {
+		return cmp.Compare(m.destinations[a].lastUsed.Load(), m.destinations[b].lastUsed.Load())
+	})
+	for _, key := range keys[:min(n, len(keys))] {
+		delete(m.destinations, key)
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// writeMetric writes the HELP and TYPE lines of a metric followed by its samples
+func writeMetric(w io.Writer, name, metricType, help string, samples map[string]string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+	for _, label := range slices.Sorted(maps.Keys(samples)) {
+		fmt.Fprintf(w, "%s%s %s\n", name, label, samples[label])
+	}
+}
+
+func getLabel(name, value string) string {
+	return fmt.Sprintf(`{%s="%s"}`, name, labelEscaper.Replace(value))
+}
+
+// writeHistograms writes the HELP and TYPE lines of a histogram followed by its series,
+// keyed by their labels without braces
+func writeHistograms(w io.Writer, name, help string, histograms map[string]*histogram) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	for _, labels := range slices.Sorted(maps.Keys(histograms)) {
+		h := histograms[labels]
+		var cumulative uint64
+		for i, bound := range latencyBuckets {
+			cumulative += h.buckets[i].Load()
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"%g\"} %d\n", name, labels, bound, cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, h.count.Load())
+		fmt.Fprintf(w, "%s_sum{%s} %g\n", name, labels, time.Duration(h.sum.Load()).Seconds())
+		fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, h.count.Load())
+	}
+}
+
+// getTopDestinations returns the latencies of the n destinations with the most dials
+func (m *proxyMetrics) getTopDestinations(n int) map[destinationKey]*latencyStats {
+	m.mu.Lock()
+	keys := slices.Collect(maps.Keys(m.destinations))
+	destinations := maps.Clone(m.destinations)
+	m.mu.Unlock()
+	slices.SortFunc(keys, func(a, b destinationKey) int {
+		return cmp.Compare(destinations[b].dial.count.Load(), destinations[a].dial.count.Load())
+	})
+	top := make(map[destinationKey]*latencyStats)
+	for _, key := range keys[:min(n, len(keys))] {
+		top[key] = destinations[key]
+	}
+	return top
+}
+
+// write writes the metrics in the Prometheus text format, with the latencies of the top destinations
+func (m *proxyMetrics) write(w io.Writer, topDestinations int) {
+	writeMetric(w, "proxydialer_active_tunnels", "gauge", "Tunnels currently open.",
+		map[string]string{"": fmt.Sprint(m.activeTunnels.Load())})
+	writeMetric(w, "proxydialer_config_reloads_total", "counter", "Configuration reloads.",
+		map[string]string{"": fmt.Sprint(m.reloads.Load())})
+
+	received := make(map[string]string)
+	sent := make(map[string]string)
+	connections := make(map[string]string)
+	open := make(map[string]string)
+	dialErrors := make(map[string]string)
+	count := make(map[string]string)
+	sum := make(map[string]string)
+	dialLatency := make(map[string]*histogram)
+	firstByteLatency := make(map[string]*histogram)
+	m.mu.Lock()
+	for name, stats := range m.upstreams {
+		label := getLabel("proxy", name)
+		received[label] = fmt.Sprint(stats.received.Load())
+		sent[label] = fmt.Sprint(stats.sent.Load())
+		connections[label] = fmt.Sprint(stats.connections.Load())
+		open[label] = fmt.Sprint(stats.open.Load())
+		dialErrors[label] = fmt.Sprint(stats.dialErrors.Load())
+		labels := strings.Trim(label, "{}")
+		dialLatency[labels] = &stats.latency.dial
+		firstByteLatency[labels] = &stats.latency.firstByte
+	}
+	for requestType, stats := range m.requests {
+		label := getLabel("type", requestType)
+		count[label] = fmt.Sprint(stats.count.Load())
+		sum[label] = fmt.Sprint(time.Duration(stats.sum.Load()).Seconds())
+	}
+	m.mu.Unlock()
+	writeMetric(w, "proxydialer_upstream_received_bytes_total", "counter", "Bytes received through a proxy.", received)
+	writeMetric(w, "proxydialer_upstream_sent_bytes_total", "counter", "Bytes sent through a proxy.", sent)
+	writeMetric(w, "proxydialer_upstream_connections_total", "counter", "Connections dialed through a proxy.", connections)
+	writeMetric(w, "proxydialer_upstream_open_connections", "gauge", "Connections through a proxy currently open.", open)
+	writeMetric(w, "proxydialer_upstream_dial_errors_total", "counter", "Failed dials through a proxy.", dialErrors)
+	writeHistograms(w, "proxydialer_upstream_dial_seconds", "Time taken to dial through a proxy.", dialLatency)
+	writeHistograms(w, "proxydialer_upstream_first_byte_seconds", "Time from the dial to the first byte received through a proxy.", firstByteLatency)
+	destinationDial := make(map[string]*histogram)
+	destinationFirstByte := make(map[string]*histogram)
+	for key, stats := range m.getTopDestinations(topDestinations) {
+		labels := strings.Trim(getLabel("destination", key.host), "{}") + "," + strings.Trim(getLabel("proxy", key.upstream), "{}")
+		destinationDial[labels] = &stats.dial
+		destinationFirstByte[labels] = &stats.firstByte
+	}
+	writeHistograms(w, "proxydialer_destination_dial_seconds", "Time taken to dial the destinations with the most connections.", destinationDial)
+	writeHistograms(w, "proxydialer_destination_first_byte_seconds", "Time from the dial to the first byte received from the destinations with the most connections.", destinationFirstByte)
+	fmt.Fprintf(w, "# HELP proxydialer_request_duration_seconds Time taken by the requests, until the tunnel is established for CONNECT.\n")
+	fmt.Fprintf(w, "# TYPE proxydialer_request_duration_seconds summary\n")
+	for _, label := range slices.Sorted(maps.Keys(count)) {
+		fmt.Fprintf(w, "proxydialer_request_duration_seconds_sum%s %s\n", label, sum[label])
+		fmt.Fprintf(w, "proxydialer_request_duration_seconds_count%s %s\n", label, count[label])
+	}
+}
+
+// startMetricsServer serves the metrics and the probes until the returned server is closed
+func startMetricsServer(conf MetricsConf, probes *probes) (*http.Server, error) {
+	listener, err := sharedListeners.listenTCP(conf.Listen)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(METRICS_PATH, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		metrics.write(w, conf.getTopDestinations())
+	})
+	probes.register(mux)
+	server := &http.Server{Handler: mux}
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Metrics server", "err", err)
+		}
+	}()
+	slog.Info("Metrics are served", "address", "http://"+listener.Addr().String()+METRICS_PATH)
+	return server, nil
+}
+
+// meteredDialer counts the traffic and the failed dials of a proxy
+type meteredDialer struct {
+	name string
+	// name told to the clients in the dial errors, empty for an unnamed proxy, named after its address
+	public string
+	dialer proxy.Dialer
+	stats  *upstreamStats
+
+	mu sync.Mutex
+	// connections dialed and still open, the dialer is closed after the last one once it is closed
+	open    int
+	closing bool
+	closed  sync.Once
+}
+
+func newMeteredDialer(name string, dialer proxy.Dialer) *meteredDialer {
+	return &meteredDialer{name: name, public: name, dialer: dialer, stats: metrics.getUpstream(name)}
+}
+
+func (d *meteredDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+func (d *meteredDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	ctx, span := startSpan(ctx, "dial", SPAN_KIND_CLIENT)
+	span.setAttribute("proxydialer.upstream", d.name)
+	span.setAttribute("server.address", address)
+	start := time.Now()
+	conn, err := dialContext(ctx, d.dialer, network, address)
+	span.setError(err)
+	span.finish()
+	if err != nil {
+		d.stats.dialErrors.Add(1)
+		return nil, &upstreamError{upstream: d.name, public: d.public, err: err}
+	}
+	dialed := time.Now()
+	d.stats.connections.Add(1)
+	d.stats.open.Add(1)
+	d.stats.latency.dial.observe(dialed.Sub(start))
+	sendTiming("upstream.dial", dialed.Sub(start), "proxy:"+d.name)
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	destination := metrics.getDestination(normalizeHost(host), d.name)
+	destination.dial.observe(dialed.Sub(start))
+	d.mu.Lock()
+	d.open++
+	d.mu.Unlock()
+	return &meteredConn{Conn: conn, upstream: d.name, stats: d.stats, destination: destination, dialed: dialed, dialer: d}, nil
+}
+
+// Close closes the proxy dialer when no connection dialed through it is open, otherwise after the last one,
+// so that the tunnels open during a reload aren't cut
+func (d *meteredDialer) Close() error {
+	d.mu.Lock()
+	d.closing = true
+	open := d.open
+	d.mu.Unlock()
+	if open > 0 {
+		return nil
+	}
+	return d.closeDialer()
+}
+
+func (d *meteredDialer) closeDialer() error {
+	var err error
+	d.closed.Do(func() {
+		if closer, ok := d.dialer.(io.Closer); ok {
+			err = closer.Close()
+		}
+	})
+	return err
+}
+
+// release counts a connection closed
+func (d *meteredDialer) release() {
+	d.mu.Lock()
+	d.open--
+	last := d.closing && d.open == 0
+	d.mu.Unlock()
+	if last {
+		d.closeDialer()
+	}
+}
+
+type meteredConn struct {
+	net.Conn
+	upstream string
+	stats    *upstreamStats
+	// latencies of the destination, nil when it isn't tracked
+	destination *latencyStats
+	dialed      time.Time
+	received    atomic.Bool
+	closed      atomic.Bool
+	dialer      *meteredDialer
+}
+
+func (c *meteredConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.stats.received.Add(uint64(n))
+	if n > 0 && c.received.CompareAndSwap(false, true) {
+		firstByte := time.Since(c.dialed)
+		c.stats.latency.firstByte.observe(firstByte)
+		sendTiming("upstream.first_byte", firstByte, "proxy:"+c.upstream)
+		if c.destination != nil {
+			c.destination.firstByte.observe(firstByte)
+		}
+	}
+	return n, err
+}
+
+func (c *meteredConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.stats.sent.Add(uint64(n))
+	return n, err
+}
+
+func (c *meteredConn) Close() error {
+	if !c.closed.CompareAndSwap(false, true) {
+		return c.Conn.Close()
+	}
+	c.stats.open.Add(-1)
+	err := c.Conn.Close()
+	// the proxy dialer may be closed with its last connection
+	c.dialer.release()
+	return err
+}
@@ -0,0 +1,65 @@
+package proxydialer
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+// HTTPMiddleware wraps the handler of the requests of the HTTP listeners, CONNECT requests included, after
+// the authentication of the client: it can inspect or modify a request, or answer it without calling next
+type HTTPMiddleware func(next http.Handler) http.Handler
+
+// TunnelMiddleware wraps the dial of the destination of the tunnels of every server, CONNECT, SOCKS5, forwards,
+// transparent proxy and TUN device: it can refuse a tunnel by returning an error, or wrap the connection dialed,
+// whose reads are the data sent to the client and writes the data of the client
+type TunnelMiddleware func(next DialContext) DialContext
+
+var middlewares struct {
+	sync.RWMutex
+	http   []HTTPMiddleware
+	tunnel []TunnelMiddleware
+}
+
+// UseHTTPMiddleware adds a middleware of the HTTP requests, the first one added is called first. The listeners
+// started before keep their middlewares until the next reload
+func UseHTTPMiddleware(middleware HTTPMiddleware) {
+	middlewares.Lock()
+	defer middlewares.Unlock()
+	middlewares.http = append(middlewares.http, middleware)
+}
+
+// UseTunnelMiddleware adds a middleware of the tunnels, the first one added is called first
+func UseTunnelMiddleware(middleware TunnelMiddleware) {
+	middlewares.Lock()
+	defer middlewares.Unlock()
+	middlewares.tunnel = append(middlewares.tunnel, middleware)
+}
+
+func withHTTPMiddlewares(handler http.Handler) http.Handler {
+	middlewares.RLock()
+	defer middlewares.RUnlock()
+	for i := len(middlewares.http) - 1; i >= 0; i-- {
+		handler = middlewares.http[i](handler)
+	}
+	return handler
+}
+
+func withTunnelMiddlewares(dial DialContext) DialContext {
+	middlewares.RLock()
+	defer middlewares.RUnlock()
+	for i := len(middlewares.tunnel) - 1; i >= 0; i-- {
+		dial = middlewares.tunnel[i](dial)
+	}
+	return dial
+}
+
+// ClientIP returns the IP of the client a request or a tunnel is handled for, empty if unknown
+func ClientIP(ctx context.Context) string {
+	return getClientIP(ctx)
+}
+
+// ClientUser returns the user the client authenticated as, empty without authentication
+func ClientUser(ctx context.Context) string {
+	return getUser(ctx)
+}
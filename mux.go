@@ -0,0 +1,150 @@
+package proxydialer
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"slices"
+	"sync"
+
+	"github.com/xtaci/smux"
+	"golang.org/x/net/proxy"
+)
+
+// MuxConf multiplexes the tunnels through a SOCKS5 proxy over a few long-lived smux sessions, the proxy must be
+// the mux_port of a listener of this tool
+type MuxConf struct {
+	Enabled bool `yaml:"enabled"`
+	// Sessions open to the proxy, the tunnels are spread over them, default 1
+	Connections int `yaml:"connections"`
+}
+
+func (conf MuxConf) validate() error {
+	if conf.Connections < 0 {
+		return errors.New("negative number of connections")
+	}
+	return nil
+}
+
+func newMuxConfig() *smux.Config {
+	return smux.DefaultConfig()
+}
+
+// muxDialer opens each tunnel as a SOCKS5 stream of a session to the proxy
+type muxDialer struct {
+	addr string
+	auth *proxy.Auth
+	// dials the proxy server, the address is ignored
+	forward     proxy.Dialer
+	connections int
+
+	mu       sync.Mutex
+	sessions []*smux.Session
+}
+
+func newMuxDialer(addr string, auth *proxy.Auth, forward proxy.Dialer, conf MuxConf) *muxDialer {
+	return &muxDialer{addr: addr, auth: auth, forward: forward, connections: max(conf.Connections, 1)}
+}
+
+// getSession returns the session with the fewest streams, a new one is opened while there are less than configured
+func (d *muxDialer) getSession(ctx context.Context) (*smux.Session, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.sessions = slices.DeleteFunc(d.sessions, (*smux.Session).IsClosed)
+	if len(d.sessions) >= d.connections {
+		return slices.MinFunc(d.sessions, func(a, b *smux.Session) int {
+			return a.NumStreams() - b.NumStreams()
+		}), nil
+	}
+	conn, err := dialContext(ctx, d.forward, "tcp", d.addr)
+	if err != nil {
+		return nil, err
+	}
+	session, err := smux.Client(conn, newMuxConfig())
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	d.sessions = append(d.sessions, session)
+	return session, nil
+}
+
+func (d *muxDialer) openStream(ctx context.Context) (*smux.Stream, error) {
+	session, err := d.getSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := session.OpenStream()
+	if err == nil {
+		return stream, nil
+	}
+	// the session broke meanwhile, the stream is opened on another one
+	session.Close()
+	session, err = d.getSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return session.OpenStream()
+}
+
+func (d *muxDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+func (d *muxDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
+		return nil, errors.New("socks: unsupported network " + network)
+	}
+	stream, err := d.openStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stop := withConnDeadline(ctx, stream)
+	err = handshakeSocks(stream, d.auth)
+	stop()
+	if err == nil {
+		err = connectSocks(ctx, stream, address)
+	}
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+	return stream, nil
+}
+
+// Close closes the sessions with their tunnels
+func (d *muxDialer) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, session := range d.sessions {
+		session.Close()
+	}
+	d.sessions = nil
+	return nil
+}
+
+// serveMux accepts smux sessions until the listener is closed, each stream is served as a SOCKS5 client
+func serveMux(listener net.Listener, dialer proxy.Dialer, auth *authenticator) error {
+	return serveListener(listener, func(conn net.Conn) {
+		serveMuxSession(conn, dialer, auth)
+	})
+}
+
+// serveMuxSession serves the streams of a session until it is closed by the client or breaks
+func serveMuxSession(conn net.Conn, dialer proxy.Dialer, auth *authenticator) {
+	session, err := smux.Server(conn, newMuxConfig())
+	if err != nil {
+		slog.Warn("Mux session failed", "client", conn.RemoteAddr().String(), "err", err)
+		conn.Close()
+		return
+	}
+	defer session.Close()
+	for {
+		stream, err := session.AcceptStream()
+		if err != nil {
+			return
+		}
+		go handleSOCKS5Conn(stream, dialer, auth)
+	}
+}
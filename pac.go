@@ -0,0 +1,204 @@
+package proxydialer
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/proxy"
+)
+
+const PAC_PATH = "/proxy.pac"
+
+// isPACRequest tells whether a request fetches the PAC file from the listener rather than being proxied
+func isPACRequest(r *http.Request) bool {
+	return r.Method != http.MethodConnect && r.URL.Host == "" && r.URL.Path == PAC_PATH
+}
+
+// pacHelpers are the functions used by the generated conditions
+const pacHelpers = `function matchDomains(host, d) {
+    if (d.all || d.full[host] || d.suffix[host]) return true;
+    for (var h = host, i = h.indexOf("."); i >= 0; i = h.indexOf(".")) {
+        h = h.substring(i + 1);
+        if (d.suffix[h] || d.wildcard[h]) return true;
+    }
+    for (var j = 0; j < d.regexp.length; j++) {
+        if (new RegExp(d.regexp[j]).test(host)) return true;
+    }
+    return false;
+}
+
+function matchNets(ip, nets) {
+    if (!ip) return false;
+    for (var i = 0; i < nets.length; i++) {
+        if (isInNet(ip, nets[i][0], nets[i][1])) return true;
+    }
+    return false;
+}
+
+function getPort(url) {
+    var m = /^[a-z0-9+.-]+:\/\/(?:[^\/@]*@)?(?:\[[^\]]*\]|[^\/:]*)(?::(\d+))?/i.exec(url);
+    if (m && m[1]) return parseInt(m[1], 10);
+    return url.substring(0, 6).toLowerCase() == "https:" ? 443 : 80;
+}
+
+`
+
+// pacDomains is the JavaScript form of domain patterns used by matchDomains
+type pacDomains struct {
+	All      bool            `json:"all"`
+	Full     map[string]bool `json:"full"`
+	Suffix   map[string]bool `json:"suffix"`
+	Wildcard map[string]bool `json:"wildcard"`
+	Regexp   []string        `json:"regexp"`
+}
+
+func newPACDomains() *pacDomains {
+	return &pacDomains{
+		Full:     make(map[string]bool),
+		Suffix:   make(map[string]bool),
+		Wildcard: make(map[string]bool),
+		Regexp:   []string{},
+	}
+}
+
+func (d *pacDomains) add(patterns []string) {
+	for _, pattern := range patterns {
+		switch {
+		case strings.HasPrefix(pattern, "regexp:"):
+			d.Regexp = append(d.Regexp, strings.TrimPrefix(pattern, "regexp:"))
+		case strings.HasPrefix(pattern, "full:"):
+			d.Full[normalizeHost(strings.TrimPrefix(pattern, "full:"))] = true
+		case pattern == "*":
+			d.All = true
+		case strings.HasPrefix(pattern, "*."):
+			d.Wildcard[normalizeHost(strings.TrimPrefix(pattern, "*."))] = true
+		default:
+			d.Suffix[normalizeHost(pattern)] = true
+		}
+	}
+}
+
+// pacNets converts IPv4 ranges to isInNet arguments, IPv6 ranges can't be checked by PAC files
+func pacNets(nets []*net.IPNet) (args [][2]string, complete bool) {
+	complete = true
+	for _, ipNet := range nets {
+		ip4 := ipNet.IP.To4()
+		if ip4 == nil || len(ipNet.Mask) != net.IPv4len {
+			complete = false
+			continue
+		}
+		args = append(args, [2]string{ip4.String(), net.IP(ipNet.Mask).String()})
+	}
+	return args, complete
+}
+
+func toJS(v any) string {
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+// pacCondition converts the conditions of a rule to a JavaScript expression,
+// exact is false when some conditions can only be checked by the proxy and were assumed to match
+func pacCondition(r *rule) (cond string, exact bool) {
+	exact = true
+	var and []string
+	if len(r.clients) > 0 || len(r.times) > 0 {
+		exact = false
+	}
+	if len(r.ports) > 0 {
+		var or []string
+		for _, pr := range r.ports {
+			or = append(or, fmt.Sprintf("(port >= %d && port <= %d)", pr.from, pr.to))
+		}
+		and = append(and, "("+strings.Join(or, " || ")+")")
+	}
+
+	if r.hasHostConditions() {
+		domains := newPACDomains()
+		domains.add(r.domains.patterns)
+		nets := append([]*net.IPNet{}, r.nets...)
+		hostExact := len(r.countries) == 0
+		for _, set := range r.ruleSets {
+			entries := set.entries.Load()
+			domains.add(entries.domains.patterns)
+			nets = append(nets, entries.nets...)
+		}
+		args, complete := pacNets(nets)
+		if !complete {
+			hostExact = false
+		}
+
+		if hostExact {
+			var or []string
+			if domains.All || len(domains.Full)+len(domains.Suffix)+len(domains.Wildcard)+len(domains.Regexp) > 0 {
+				or = append(or, "matchDomains(host, "+toJS(domains)+")")
+			}
+			if len(args) > 0 {
+				ip := "resolve()"
+				if r.literalOnly {
+					ip = "(isIP ? host : null)"
+				}
+				or = append(or, "matchNets("+ip+", "+toJS(args)+")")
+			}
+			if len(or) == 0 {
+				or = append(or, "false")
+			}
+			and = append(and, "("+strings.Join(or, " || ")+")")
+		} else {
+			// the host may match a condition the proxy has to check
+			exact = false
+		}
+	}
+
+	if len(and) == 0 {
+		return "true", exact
+	}
+	return strings.Join(and, " && "), exact
+}
+
+// generatePAC creates a PAC file sending the destinations the rules dial directly around the proxy,
+// everything else, including rejected destinations and rules that can't be checked by a PAC file,
+// goes through the proxy which applies the rules again
+func generatePAC(dialer proxy.Dialer, proxyAddr string, secure bool) string {
+	var b strings.Builder
+	b.WriteString(pacHelpers)
+	b.WriteString("function FindProxyForURL(url, host) {\n")
+	scheme := "PROXY "
+	if secure {
+		scheme = "HTTPS "
+	}
+	fmt.Fprintf(&b, "    var proxy = %s;\n", toJS(scheme+proxyAddr))
+	rt, ok := dialer.(*router)
+	if ok {
+		b.WriteString("    var port = getPort(url);\n")
+		b.WriteString("    var isIP = /^\\d+\\.\\d+\\.\\d+\\.\\d+$/.test(host);\n")
+		b.WriteString("    var ip;\n")
+		b.WriteString("    function resolve() {\n")
+		b.WriteString("        if (ip === undefined) ip = isIP ? host : dnsResolve(host);\n")
+		b.WriteString("        return ip;\n")
+		b.WriteString("    }\n")
+		for _, r := range rt.rules {
+			cond, exact := pacCondition(r)
+			result := "proxy"
+			if exact && r.action == ACTION_DIRECT {
+				result = `"DIRECT"`
+			}
+			fmt.Fprintf(&b, "    if (%s) return %s;\n", cond, result)
+		}
+	}
+	b.WriteString("    return proxy;\n")
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// getHandlePAC serves the PAC file, the proxy address is the one the client reached the server at
+// and the proxy is used over TLS when the file was fetched over TLS
+func getHandlePAC(dialer proxy.Dialer) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+		w.Write([]byte(generatePAC(dialer, r.Host, r.TLS != nil)))
+	}
+}
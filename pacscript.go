@@ -0,0 +1,275 @@
+package proxydialer
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dop251/goja"
+)
+
+const (
+	DEFAULT_PAC_INTERVAL = time.Hour
+	DEFAULT_PAC_TIMEOUT  = time.Second
+)
+
+// errPACTimeout interrupts a PAC file running longer than its timeout
+var errPACTimeout = errors.New("PAC file timed out")
+
+// PACConf is a PAC file deciding which destinations are dialed directly
+type PACConf struct {
+	Path string `yaml:"path"`
+	URL  string `yaml:"url"`
+	// How often the file is read again
+	Interval time.Duration `yaml:"interval"`
+	// How long FindProxyForURL can run for a destination
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// pacUtils are the standard PAC functions that don't need the network
+const pacUtils = `
+function isPlainHostName(host) { return host.indexOf(".") < 0; }
+function dnsDomainIs(host, domain) {
+    return host.length >= domain.length && host.substring(host.length - domain.length) == domain;
+}
+function localHostOrDomainIs(host, hostdom) {
+    return host == hostdom || hostdom.lastIndexOf(host + ".", 0) == 0;
+}
+function dnsDomainLevels(host) { return host.split(".").length - 1; }
+function isResolvable(host) { return !!dnsResolve(host); }
+function convert_addr(ipchars) {
+    var bytes = ipchars.split(".");
+    return ((bytes[0] & 0xff) << 24) | ((bytes[1] & 0xff) << 16) | ((bytes[2] & 0xff) << 8) | (bytes[3] & 0xff);
+}
+function isInNet(ipaddr, pattern, maskstr) {
+    if (!/^\d+\.\d+\.\d+\.\d+$/.test(ipaddr)) {
+        ipaddr = dnsResolve(ipaddr);
+        if (!ipaddr) return false;
+    }
+    var mask = convert_addr(maskstr);
+    return (convert_addr(ipaddr) & mask) == (convert_addr(pattern) & mask);
+}
+function shExpMatch(url, pattern) {
+    pattern = pattern.replace(/[.+^${}()|[\]\\]/g, "\\$&").replace(/\*/g, ".*").replace(/\?/g, ".");
+    return new RegExp("^" + pattern + "$").test(url);
+}
+var pacWeekdays = ["SUN", "MON", "TUE", "WED", "THU", "FRI", "SAT"];
+var pacMonths = ["JAN", "FEB", "MAR", "APR", "MAY", "JUN", "JUL", "AUG", "SEP", "OCT", "NOV", "DEC"];
+function pacNow(args) {
+    var gmt = args.length > 0 && args[args.length - 1] == "GMT";
+    return { gmt: gmt, date: new Date(), args: gmt ? Array.prototype.slice.call(args, 0, -1) : Array.prototype.slice.call(args) };
+}
+function pacInRange(value, from, to) {
+    return from <= to ? value >= from && value <= to : value >= from || value <= to;
+}
+function weekdayRange() {
+    var now = pacNow(arguments);
+    var day = now.gmt ? now.date.getUTCDay() : now.date.getDay();
+    var from = pacWeekdays.indexOf(now.args[0]);
+    var to = now.args.length > 1 ? pacWeekdays.indexOf(now.args[1]) : from;
+    return pacInRange(day, from, to);
+}
+function dateRange() {
+    var now = pacNow(arguments);
+    var d = now.date;
+    var values = { day: now.gmt ? d.getUTCDate() : d.getDate(), month: now.gmt ? d.getUTCMonth() : d.getMonth(), year: now.gmt ? d.getUTCFullYear() : d.getFullYear() };
+    var parse = function (arg) {
+        if (typeof arg == "string") return { month: pacMonths.indexOf(arg) };
+        return arg > 31 ? { year: arg } : { day: arg };
+    };
+    var args = now.args.map(parse);
+    var half = args.length > 1 ? args.length / 2 : 1;
+    var from = args.slice(0, half), to = args.length > 1 ? args.slice(half) : from;
+    var key = function (parts, fill) {
+        var p = {};
+        parts.forEach(function (part) { for (var k in part) p[k] = part[k]; });
+        return [p.year !== undefined ? p.year : fill.year, p.month !== undefined ? p.month : fill.month, p.day !== undefined ? p.day : fill.day];
+    };
+    var cmp = function (a, b) { for (var i = 0; i < 3; i++) if (a[i] != b[i]) return a[i] - b[i]; return 0; };
+    var cur = [values.year, values.month, values.day];
+    var lo = key(from, values), hi = key(to, values);
+    if (cmp(lo, hi) <= 0) return cmp(cur, lo) >= 0 && cmp(cur, hi) <= 0;
+    return cmp(cur, lo) >= 0 || cmp(cur, hi) <= 0;
+}
+function timeRange() {
+    var now = pacNow(arguments);
+    var d = now.date;
+    var cur = (now.gmt ? d.getUTCHours() : d.getHours()) * 3600 + (now.gmt ? d.getUTCMinutes() : d.getMinutes()) * 60 + (now.gmt ? d.getUTCSeconds() : d.getSeconds());
+    var a = now.args;
+    if (a.length == 1) return Math.floor(cur / 3600) == a[0];
+    if (a.length == 2) return pacInRange(Math.floor(cur / 3600), a[0], a[1] - 1);
+    if (a.length == 4) return pacInRange(cur, a[0] * 3600 + a[1] * 60, a[2] * 3600 + a[3] * 60 - 1);
+    if (a.length == 6) return pacInRange(cur, a[0] * 3600 + a[1] * 60 + a[2], a[3] * 3600 + a[4] * 60 + a[5]);
+    return false;
+}
+function alert(message) {}
+`
+
+// pacScript evaluates FindProxyForURL of a user supplied PAC file, the file is reloaded periodically
+type pacScript struct {
+	conf    PACConf
+	program atomic.Pointer[pacProgram]
+}
+
+// pacProgram is a compiled PAC file with a pool of runtimes running it, a goja runtime can't be used concurrently
+type pacProgram struct {
+	program  *goja.Program
+	runtimes sync.Pool
+}
+
+// pacRuntime is a runtime of a PAC file with its FindProxyForURL function
+type pacRuntime struct {
+	vm   *goja.Runtime
+	find goja.Callable
+}
+
+func newPACScript(conf PACConf) (*pacScript, error) {
+	if conf.Path == "" && conf.URL == "" {
+		return nil, nil
+	}
+	if conf.Path != "" && conf.URL != "" {
+		return nil, errors.New("pac: only one of path and url can be set")
+	}
+	if conf.Interval <= 0 {
+		conf.Interval = DEFAULT_PAC_INTERVAL
+	}
+	if conf.Timeout <= 0 {
+		conf.Timeout = DEFAULT_PAC_TIMEOUT
+	}
+	return &pacScript{conf: conf}, nil
+}
+
+// compilePAC compiles the PAC file, a first runtime checks that it runs and defines FindProxyForURL
+func compilePAC(source string) (*pacProgram, error) {
+	program, err := goja.Compile("pac", pacUtils+source, false)
+	if err != nil {
+		return nil, err
+	}
+	p := &pacProgram{program: program}
+	runtime, err := p.newRuntime()
+	if err != nil {
+		return nil, err
+	}
+	p.runtimes.Put(runtime)
+	return p, nil
+}
+
+// newRuntime creates a runtime running the PAC file
+func (p *pacProgram) newRuntime() (*pacRuntime, error) {
+	vm := goja.New()
+	vm.Set("dnsResolve", func(host string) any {
+		addrs, err := net.LookupIP(host)
+		if err != nil {
+			return nil
+		}
+		for _, addr := range addrs {
+			if ip4 := addr.To4(); ip4 != nil {
+				return ip4.String()
+			}
+		}
+		return nil
+	})
+	vm.Set("myIpAddress", func() string {
+		conn, err := net.Dial("udp", "8.8.8.8:53")
+		if err != nil {
+			return "127.0.0.1"
+		}
+		defer conn.Close()
+		return conn.LocalAddr().(*net.UDPAddr).IP.String()
+	})
+	if _, err := vm.RunProgram(p.program); err != nil {
+		return nil, err
+	}
+	find, ok := goja.AssertFunction(vm.Get("FindProxyForURL"))
+	if !ok {
+		return nil, errors.New("FindProxyForURL is not defined")
+	}
+	return &pacRuntime{vm: vm, find: find}, nil
+}
+
+// getRuntime returns an idle runtime of the PAC file, a new one when they are all busy
+func (p *pacProgram) getRuntime() (*pacRuntime, error) {
+	if runtime, ok := p.runtimes.Get().(*pacRuntime); ok {
+		return runtime, nil
+	}
+	return p.newRuntime()
+}
+
+// load reads and compiles the PAC file, the previous version is kept on error
+func (pac *pacScript) load() {
+	data, err := readFileOrURL(pac.conf.Path, pac.conf.URL, nil)
+	if err == nil {
+		var program *pacProgram
+		if program, err = compilePAC(string(data)); err == nil {
+			pac.program.Store(program)
+			slog.Info("PAC file loaded")
+			return
+		}
+	}
+	slog.Warn("Cannot load the PAC file", "err", err)
+}
+
+// run reloads the PAC file every interval until done is closed
+func (pac *pacScript) run(done chan struct{}) {
+	ticker := time.NewTicker(pac.conf.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			pac.load()
+		}
+	}
+}
+
+// getPACURL builds the URL FindProxyForURL is called with, only the scheme, host and port are known
+func getPACURL(host, port string) string {
+	switch port {
+	case "80":
+		return "http://" + host + "/"
+	case "443":
+		return "https://" + host + "/"
+	}
+	return "http://" + net.JoinHostPort(host, port) + "/"
+}
+
+// isDirect tells whether the PAC file sends the destination directly,
+// only the first entry of the result is used, any proxy means the upstream.
+// A script running longer than the timeout is interrupted and fails
+func (pac *pacScript) isDirect(host, port string) (bool, error) {
+	program := pac.program.Load()
+	if program == nil {
+		return false, errors.New("PAC file not loaded")
+	}
+	runtime, err := program.getRuntime()
+	if err != nil {
+		return false, err
+	}
+	timer := time.AfterFunc(pac.conf.Timeout, func() {
+		runtime.vm.Interrupt(errPACTimeout)
+	})
+	result, err := runtime.find(goja.Undefined(), runtime.vm.ToValue(getPACURL(host, port)), runtime.vm.ToValue(host))
+	// an interrupted runtime, or one that may still be, isn't reused
+	if timer.Stop() {
+		program.runtimes.Put(runtime)
+	}
+	if err != nil {
+		var interrupted *goja.InterruptedError
+		if errors.As(err, &interrupted) {
+			return false, fmt.Errorf("PAC file timed out after %s", pac.conf.Timeout)
+		}
+		return false, err
+	}
+	first, _, _ := strings.Cut(result.String(), ";")
+	fields := strings.Fields(first)
+	if len(fields) == 0 {
+		return false, fmt.Errorf("unexpected PAC result %q", result.String())
+	}
+	return strings.EqualFold(fields[0], "DIRECT"), nil
+}
@@ -0,0 +1,71 @@
+package proxydialer
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// probes answers the liveness and readiness probes of container orchestrators
+type probes struct {
+	proxies []ProxyConf
+	timeout time.Duration
+	// only the first hop of a chain can be reached directly
+	chain bool
+}
+
+func newProbes(config *Config) *probes {
+	p := &probes{
+		proxies: config.getUpstreamProxies(),
+		timeout: config.HealthCheck.Timeout,
+		chain:   len(config.Chain) > 0,
+	}
+	if p.timeout <= 0 {
+		p.timeout = DEFAULT_HEALTH_TIMEOUT
+	}
+	if p.chain && len(p.proxies) > 1 {
+		p.proxies = p.proxies[:1]
+	}
+	return p
+}
+
+// register adds the probes to a mux, they don't require the token of the admin API
+func (p *probes) register(mux *http.ServeMux) {
+	mux.HandleFunc("GET /healthz", p.handleHealthz)
+	mux.HandleFunc("GET /readyz", p.handleReadyz)
+}
+
+// handleHealthz answers as long as the server serves requests
+func (p *probes) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// handleReadyz checks the handshake of the proxies, the server is ready when one of them accepts it
+func (p *probes) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	errs := make([]error, len(p.proxies))
+	var wg sync.WaitGroup
+	for i, conf := range p.proxies {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = probeHandshake(conf, p.timeout)
+		}()
+	}
+	wg.Wait()
+
+	status := http.StatusServiceUnavailable
+	proxies := make(map[string]string)
+	for i, conf := range p.proxies {
+		if errs[i] != nil {
+			proxies[conf.getName()] = errs[i].Error()
+			continue
+		}
+		proxies[conf.getName()] = "ok"
+		status = http.StatusOK
+	}
+	result := "ready"
+	if status != http.StatusOK {
+		result = "not ready"
+	}
+	writeJSON(w, status, map[string]any{"status": result, "proxies": proxies})
+}
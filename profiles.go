@@ -0,0 +1,38 @@
+package proxydialer
+
+import (
+	"fmt"
+
+	"gopkg.in/yaml.v3"
+)
+
+// selectProfile applies the settings of a profile, data converted to YAML, over the ones of the configuration
+// and returns it as YAML without the profiles
+func selectProfile(data []byte, name string) ([]byte, error) {
+	values := make(map[string]any)
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		return nil, err
+	}
+	profiles, _ := values["profiles"].(map[string]any)
+	profile, ok := profiles[name].(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("unknown profile %s", name)
+	}
+	delete(values, "profiles")
+	overrideValues(values, profile)
+	return yaml.Marshal(values)
+}
+
+// overrideValues sets the values of src in dst, maps are merged and lists replaced, so that a profile
+// has its own listeners, proxies and rules
+func overrideValues(dst, src map[string]any) {
+	for key, value := range src {
+		if value, ok := value.(map[string]any); ok {
+			if current, ok := dst[key].(map[string]any); ok {
+				overrideValues(current, value)
+				continue
+			}
+		}
+		dst[key] = value
+	}
+}
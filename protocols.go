@@ -0,0 +1,48 @@
+package proxydialer
+
+import (
+	"sync"
+
+	"golang.org/x/net/proxy"
+)
+
+// DialerFactory creates the dialer of a proxy of a registered protocol, the connections to the proxy server
+// are made through forward, the previous hop of a chain or a direct dialer
+type DialerFactory func(conf ProxyConf, forward proxy.Dialer) (proxy.Dialer, error)
+
+var (
+	protocolsMu         sync.RWMutex
+	registeredProtocols = make(map[Protocol]DialerFactory)
+)
+
+// RegisterProtocol adds a protocol the proxies of the configuration can use, their settings are passed
+// to the factory, the ones specific to the protocol in options. It panics when the protocol is built in
+// or already registered, protocols are meant to be registered before the configuration is loaded
+func RegisterProtocol(name string, factory DialerFactory) {
+	protocolsMu.Lock()
+	defer protocolsMu.Unlock()
+	protocol := Protocol(name)
+	if factory == nil {
+		panic("proxydialer: RegisterProtocol factory is nil")
+	}
+	if _, ok := registeredProtocols[protocol]; ok || supportedProtocols[protocol] {
+		panic("proxydialer: RegisterProtocol called twice for protocol " + name)
+	}
+	registeredProtocols[protocol] = factory
+}
+
+// isSupportedProtocol tells whether the protocol is built in or registered
+func isSupportedProtocol(protocol Protocol) bool {
+	if supportedProtocols[protocol] {
+		return true
+	}
+	_, ok := getDialerFactory(protocol)
+	return ok
+}
+
+func getDialerFactory(protocol Protocol) (DialerFactory, bool) {
+	protocolsMu.RLock()
+	defer protocolsMu.RUnlock()
+	factory, ok := registeredProtocols[protocol]
+	return factory, ok
+}
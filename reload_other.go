@@ -0,0 +1,21 @@
+//go:build !windows
+
+package proxydialer
+
+import (
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// reloadOnSignal reads the configuration again every time SIGHUP is received, e.g. kill -HUP <pid>,
+// for process managers and the file systems that don't notify the modifications
+func reloadOnSignal(notify chan int) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	for range sigs {
+		slog.Info("Reload requested by SIGHUP")
+		notify <- 1
+	}
+}
@@ -0,0 +1,4 @@
+package proxydialer
+
+// reloadOnSignal does nothing, Windows has no SIGHUP
+func reloadOnSignal(notify chan int) {}
@@ -0,0 +1,124 @@
+package proxydialer
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const DEFAULT_CONFIG_POLL_INTERVAL = time.Minute
+
+// configPollInterval is how often a configuration given by a URL is checked for changes, the default when 0
+var configPollInterval atomic.Int64
+
+// isConfigURL tells whether the configuration is downloaded rather than read from a file
+func isConfigURL(configFile string) bool {
+	return strings.HasPrefix(configFile, "https://") || strings.HasPrefix(configFile, "http://")
+}
+
+// getConfigName returns the name the format of the configuration is told by, the path of a URL
+func getConfigName(configFile string) string {
+	if !isConfigURL(configFile) {
+		return configFile
+	}
+	u, err := url.Parse(configFile)
+	if err != nil {
+		return configFile
+	}
+	return u.Path
+}
+
+// remoteConfig is the last version of a configuration downloaded, it is only downloaded again when modified
+type remoteConfig struct {
+	mu           sync.Mutex
+	url          string
+	etag         string
+	lastModified string
+	data         []byte
+}
+
+var remoteConfigs = &remoteConfig{}
+
+// fetch downloads the configuration when it was modified since the previous download, changed is false
+// when the server answered that it wasn't or the content is the same
+func (c *remoteConfig) fetch(rawURL string) (data []byte, changed bool, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.url != rawURL {
+		c.url, c.etag, c.lastModified, c.data = rawURL, "", "", nil
+	}
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	if c.etag != "" {
+		req.Header.Set("If-None-Match", c.etag)
+	}
+	if c.lastModified != "" {
+		req.Header.Set("If-Modified-Since", c.lastModified)
+	}
+	client := &http.Client{Timeout: DEFAULT_DOWNLOAD_TIMEOUT}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		if c.data != nil {
+			return c.data, false, nil
+		}
+	case http.StatusOK:
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, false, err
+		}
+		c.etag = resp.Header.Get("ETag")
+		c.lastModified = resp.Header.Get("Last-Modified")
+		changed := c.data == nil || !bytes.Equal(data, c.data)
+		c.data = data
+		return data, changed, nil
+	}
+	return nil, false, fmt.Errorf("unexpected status %s", resp.Status)
+}
+
+// readConfigData reads the configuration file, or downloads it when it is a URL
+func readConfigData(configFile string) ([]byte, error) {
+	if !isConfigURL(configFile) {
+		return os.ReadFile(configFile)
+	}
+	data, _, err := remoteConfigs.fetch(configFile)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", configFile, err)
+	}
+	return data, nil
+}
+
+// pollConfigURL checks the configuration for changes every poll interval, notify is signaled when it was modified,
+// the configuration running is kept while the server can't be reached
+func pollConfigURL(configURL string, notify chan int) {
+	for {
+		interval := time.Duration(configPollInterval.Load())
+		if interval <= 0 {
+			interval = DEFAULT_CONFIG_POLL_INTERVAL
+		}
+		time.Sleep(interval)
+		_, changed, err := remoteConfigs.fetch(configURL)
+		if err != nil {
+			slog.Warn("Cannot download the configuration", "url", configURL, "err", err)
+			continue
+		}
+		if changed {
+			slog.Info("Modified configuration", "url", configURL)
+			notify <- 1
+		}
+	}
+}
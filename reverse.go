@@ -0,0 +1,132 @@
+package proxydialer
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// How long to wait before connecting again when a reverse tunnel is lost
+const DEFAULT_REVERSE_RETRY = 10 * time.Second
+
+// ReverseConf exposes a local service on an SSH server, like ssh -R
+type ReverseConf struct {
+	// Name of the "ssh" proxy the port is opened on
+	Proxy string `yaml:"proxy"`
+	// Address listened on by the SSH server, e.g. "127.0.0.1:8080"
+	Remote string `yaml:"remote"`
+	// Local service the connections are forwarded to
+	Local string `yaml:"local"`
+	// Names of the proxies the SSH server is reached through instead of the ones marked with use
+	Proxies []string `yaml:"proxies"`
+}
+
+// reverseTunnel keeps a remote port open on an SSH server, reconnecting when the connection is lost
+type reverseTunnel struct {
+	conf   ReverseConf
+	dialer *sshDialer
+	done   chan struct{}
+
+	mu       sync.Mutex
+	listener net.Listener
+}
+
+// startReverseTunnel connects to the SSH server of conf through forward in the background, only the
+// settings of the SSH proxy fail it, an unreachable server is retried until the tunnel is closed
+func startReverseTunnel(config *Config, conf ReverseConf, forward proxy.Dialer) (*reverseTunnel, error) {
+	proxyConf := config.getProxy(conf.Proxy)
+	dialer, err := establishSSHProxy(*proxyConf, forward)
+	if err != nil {
+		return nil, err
+	}
+	t := &reverseTunnel{
+		conf:   conf,
+		dialer: dialer.(*sshDialer),
+		done:   make(chan struct{}),
+	}
+	go t.run()
+	return t, nil
+}
+
+// run listens on the SSH server until the tunnel is closed
+func (t *reverseTunnel) run() {
+	for {
+		opened, err := t.serve()
+		select {
+		case <-t.done:
+			return
+		default:
+		}
+		if opened {
+			slog.Warn("Reverse tunnel lost, retrying", "remote", t.conf.Remote, "proxy", t.conf.Proxy, "retry", DEFAULT_REVERSE_RETRY, "err", err)
+		} else {
+			slog.Warn("Reverse tunnel cannot be opened, retrying", "remote", t.conf.Remote, "proxy", t.conf.Proxy, "retry", DEFAULT_REVERSE_RETRY, "err", err)
+		}
+		select {
+		case <-t.done:
+			return
+		case <-time.After(DEFAULT_REVERSE_RETRY):
+		}
+	}
+}
+
+// serve accepts the connections of the remote port until the SSH connection is lost, and tells whether
+// the port was opened
+func (t *reverseTunnel) serve() (bool, error) {
+	ctx, cancel := withDialTimeout(context.Background())
+	client, err := t.dialer.getClient(ctx)
+	cancel()
+	if err != nil {
+		return false, err
+	}
+	listener, err := client.Listen("tcp", t.conf.Remote)
+	if err != nil {
+		return false, err
+	}
+	t.mu.Lock()
+	select {
+	case <-t.done:
+		t.mu.Unlock()
+		listener.Close()
+		return false, nil
+	default:
+	}
+	t.listener = listener
+	t.mu.Unlock()
+
+	slog.Info("Reverse tunnel is open", "remote", listener.Addr().String(), "proxy", t.conf.Proxy, "local", t.conf.Local)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			t.dialer.resetClient(client)
+			return true, err
+		}
+		go t.handleConn(conn)
+	}
+}
+
+// handleConn connects a client of the remote port to the local service
+func (t *reverseTunnel) handleConn(client_conn net.Conn) {
+	slog.Info("REVERSE", "client", client_conn.RemoteAddr().String(), "local", t.conf.Local)
+	dest_conn, err := net.Dial("tcp", t.conf.Local)
+	if err != nil {
+		slog.Warn("REVERSE failed", "client", client_conn.RemoteAddr().String(), "local", t.conf.Local, "err", err)
+		client_conn.Close()
+		return
+	}
+	relay(client_conn, dest_conn, nil)
+}
+
+func (t *reverseTunnel) Close() error {
+	t.mu.Lock()
+	close(t.done)
+	if t.listener != nil {
+		t.listener.Close()
+	}
+	t.mu.Unlock()
+	return t.dialer.Close()
+}
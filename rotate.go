@@ -0,0 +1,154 @@
+package proxydialer
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Suffix of the rotated files, after the name of the file
+const rotatedTimeFormat = "2006-01-02T15-04-05.000"
+
+// RotateConf rotates a file once it is too big or at the end of an interval,
+// the rotated files are renamed with the time of the rotation appended
+type RotateConf struct {
+	// Size in megabytes the file is rotated at, no limit when 0
+	MaxSize int `yaml:"max_size"`
+	// Interval the file is rotated every, e.g. "24h" at midnight UTC, none when 0
+	Interval time.Duration `yaml:"interval"`
+	// Rotated files kept, all when 0
+	MaxBackups int `yaml:"max_backups"`
+	// Age after which the rotated files are removed, e.g. "720h", never when 0
+	MaxAge time.Duration `yaml:"max_age"`
+}
+
+func (conf RotateConf) validate() error {
+	if conf.MaxSize < 0 || conf.Interval < 0 || conf.MaxBackups < 0 || conf.MaxAge < 0 {
+		return fmt.Errorf("negative rotation setting")
+	}
+	return nil
+}
+
+// rotatingFile appends to a file and rotates it
+type rotatingFile struct {
+	conf RotateConf
+	path string
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+	// time the current file was last written to when it was opened, then of its creation
+	opened time.Time
+}
+
+// openAppendFile opens a file to append to, rotated when conf sets a size or an interval
+func openAppendFile(path string, conf RotateConf) (io.WriteCloser, error) {
+	if conf.MaxSize == 0 && conf.Interval == 0 {
+		return os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	}
+	f := &rotatingFile{conf: conf, path: path}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	f.opened = time.Now()
+	if f.size > 0 {
+		// a file left by the previous run is rotated at the end of the interval it was written in
+		f.opened = info.ModTime()
+	}
+	return nil
+}
+
+func (f *rotatingFile) shouldRotate(n int) bool {
+	if f.conf.MaxSize > 0 && f.size > 0 && f.size+int64(n) > int64(f.conf.MaxSize)<<20 {
+		return true
+	}
+	return f.conf.Interval > 0 && !time.Now().Truncate(f.conf.Interval).Equal(f.opened.Truncate(f.conf.Interval))
+}
+
+func (f *rotatingFile) Write(b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.shouldRotate(len(b)) {
+		if err := f.rotate(); err != nil {
+			// the log can't be logged to
+			fmt.Fprintf(os.Stderr, "Cannot rotate %s: %v\n", f.path, err)
+		}
+	}
+	n, err := f.file.Write(b)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate renames the file and opens a new one, the current file is kept when it can't be renamed
+func (f *rotatingFile) rotate() error {
+	f.file.Close()
+	renameErr := os.Rename(f.path, f.path+"."+time.Now().UTC().Format(rotatedTimeFormat))
+	if err := f.open(); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		// tried again at the next interval or write over the size
+		f.size = 0
+		f.opened = time.Now()
+		return renameErr
+	}
+	go f.removeOld()
+	return nil
+}
+
+// removeOld removes the rotated files over the count or the age kept
+func (f *rotatingFile) removeOld() {
+	if f.conf.MaxBackups == 0 && f.conf.MaxAge == 0 {
+		return
+	}
+	matches, err := filepath.Glob(f.path + ".*")
+	if err != nil {
+		return
+	}
+	type rotated struct {
+		path string
+		time time.Time
+	}
+	var files []rotated
+	for _, path := range matches {
+		t, err := time.Parse(rotatedTimeFormat, strings.TrimPrefix(path, f.path+"."))
+		if err == nil {
+			files = append(files, rotated{path, t})
+		}
+	}
+	// newest first
+	slices.SortFunc(files, func(a, b rotated) int {
+		return b.time.Compare(a.time)
+	})
+	for i, file := range files {
+		if (f.conf.MaxBackups > 0 && i >= f.conf.MaxBackups) || (f.conf.MaxAge > 0 && time.Since(file.time) > f.conf.MaxAge) {
+			os.Remove(file.path)
+		}
+	}
+}
+
+func (f *rotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Close()
+}
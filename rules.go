@@ -0,0 +1,514 @@
+package proxydialer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+const (
+	ACTION_PROXY  = "proxy"
+	ACTION_DIRECT = "direct"
+	ACTION_REJECT = "reject"
+)
+
+var errRejected = errors.New("destination rejected by rules")
+
+// RuleConf matches destinations and tells what to do with them
+type RuleConf struct {
+	// Domain suffixes, "example.com" matches example.com and all its subdomains,
+	// "*.example.com" only the subdomains, "full:example.com" only example.com,
+	// "regexp:" prefixes a regular expression
+	Domain []string `yaml:"domain"`
+	// IP ranges, the host is resolved when it is not an IP
+	CIDR []string `yaml:"cidr"`
+	// ISO country codes of the destination IP, looked up in the GeoIP database
+	GeoIP []string `yaml:"geoip"`
+	// Names of rule sets, the destination matches when it is in one of them
+	RuleSet []string `yaml:"rule_set"`
+	// Destination ports or port ranges like "8000-9000", all ports when empty
+	Ports []string `yaml:"ports"`
+	// Local time windows like "18:00-23:00" the rule applies in, always when empty
+	Time []string `yaml:"time"`
+	// Client IPs or ranges the rule applies to, all clients when empty
+	Clients []string `yaml:"clients"`
+	Action  string   `yaml:"action"`
+	// Name of the proxy used by the "proxy" action instead of the upstream proxies
+	Proxy string `yaml:"proxy"`
+}
+
+// destination is the target of a dial as seen by the rules
+type destination struct {
+	// host the tunnel is dialed to, checked by the IP, CIDR and GeoIP conditions
+	host string
+	// name checked by the domain conditions, the server name sniffed from a tunnel rather than its host
+	name     string
+	port     string
+	clientIP net.IP
+
+	resolved bool
+	ips      []net.IP
+}
+
+type portRange struct {
+	from, to int
+}
+
+// timeWindow is a range of minutes of the day, it crosses midnight when from is after to
+type timeWindow struct {
+	from, to int
+}
+
+type rule struct {
+	domains   *domainMatcher
+	nets      []*net.IPNet
+	countries map[string]bool
+	geoip     *geoIPDB
+	ruleSets  []*ruleSet
+	ports     []portRange
+	times     []timeWindow
+	clients   []*net.IPNet
+	action    string
+	// dialer of the named proxy of the rule, nil for the upstream
+	dialer proxy.Dialer
+	// cidr ranges are only checked against destinations given as IPs
+	literalOnly bool
+}
+
+// router sends every dial through the upstream, directly or nowhere depending on the first matching rule
+type router struct {
+	rules    []*rule
+	upstream proxy.Dialer
+	direct   proxy.Dialer
+	geoip    *geoIPDB
+	// dialers of the proxies named by rules
+	proxies  map[string]proxy.Dialer
+	ruleSets map[string]*ruleSet
+	// PAC file deciding about the destinations no rule matches
+	pac  *pacScript
+	done chan struct{}
+}
+
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// parseNets parses CIDR ranges, a single IP is a range of its own
+func parseNets(entries []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range entries {
+		if ip := net.ParseIP(entry); ip != nil {
+			bits := 8 * len(ip)
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// parsePorts parses ports and "from-to" port ranges
+func parsePorts(entries []string) ([]portRange, error) {
+	var ports []portRange
+	for _, entry := range entries {
+		from, to, isRange := strings.Cut(entry, "-")
+		if !isRange {
+			to = from
+		}
+		var r portRange
+		var err1, err2 error
+		r.from, err1 = strconv.Atoi(strings.TrimSpace(from))
+		r.to, err2 = strconv.Atoi(strings.TrimSpace(to))
+		if err1 != nil || err2 != nil || r.from < 0 || r.to > 65535 || r.from > r.to {
+			return nil, fmt.Errorf("invalid port: %s", entry)
+		}
+		ports = append(ports, r)
+	}
+	return ports, nil
+}
+
+func (r *rule) matchPort(port string) bool {
+	if len(r.ports) == 0 {
+		return true
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return false
+	}
+	for _, pr := range r.ports {
+		if p >= pr.from && p <= pr.to {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTimeWindows parses "HH:MM-HH:MM" time windows
+func parseTimeWindows(entries []string) ([]timeWindow, error) {
+	var windows []timeWindow
+	for _, entry := range entries {
+		from, to, ok := strings.Cut(entry, "-")
+		if !ok {
+			return nil, fmt.Errorf("invalid time window: %s", entry)
+		}
+		start, err1 := time.Parse("15:04", strings.TrimSpace(from))
+		end, err2 := time.Parse("15:04", strings.TrimSpace(to))
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("invalid time window: %s", entry)
+		}
+		windows = append(windows, timeWindow{
+			from: start.Hour()*60 + start.Minute(),
+			to:   end.Hour()*60 + end.Minute(),
+		})
+	}
+	return windows, nil
+}
+
+func (r *rule) matchTime(now time.Time) bool {
+	if len(r.times) == 0 {
+		return true
+	}
+	minute := now.Hour()*60 + now.Minute()
+	for _, w := range r.times {
+		if w.from <= w.to && minute >= w.from && minute < w.to {
+			return true
+		}
+		if w.from > w.to && (minute >= w.from || minute < w.to) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func newRule(conf RuleConf, geoip *geoIPDB, ruleSets map[string]*ruleSet) (*rule, error) {
+	r := &rule{
+		countries: make(map[string]bool),
+		geoip:     geoip,
+		action:    conf.Action,
+	}
+	switch r.action {
+	case "":
+		r.action = ACTION_PROXY
+	case ACTION_PROXY, ACTION_DIRECT, ACTION_REJECT:
+	default:
+		return nil, fmt.Errorf("unsupported rule action: %s", conf.Action)
+	}
+	domains, err := newDomainMatcher(conf.Domain)
+	if err != nil {
+		return nil, err
+	}
+	r.domains = domains
+	if r.nets, err = parseNets(conf.CIDR); err != nil {
+		return nil, err
+	}
+	if r.clients, err = parseNets(conf.Clients); err != nil {
+		return nil, err
+	}
+	if r.ports, err = parsePorts(conf.Ports); err != nil {
+		return nil, err
+	}
+	if r.times, err = parseTimeWindows(conf.Time); err != nil {
+		return nil, err
+	}
+	if len(conf.GeoIP) > 0 && geoip == nil {
+		return nil, errors.New("geoip rules require a geoip database")
+	}
+	for _, country := range conf.GeoIP {
+		r.countries[strings.ToUpper(country)] = true
+	}
+	for _, name := range conf.RuleSet {
+		set, ok := ruleSets[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown rule set: %s", name)
+		}
+		r.ruleSets = append(r.ruleSets, set)
+	}
+	return r, nil
+}
+
+// getIPs returns the IPs of the destination, the host is resolved once when it is a name
+func (dest *destination) getIPs(ctx context.Context) []net.IP {
+	if dest.resolved {
+		return dest.ips
+	}
+	dest.resolved = true
+	if ip := net.ParseIP(dest.host); ip != nil {
+		dest.ips = []net.IP{ip}
+		return dest.ips
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, dest.host)
+	if err != nil {
+		slog.Warn("Routing: cannot resolve", "host", dest.host, "err", err)
+		return nil
+	}
+	for _, addr := range addrs {
+		dest.ips = append(dest.ips, addr.IP)
+	}
+	return dest.ips
+}
+
+// matchCIDR tells whether one of the destination IPs is in the ranges of the rule
+func (r *rule) matchCIDR(ctx context.Context, dest *destination) bool {
+	if len(r.nets) == 0 {
+		return false
+	}
+	var ips []net.IP
+	if r.literalOnly {
+		// a host name isn't resolved, which would send its query outside of the proxies
+		ip := net.ParseIP(dest.host)
+		if ip == nil {
+			return false
+		}
+		ips = []net.IP{ip}
+	} else {
+		ips = dest.getIPs(ctx)
+	}
+	for _, ip := range ips {
+		if containsIP(r.nets, ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchGeoIP tells whether one of the destination IPs is located in the countries of the rule
+func (r *rule) matchGeoIP(ctx context.Context, dest *destination) bool {
+	if len(r.countries) == 0 {
+		return false
+	}
+	for _, ip := range dest.getIPs(ctx) {
+		if r.countries[r.geoip.getCountry(ip)] {
+			return true
+		}
+	}
+	return false
+}
+
+// matchRuleSet tells whether the destination is in one of the rule sets of the rule
+func (r *rule) matchRuleSet(ctx context.Context, dest *destination) bool {
+	for _, set := range r.ruleSets {
+		if set.match(ctx, dest) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *rule) hasHostConditions() bool {
+	return !r.domains.empty || len(r.nets) > 0 || len(r.countries) > 0 || len(r.ruleSets) > 0
+}
+
+// match tells whether the destination matches the rule: the client must be one of the clients of the rule,
+// the port one of its ports, the time in one of its windows and the host must match one of its host conditions,
+// a missing condition matches everything
+func (r *rule) match(ctx context.Context, dest *destination) bool {
+	if len(r.clients) > 0 && !containsIP(r.clients, dest.clientIP) {
+		return false
+	}
+	if !r.matchPort(dest.port) || !r.matchTime(time.Now()) {
+		return false
+	}
+	if !r.hasHostConditions() {
+		return true
+	}
+	return r.domains.match(dest.name) || r.matchCIDR(ctx, dest) || r.matchGeoIP(ctx, dest) ||
+		r.matchRuleSet(ctx, dest)
+}
+
+// newRouter wraps upstream with the bypass list, the rules and the PAC file,
+// upstream is returned as is when there are none
+func newRouter(config *Config, upstream proxy.Dialer) (proxy.Dialer, error) {
+	pac, err := newPACScript(config.PAC)
+	if err != nil {
+		return nil, err
+	}
+	if len(config.Rules) == 0 && len(config.Bypass) == 0 && pac == nil {
+		return upstream, nil
+	}
+	rt := &router{
+		upstream: upstream,
+		direct:   newMeteredDialer("direct", directDialer),
+		geoip:    newGeoIPDB(config.GeoIP),
+		proxies:  make(map[string]proxy.Dialer),
+		ruleSets: make(map[string]*ruleSet),
+		pac:      pac,
+		done:     make(chan struct{}),
+	}
+	for _, conf := range config.RuleSets {
+		set, err := newRuleSet(conf, upstream)
+		if err != nil {
+			rt.stop()
+			return nil, err
+		}
+		rt.ruleSets[conf.Name] = set
+	}
+	if len(config.Bypass) > 0 {
+		r, err := newBypassRule(config.Bypass)
+		if err != nil {
+			rt.stop()
+			return nil, fmt.Errorf("bypass: %w", err)
+		}
+		if r != nil {
+			rt.rules = append(rt.rules, r)
+		}
+	}
+	for i, conf := range config.Rules {
+		r, err := newRule(conf, rt.geoip, rt.ruleSets)
+		if err == nil && conf.Proxy != "" {
+			r.dialer, err = rt.getProxyDialer(config, conf.Proxy)
+		}
+		if err != nil {
+			rt.stop()
+			return nil, fmt.Errorf("rule %d: %w", i+1, err)
+		}
+		rt.rules = append(rt.rules, r)
+	}
+	for _, set := range rt.ruleSets {
+		// a file is read at once, a download doesn't delay the start and goes through the proxies
+		if set.conf.Path != "" {
+			set.load()
+		}
+		go set.run(rt.done)
+	}
+	if rt.pac != nil {
+		rt.pac.load()
+		go rt.pac.run(rt.done)
+	}
+	return rt, nil
+}
+
+// getProxyDialer returns the dialer of a proxy named by a rule, proxies used by several rules share it
+func (rt *router) getProxyDialer(config *Config, name string) (proxy.Dialer, error) {
+	if dialer, ok := rt.proxies[name]; ok {
+		return dialer, nil
+	}
+	conf := config.getProxy(name)
+	if conf == nil {
+		return nil, fmt.Errorf("unknown proxy: %s", name)
+	}
+	if !isSupportedProtocol(conf.Protocol) {
+		return nil, fmt.Errorf("unsupported protocol: %s", conf.Protocol)
+	}
+	dialer, err := getProxyDialer(*conf, directDialer)
+	if err != nil {
+		return nil, err
+	}
+	rt.proxies[name] = dialer
+	return dialer, nil
+}
+
+// getRule returns the first rule matching the destination, nil when none matches
+func (rt *router) getRule(ctx context.Context, dest *destination) *rule {
+	for _, r := range rt.rules {
+		if r.match(ctx, dest) {
+			return r
+		}
+	}
+	return nil
+}
+
+func (rt *router) Dial(network, address string) (net.Conn, error) {
+	return rt.DialContext(context.Background(), network, address)
+}
+
+func (rt *router) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	dest := &destination{
+		host:     normalizeHost(host),
+		port:     port,
+		clientIP: net.ParseIP(getClientIP(ctx)),
+	}
+	dest.name = dest.host
+	// the server name sniffed from a tunnel is more reliable than the IP it was opened to for the domains,
+	// the IPs are still the ones of the address dialed
+	if sni := getSNI(ctx); sni != "" {
+		dest.name = normalizeHost(sni)
+	}
+	_, span := startSpan(ctx, "route", SPAN_KIND_INTERNAL)
+	dialer, action := rt.route(ctx, dest)
+	span.setAttribute("proxydialer.action", action)
+	span.finish()
+	if dialer == nil {
+		return nil, fmt.Errorf("%s: %w", address, errRejected)
+	}
+	return dialContext(ctx, dialer, network, address)
+}
+
+// route returns the dialer of a destination and the action deciding it, the dialer is nil when it is rejected
+func (rt *router) route(ctx context.Context, dest *destination) (proxy.Dialer, string) {
+	r := rt.getRule(ctx, dest)
+	if r == nil {
+		if rt.pac != nil {
+			direct, err := rt.pac.isDirect(dest.name, dest.port)
+			if err != nil {
+				slog.Warn("PAC file failed", "address", net.JoinHostPort(dest.name, dest.port), "err", err)
+			} else if direct {
+				return rt.direct, ACTION_DIRECT
+			}
+		}
+		return rt.upstream, ACTION_PROXY
+	}
+	switch r.action {
+	case ACTION_DIRECT:
+		return rt.direct, ACTION_DIRECT
+	case ACTION_REJECT:
+		return nil, ACTION_REJECT
+	}
+	if r.dialer != nil {
+		return r.dialer, ACTION_PROXY
+	}
+	return rt.upstream, ACTION_PROXY
+}
+
+func (rt *router) closeProxies() {
+	for _, dialer := range rt.proxies {
+		if closer, ok := dialer.(io.Closer); ok {
+			closer.Close()
+		}
+	}
+}
+
+// stop ends the refresh of the rule sets and the PAC file and closes the dialers of the router,
+// the upstream excepted
+func (rt *router) stop() {
+	close(rt.done)
+	if rt.geoip != nil {
+		rt.geoip.Close()
+	}
+	rt.closeProxies()
+}
+
+func (rt *router) Close() error {
+	rt.stop()
+	if closer, ok := rt.upstream.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
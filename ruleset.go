@@ -0,0 +1,254 @@
+package proxydialer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+const (
+	RULE_SET_FORMAT_LIST    = "list"
+	RULE_SET_FORMAT_GFWLIST = "gfwlist"
+)
+
+const (
+	DEFAULT_RULE_SET_INTERVAL = time.Hour
+	DEFAULT_DOWNLOAD_TIMEOUT  = 30 * time.Second
+)
+
+// RuleSetConf is a list of domains and IP ranges kept in a file or downloaded, referenced by rules
+type RuleSetConf struct {
+	Name string `yaml:"name"`
+	Path string `yaml:"path"`
+	URL  string `yaml:"url"`
+	// "list" (default): one domain, IP or CIDR range per line, "gfwlist": base64 encoded AutoProxy list
+	Format string `yaml:"format"`
+	// How often the list is read again
+	Interval time.Duration `yaml:"interval"`
+}
+
+// ruleSetEntries is the parsed content of a rule set
+type ruleSetEntries struct {
+	domains *domainMatcher
+	nets    []*net.IPNet
+}
+
+// ruleSet is refreshed in the background, rules always see a complete version of it
+type ruleSet struct {
+	conf RuleSetConf
+	// dialer the list is downloaded through
+	dialer  proxy.Dialer
+	entries atomic.Pointer[ruleSetEntries]
+}
+
+// ruleSetCache keeps the last entries of the rule sets by source, a reloaded configuration routes with them
+// until its own download completes
+var ruleSetCache sync.Map
+
+// newRuleSet creates a rule set downloaded through dialer, it starts with the entries cached from a previous
+// configuration, or empty, until it is loaded
+func newRuleSet(conf RuleSetConf, dialer proxy.Dialer) (*ruleSet, error) {
+	if conf.Name == "" {
+		return nil, errors.New("rule set without a name")
+	}
+	if (conf.Path == "") == (conf.URL == "") {
+		return nil, fmt.Errorf("rule set %s: exactly one of path and url is required", conf.Name)
+	}
+	switch conf.Format {
+	case "":
+		conf.Format = RULE_SET_FORMAT_LIST
+	case RULE_SET_FORMAT_LIST, RULE_SET_FORMAT_GFWLIST:
+	default:
+		return nil, fmt.Errorf("rule set %s: unsupported format: %s", conf.Name, conf.Format)
+	}
+	if conf.Interval <= 0 {
+		conf.Interval = DEFAULT_RULE_SET_INTERVAL
+	}
+	set := &ruleSet{conf: conf, dialer: dialer}
+	if entries, ok := ruleSetCache.Load(set.getSource()); ok {
+		set.entries.Store(entries.(*ruleSetEntries))
+	} else {
+		set.entries.Store(&ruleSetEntries{domains: &domainMatcher{empty: true}})
+	}
+	return set, nil
+}
+
+// getSource identifies the content of the rule set in the cache
+func (set *ruleSet) getSource() string {
+	return set.conf.Format + " " + set.conf.Path + set.conf.URL
+}
+
+// read returns the raw content of the rule set
+func (set *ruleSet) read() ([]byte, error) {
+	return readFileOrURL(set.conf.Path, set.conf.URL, set.dialer)
+}
+
+// readFileOrURL reads the file at path, or downloads rawURL when path is empty,
+// through dialer when it isn't nil
+func readFileOrURL(path, rawURL string, dialer proxy.Dialer) ([]byte, error) {
+	if path != "" {
+		return os.ReadFile(path)
+	}
+	client := &http.Client{Timeout: DEFAULT_DOWNLOAD_TIMEOUT}
+	if dialer != nil {
+		client.Transport = &http.Transport{
+			DialContext:       getDialContext(dialer),
+			DisableKeepAlives: true,
+		}
+	}
+	resp, err := client.Get(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// parseListLine converts a line of a plain list into a domain pattern or a CIDR range
+func parseListLine(line string) (domain, cidr string) {
+	if i := strings.IndexByte(line, '#'); i >= 0 {
+		line = line[:i]
+	}
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return "", ""
+	}
+	if strings.Contains(line, "/") || net.ParseIP(line) != nil {
+		return "", line
+	}
+	return line, ""
+}
+
+// parseGFWListLine converts the domain rules of an AutoProxy list, exceptions, URL patterns
+// and regular expressions are skipped
+func parseGFWListLine(line string) string {
+	line = strings.TrimSpace(line)
+	switch {
+	case line == "", strings.HasPrefix(line, "!"), strings.HasPrefix(line, "["),
+		strings.HasPrefix(line, "@@"), strings.HasPrefix(line, "/"):
+		return ""
+	case strings.HasPrefix(line, "||"):
+		line = strings.TrimPrefix(line, "||")
+	case strings.HasPrefix(line, "|"):
+		u, err := url.Parse(strings.TrimPrefix(line, "|"))
+		if err != nil {
+			return ""
+		}
+		return "full:" + u.Hostname()
+	case strings.HasPrefix(line, "."):
+		line = strings.TrimPrefix(line, ".")
+	}
+	if i := strings.IndexAny(line, "/*:^"); i >= 0 {
+		// only the host part of a keyword is usable
+		if line[i] != '/' && line[i] != '^' {
+			return ""
+		}
+		line = line[:i]
+	}
+	return line
+}
+
+func (set *ruleSet) parse(data []byte) (*ruleSetEntries, error) {
+	if set.conf.Format == RULE_SET_FORMAT_GFWLIST {
+		decoded, err := base64.StdEncoding.DecodeString(string(bytes.Join(bytes.Fields(data), nil)))
+		if err != nil {
+			return nil, err
+		}
+		data = decoded
+	}
+	var domains, cidrs []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		if set.conf.Format == RULE_SET_FORMAT_GFWLIST {
+			if domain := parseGFWListLine(scanner.Text()); domain != "" {
+				domains = append(domains, domain)
+			}
+			continue
+		}
+		domain, cidr := parseListLine(scanner.Text())
+		if domain != "" {
+			domains = append(domains, domain)
+		}
+		if cidr != "" {
+			cidrs = append(cidrs, cidr)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	matcher, err := newDomainMatcher(domains)
+	if err != nil {
+		return nil, err
+	}
+	nets, err := parseNets(cidrs)
+	if err != nil {
+		return nil, err
+	}
+	return &ruleSetEntries{domains: matcher, nets: nets}, nil
+}
+
+// load reads the rule set and replaces its entries, the previous entries are kept on error
+func (set *ruleSet) load() {
+	data, err := set.read()
+	if err == nil {
+		var entries *ruleSetEntries
+		if entries, err = set.parse(data); err == nil {
+			set.entries.Store(entries)
+			ruleSetCache.Store(set.getSource(), entries)
+			slog.Info("Rule set loaded", "rule_set", set.conf.Name, "domains", entries.domains.len(), "ranges", len(entries.nets))
+			return
+		}
+	}
+	slog.Warn("Cannot load the rule set", "rule_set", set.conf.Name, "err", err)
+}
+
+// run downloads the rule set, then reloads it every interval until done is closed
+func (set *ruleSet) run(done chan struct{}) {
+	if set.conf.URL != "" {
+		set.load()
+	}
+	ticker := time.NewTicker(set.conf.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			set.load()
+		}
+	}
+}
+
+func (set *ruleSet) match(ctx context.Context, dest *destination) bool {
+	entries := set.entries.Load()
+	if entries.domains.match(dest.name) {
+		return true
+	}
+	if len(entries.nets) == 0 {
+		return false
+	}
+	for _, ip := range dest.getIPs(ctx) {
+		if containsIP(entries.nets, ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,69 @@
+package proxydialer
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// resolveSecrets replaces the settings tagged secret, like the passwords, whose value is a reference
+// to an environment variable, "env:NAME", or to a file, "file:/run/secrets/name", by the value referenced
+func resolveSecrets(config *Config) error {
+	return resolveSecretValues(reflect.ValueOf(config).Elem(), "")
+}
+
+func resolveSecretValues(v reflect.Value, path string) error {
+	switch v.Kind() {
+	case reflect.Struct:
+		for i := range v.NumField() {
+			field := v.Type().Field(i)
+			tag, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+			if tag == "" || tag == "-" {
+				continue
+			}
+			if field.Tag.Get("secret") == "true" && field.Type.Kind() == reflect.String {
+				value, err := resolveSecret(v.Field(i).String())
+				if err != nil {
+					return fmt.Errorf("%s%s: %w", path, tag, err)
+				}
+				v.Field(i).SetString(value)
+				continue
+			}
+			if err := resolveSecretValues(v.Field(i), path+tag+"."); err != nil {
+				return err
+			}
+		}
+	case reflect.Pointer:
+		if !v.IsNil() {
+			return resolveSecretValues(v.Elem(), path)
+		}
+	case reflect.Slice:
+		for i := range v.Len() {
+			if err := resolveSecretValues(v.Index(i), fmt.Sprintf("%s%d.", path, i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// resolveSecret returns the value of a reference, other values are returned as is
+func resolveSecret(value string) (string, error) {
+	if name, ok := strings.CutPrefix(value, "env:"); ok {
+		secret, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		return secret, nil
+	}
+	if file, ok := strings.CutPrefix(value, "file:"); ok {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+		// files written by hand or by an editor end with a line break
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+	return value, nil
+}
@@ -0,0 +1,245 @@
+package proxydialer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"sync"
+)
+
+// ErrServerClosed is returned by ListenAndServe once the server is shut down
+var ErrServerClosed = errors.New("proxydialer: Server closed")
+
+// ErrServerRunning is returned by ListenAndServe while another server of the process is running
+var ErrServerRunning = errors.New("proxydialer: another Server is running")
+
+// runningServer is the server running in the process, whose sockets, limits and metrics another one would take over
+var (
+	runningMu     sync.Mutex
+	runningServer *Server
+)
+
+// Server runs the listeners, proxies and services of a configuration. The sockets, limits and metrics
+// belong to the process, so only one server runs at a time: a server started after the shutdown of
+// another one takes over the sockets it listened on, like a reload
+type Server struct {
+	config Config
+	// reload asks the owner of the server to read the configuration again, from the admin API
+	reload chan int
+
+	mu       sync.Mutex
+	instance *serverInstance
+	closed   bool
+	done     chan struct{}
+}
+
+// NewServer returns a server of the configuration, or the first invalid setting of it
+func NewServer(config Config) (*Server, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	if !config.hasUpstreamProxies() {
+		return nil, errors.New("No proxy configured")
+	}
+	return newServer(config, nil), nil
+}
+
+func newServer(config Config, reload chan int) *Server {
+	return &Server{config: cloneConfig(config), reload: reload, done: make(chan struct{})}
+}
+
+// ListenAndServe starts the server and serves until the context is canceled or Shutdown is called.
+// The error of a listener or proxy that can't be started is returned at once, and ErrServerRunning
+// while another server is running
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	s.mu.Lock()
+	if s.instance != nil || s.closed {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	runningMu.Lock()
+	if runningServer != nil {
+		runningMu.Unlock()
+		s.mu.Unlock()
+		return ErrServerRunning
+	}
+	runningServer = s
+	runningMu.Unlock()
+	instance, err := startServer(s.config, s.reload, nil)
+	if err != nil {
+		s.release()
+		s.mu.Unlock()
+		return err
+	}
+	s.instance = instance
+	s.mu.Unlock()
+	select {
+	case <-ctx.Done():
+		s.Shutdown(context.Background())
+		return ctx.Err()
+	case <-s.done:
+		return ErrServerClosed
+	}
+}
+
+// Shutdown closes the listeners, the tunnels and requests in progress finish through the proxies
+// of the server, which are closed after them
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	if s.instance != nil {
+		s.instance.stop()
+		s.instance = nil
+		s.release()
+	}
+	s.closed = true
+	close(s.done)
+	return nil
+}
+
+// release lets another server run once the sockets of s are closed
+func (s *Server) release() {
+	runningMu.Lock()
+	defer runningMu.Unlock()
+	if runningServer == s {
+		runningServer = nil
+	}
+}
+
+// Config returns a copy of the configuration of the server, which shares no slice or map with it
+func (s *Server) Config() Config {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return cloneConfig(s.config)
+}
+
+// Apply replaces the configuration of the server like a reload of the configuration file: the sockets
+// whose address didn't change are kept, the tunnels and requests in progress finish on the previous
+// configuration. A configuration that is invalid or can't be started is returned as an error and
+// the running one is kept
+func (s *Server) Apply(config Config) error {
+	return s.Update(func(current *Config) error {
+		*current = cloneConfig(config)
+		return nil
+	})
+}
+
+// Update applies the changes made by update to a copy of the configuration, like Apply. The updates
+// are applied one at a time, so that concurrent ones aren't lost, and update must not call the server
+func (s *Server) Update(update func(config *Config) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrServerClosed
+	}
+	config := cloneConfig(s.config)
+	if err := update(&config); err != nil {
+		return err
+	}
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	if !config.hasUpstreamProxies() {
+		return errors.New("No proxy configured")
+	}
+	if s.instance == nil {
+		s.config = config
+		return nil
+	}
+	next, err := startServer(config, s.reload, s.instance)
+	if err != nil {
+		return err
+	}
+	s.instance.stop()
+	s.instance = next
+	s.config = config
+	metrics.reloads.Add(1)
+	emitEvent(func(h EventHandler) { h.OnReload() })
+	return nil
+}
+
+// AddProxy adds a proxy to the configuration, used when marked with use
+func (s *Server) AddProxy(conf ProxyConf) error {
+	return s.Update(func(config *Config) error {
+		if conf.Name != "" && config.getProxy(conf.Name) != nil {
+			return fmt.Errorf("proxy %s already exists", conf.Name)
+		}
+		config.Proxies = append(slices.Clone(config.Proxies), conf)
+		return nil
+	})
+}
+
+// SetRules replaces the routing rules of the configuration
+func (s *Server) SetRules(rules []RuleConf) error {
+	return s.Update(func(config *Config) error {
+		config.Rules = slices.Clone(rules)
+		return nil
+	})
+}
+
+// SelectUpstream sends the traffic through the proxy of the name only, instead of the chain
+// and of the other proxies marked with use
+func (s *Server) SelectUpstream(name string) error {
+	return s.Update(func(config *Config) error {
+		if config.getProxy(name) == nil {
+			return fmt.Errorf("unknown proxy %s", name)
+		}
+		proxies := slices.Clone(config.Proxies)
+		for i := range proxies {
+			proxies[i].Use = proxies[i].Name == name
+		}
+		config.Proxies = proxies
+		config.Chain = nil
+		return nil
+	})
+}
+
+// cloneConfig returns a copy of the configuration whose slices, maps and pointers are copied too
+func cloneConfig(config Config) Config {
+	cloneValues(reflect.ValueOf(&config).Elem())
+	return config
+}
+
+// cloneValues replaces the slices, maps and pointers of v, which must be settable, by copies
+func cloneValues(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Struct:
+		for i := range v.NumField() {
+			if v.Field(i).CanSet() {
+				cloneValues(v.Field(i))
+			}
+		}
+	case reflect.Pointer:
+		if !v.IsNil() {
+			clone := reflect.New(v.Type().Elem())
+			clone.Elem().Set(v.Elem())
+			cloneValues(clone.Elem())
+			v.Set(clone)
+		}
+	case reflect.Slice:
+		if !v.IsNil() {
+			clone := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+			reflect.Copy(clone, v)
+			for i := range clone.Len() {
+				cloneValues(clone.Index(i))
+			}
+			v.Set(clone)
+		}
+	case reflect.Map:
+		if !v.IsNil() {
+			clone := reflect.MakeMapWithSize(v.Type(), v.Len())
+			for iter := v.MapRange(); iter.Next(); {
+				value := reflect.New(v.Type().Elem()).Elem()
+				value.Set(iter.Value())
+				cloneValues(value)
+				clone.SetMapIndex(iter.Key(), value)
+			}
+			v.Set(clone)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package proxydialer
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// How long the client of a tunnel is waited for to send its TLS ClientHello,
+// clients of protocols where the server talks first are only delayed by that much
+const DEFAULT_SNIFF_TIMEOUT = time.Second
+
+var errClientHelloRead = errors.New("client hello read")
+
+type sniKey struct{}
+
+// withSNI stores the server name the client of a tunnel asked for in its TLS ClientHello
+func withSNI(ctx context.Context, sni string) context.Context {
+	return context.WithValue(ctx, sniKey{}, sni)
+}
+
+// getSNI returns the server name sniffed from the client, empty if unknown
+func getSNI(ctx context.Context) string {
+	sni, _ := ctx.Value(sniKey{}).(string)
+	return sni
+}
+
+// readOnlyConn feeds a TLS server handshake without ever answering the client
+type readOnlyConn struct {
+	reader io.Reader
+}
+
+func (c readOnlyConn) Read(b []byte) (int, error)         { return c.reader.Read(b) }
+func (c readOnlyConn) Write(b []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c readOnlyConn) Close() error                       { return nil }
+func (c readOnlyConn) LocalAddr() net.Addr                { return nil }
+func (c readOnlyConn) RemoteAddr() net.Addr               { return nil }
+func (c readOnlyConn) SetDeadline(t time.Time) error      { return nil }
+func (c readOnlyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c readOnlyConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// peekedConn replays the bytes read while sniffing before reading from the connection again
+type peekedConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// peekSNI reads the TLS ClientHello of the client and returns the server name it carries,
+// the returned connection reads everything the client sent, including the ClientHello
+func peekSNI(conn net.Conn, reader io.Reader) (string, net.Conn) {
+	peeked := new(bytes.Buffer)
+	var sni string
+	conn.SetReadDeadline(time.Now().Add(DEFAULT_SNIFF_TIMEOUT))
+	tls.Server(readOnlyConn{reader: io.TeeReader(reader, peeked)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			sni = hello.ServerName
+			return nil, errClientHelloRead
+		},
+	}).Handshake()
+	conn.SetReadDeadline(time.Time{})
+	return sni, &peekedConn{Conn: conn, reader: io.MultiReader(peeked, reader)}
+}
@@ -0,0 +1,310 @@
+package proxydialer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+const DEFAULT_POOL_TTL = 30 * time.Second
+
+// Time between two attempts to fill the pool while the proxy can't be reached
+const poolRetryInterval = 5 * time.Second
+
+// PoolConf keeps connections to a SOCKS5 proxy open with the handshake done,
+// so that a CONNECT only waits for the proxy to reach the destination
+type PoolConf struct {
+	// Connections kept ready, disabled when 0
+	Size int `yaml:"size"`
+	// Time a connection is kept ready before it is replaced, default "30s", below the idle timeout of the proxy
+	TTL time.Duration `yaml:"ttl"`
+}
+
+func (conf PoolConf) validate() error {
+	if conf.Size < 0 || conf.TTL < 0 {
+		return errors.New("negative pool setting")
+	}
+	return nil
+}
+
+// socksReplyError is a failure reply of a SOCKS5 proxy
+type socksReplyError byte
+
+func (e socksReplyError) Error() string {
+	switch byte(e) {
+	case socksReplyNotAllowed:
+		return "socks connect: connection not allowed by ruleset"
+	case socksReplyHostUnreachable:
+		return "socks connect: host unreachable"
+	case socksReplyConnectionRefused:
+		return "socks connect: connection refused"
+	}
+	return fmt.Sprintf("socks connect: failure reply %d", byte(e))
+}
+
+type warmConn struct {
+	net.Conn
+	ready time.Time
+}
+
+// socksPoolDialer dials through a SOCKS5 proxy, with the connections of its pool when there are some
+type socksPoolDialer struct {
+	addr string
+	auth *proxy.Auth
+	// dials the proxy server, the address is ignored
+	forward proxy.Dialer
+	conf    PoolConf
+	conns   chan warmConn
+	refill  chan struct{}
+	done    chan struct{}
+}
+
+func newSocksPoolDialer(addr string, auth *proxy.Auth, forward proxy.Dialer, conf PoolConf) *socksPoolDialer {
+	if conf.TTL == 0 {
+		conf.TTL = DEFAULT_POOL_TTL
+	}
+	d := &socksPoolDialer{
+		addr:    addr,
+		auth:    auth,
+		forward: forward,
+		conf:    conf,
+		conns:   make(chan warmConn, conf.Size),
+		refill:  make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	go d.run()
+	return d
+}
+
+// withConnDeadline applies the deadline of ctx to conn, and interrupts it when ctx is canceled, until stop is called
+func withConnDeadline(ctx context.Context, conn net.Conn) (stop func()) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stopCancel := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	return func() {
+		stopCancel()
+		conn.SetDeadline(time.Time{})
+	}
+}
+
+// negotiate connects to the proxy and authenticates, the connection is then ready for a request
+func (d *socksPoolDialer) negotiate(ctx context.Context) (net.Conn, error) {
+	conn, err := dialContext(ctx, d.forward, "tcp", d.addr)
+	if err != nil {
+		return nil, err
+	}
+	stop := withConnDeadline(ctx, conn)
+	defer stop()
+	if err := handshakeSocks(conn, d.auth); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// handshakeSocks selects the authentication method of a connection to a SOCKS5 proxy and authenticates
+func handshakeSocks(conn net.Conn, auth *proxy.Auth) error {
+	method := byte(socksMethodNoAuth)
+	if auth != nil {
+		method = socksMethodPassword
+	}
+	if _, err := conn.Write([]byte{socksVersion, 1, method}); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != socksVersion || reply[1] != method {
+		return errors.New("socks: no acceptable authentication method")
+	}
+	if auth != nil {
+		return authenticate(conn, auth)
+	}
+	return nil
+}
+
+// authenticate runs the username/password subnegotiation (RFC 1929)
+func authenticate(conn net.Conn, auth *proxy.Auth) error {
+	if len(auth.User) > 255 || len(auth.Password) > 255 {
+		return errors.New("socks: username or password too long")
+	}
+	buf := []byte{socksPasswordVersion, byte(len(auth.User))}
+	buf = append(buf, auth.User...)
+	buf = append(buf, byte(len(auth.Password)))
+	buf = append(buf, auth.Password...)
+	if _, err := conn.Write(buf); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[1] != 0x00 {
+		return errors.New("socks: username/password authentication failed")
+	}
+	return nil
+}
+
+// connectSocks sends the CONNECT request on a negotiated connection
+func connectSocks(ctx context.Context, conn net.Conn, address string) error {
+	request, err := appendSocksAddr([]byte{socksVersion, socksCmdConnect, 0x00}, address)
+	if err != nil {
+		return err
+	}
+	stop := withConnDeadline(ctx, conn)
+	defer stop()
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+	// VER, REP, RSV
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[0] != socksVersion {
+		return fmt.Errorf("socks: unexpected version %d", header[0])
+	}
+	if header[1] != socksReplySucceeded {
+		return socksReplyError(header[1])
+	}
+	_, err = readSocksAddr(conn)
+	return err
+}
+
+// take returns a connection of the pool that isn't too old, false when there is none
+func (d *socksPoolDialer) take() (net.Conn, bool) {
+	for {
+		select {
+		case conn := <-d.conns:
+			d.signalRefill()
+			if time.Since(conn.ready) > d.conf.TTL {
+				conn.Close()
+				continue
+			}
+			return conn.Conn, true
+		default:
+			return nil, false
+		}
+	}
+}
+
+func (d *socksPoolDialer) signalRefill() {
+	select {
+	case d.refill <- struct{}{}:
+	default:
+	}
+}
+
+func (d *socksPoolDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+func (d *socksPoolDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
+		return nil, errors.New("socks: unsupported network " + network)
+	}
+	if conn, ok := d.take(); ok {
+		err := connectSocks(ctx, conn, address)
+		if err == nil {
+			return conn, nil
+		}
+		conn.Close()
+		var replyErr socksReplyError
+		if errors.As(err, &replyErr) || ctx.Err() != nil {
+			return nil, err
+		}
+		// the proxy closed the connection meanwhile, a new one is made
+	}
+	conn, err := d.negotiate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := connectSocks(ctx, conn, address); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// fill opens connections until the pool is full, it stops at the first failure
+func (d *socksPoolDialer) fill() {
+	for len(d.conns) < cap(d.conns) {
+		select {
+		case <-d.done:
+			return
+		default:
+		}
+		ctx, cancel := withDialTimeout(context.Background())
+		conn, err := d.negotiate(ctx)
+		cancel()
+		if err != nil {
+			slog.Debug("Cannot fill the pool", "proxy", d.addr, "err", err)
+			return
+		}
+		select {
+		case d.conns <- warmConn{Conn: conn, ready: time.Now()}:
+		default:
+			conn.Close()
+			return
+		}
+	}
+}
+
+// dropExpired closes the connections of the pool older than the TTL
+func (d *socksPoolDialer) dropExpired() {
+	for range len(d.conns) {
+		select {
+		case conn := <-d.conns:
+			if time.Since(conn.ready) > d.conf.TTL {
+				conn.Close()
+				continue
+			}
+			select {
+			case d.conns <- conn:
+			default:
+				conn.Close()
+			}
+		default:
+			return
+		}
+	}
+}
+
+// run keeps the pool full until the dialer is closed
+func (d *socksPoolDialer) run() {
+	ticker := time.NewTicker(min(d.conf.TTL/2, poolRetryInterval))
+	defer ticker.Stop()
+	for {
+		d.fill()
+		select {
+		case <-d.done:
+			for {
+				select {
+				case conn := <-d.conns:
+					conn.Close()
+				default:
+					return
+				}
+			}
+		case <-d.refill:
+		case <-ticker.C:
+			d.dropExpired()
+		}
+	}
+}
+
+// Close closes the connections of the pool
+func (d *socksPoolDialer) Close() error {
+	close(d.done)
+	return nil
+}
@@ -0,0 +1,235 @@
+package proxydialer
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+const (
+	socksVersion        = 0x05
+	socksMethodNoAuth   = 0x00
+	socksMethodPassword = 0x02
+	socksMethodNoAccept = 0xff
+	socksCmdConnect     = 0x01
+)
+
+// SOCKS5 reply codes
+const (
+	socksReplySucceeded         = 0x00
+	socksReplyGeneralFailure    = 0x01
+	socksReplyNotAllowed        = 0x02
+	socksReplyHostUnreachable   = 0x04
+	socksReplyConnectionRefused = 0x05
+	socksReplyCmdNotSupported   = 0x07
+	socksReplyAddrNotSupported  = 0x08
+)
+
+// How long a client may take to send its request
+const socksHandshakeTimeout = 30 * time.Second
+
+// readSocksAddr reads an address in the SOCKS5 ATYP/DST.ADDR/DST.PORT form
+func readSocksAddr(reader io.Reader) (string, error) {
+	atyp := make([]byte, 1)
+	if _, err := io.ReadFull(reader, atyp); err != nil {
+		return "", err
+	}
+	var host string
+	switch atyp[0] {
+	case socksAddrIPv4, socksAddrIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if atyp[0] == socksAddrIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(reader, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socksAddrDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(reader, length); err != nil {
+			return "", err
+		}
+		domain := make([]byte, length[0])
+		if _, err := io.ReadFull(reader, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		return "", fmt.Errorf("unsupported address type %d", atyp[0])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(reader, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// writeSocksReply answers a request, bound is the local address of the outgoing connection
+func writeSocksReply(conn net.Conn, reply byte, bound net.Addr) error {
+	buf := []byte{socksVersion, reply, 0x00}
+	addr := "0.0.0.0:0"
+	if bound != nil {
+		addr = bound.String()
+	}
+	buf, err := appendSocksAddr(buf, addr)
+	if err != nil {
+		buf, _ = appendSocksAddr(buf[:3], "0.0.0.0:0")
+	}
+	_, err = conn.Write(buf)
+	return err
+}
+
+// getSocksReply converts a dial error to a SOCKS5 reply code
+func getSocksReply(err error) byte {
+	switch {
+	case errors.Is(err, errRejected):
+		return socksReplyNotAllowed
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socksReplyConnectionRefused
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		return socksReplyHostUnreachable
+	}
+	return socksReplyGeneralFailure
+}
+
+// socksPasswordVersion is the version of the username/password subnegotiation (RFC 1929)
+const socksPasswordVersion = 0x01
+
+// authenticateSOCKS5 runs the username/password subnegotiation and returns the user
+func authenticateSOCKS5(conn net.Conn, auth *authenticator) (string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", err
+	}
+	if header[0] != socksPasswordVersion {
+		return "", fmt.Errorf("unsupported authentication version %d", header[0])
+	}
+	username := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, username); err != nil {
+		return "", err
+	}
+	length := make([]byte, 1)
+	if _, err := io.ReadFull(conn, length); err != nil {
+		return "", err
+	}
+	password := make([]byte, length[0])
+	if _, err := io.ReadFull(conn, password); err != nil {
+		return "", err
+	}
+	if !auth.check(string(username), string(password)) {
+		conn.Write([]byte{socksPasswordVersion, 0x01})
+		return "", fmt.Errorf("invalid credentials of user %s", username)
+	}
+	_, err := conn.Write([]byte{socksPasswordVersion, 0x00})
+	return string(username), err
+}
+
+// negotiateSOCKS5 selects the authentication method of a new client,
+// username/password when auth is set, and returns the authenticated user
+func negotiateSOCKS5(conn net.Conn, auth *authenticator) (string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", err
+	}
+	if header[0] != socksVersion {
+		return "", fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+	expected := byte(socksMethodNoAuth)
+	if auth != nil {
+		expected = socksMethodPassword
+	}
+	for _, method := range methods {
+		if method != expected {
+			continue
+		}
+		if _, err := conn.Write([]byte{socksVersion, method}); err != nil {
+			return "", err
+		}
+		if auth != nil {
+			return authenticateSOCKS5(conn, auth)
+		}
+		return "", nil
+	}
+	conn.Write([]byte{socksVersion, socksMethodNoAccept})
+	return "", errors.New("no acceptable authentication method")
+}
+
+// handleSOCKS5Conn serves a SOCKS5 client, BIND is not supported
+func handleSOCKS5Conn(client_conn net.Conn, dialer proxy.Dialer, auth *authenticator) {
+	client_conn.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+	username, err := negotiateSOCKS5(client_conn, auth)
+	if err != nil {
+		slog.Warn("SOCKS5 failed", "client", client_conn.RemoteAddr().String(), "err", err)
+		client_conn.Close()
+		return
+	}
+
+	// VER, CMD, RSV
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(client_conn, header); err != nil {
+		client_conn.Close()
+		return
+	}
+	address, err := readSocksAddr(client_conn)
+	if err != nil {
+		slog.Warn("SOCKS5 failed", "client", client_conn.RemoteAddr().String(), "err", err)
+		writeSocksReply(client_conn, socksReplyAddrNotSupported, nil)
+		client_conn.Close()
+		return
+	}
+	ctx := withClientAddr(context.Background(), client_conn.RemoteAddr().String())
+	if username != "" {
+		ctx = withUser(ctx, username)
+	}
+	if header[1] == socksCmdUDPAssociate {
+		// the address is where the client sends from, usually unknown yet
+		handleSOCKS5UDP(ctx, client_conn, dialer)
+		return
+	}
+	if header[1] != socksCmdConnect {
+		slog.Warn("SOCKS5 unsupported command", "client", client_conn.RemoteAddr().String(), "command", header[1])
+		writeSocksReply(client_conn, socksReplyCmdNotSupported, nil)
+		client_conn.Close()
+		return
+	}
+
+	slog.Info("SOCKS5 CONNECT", "client", client_conn.RemoteAddr().String(), "address", address)
+	ctx, entry := newAccessEntry(ctx, "CONNECT", address, "SOCKS5")
+	dest_conn, err := dialTunnel(ctx, dialer, "tcp", address)
+	if err != nil {
+		slog.Warn("SOCKS5 CONNECT failed", "client", client_conn.RemoteAddr().String(), "address", address, "err", err)
+		entry.finish(getDialErrorStatus(err), 0, 0)
+		writeSocksReply(client_conn, getSocksReply(err), nil)
+		client_conn.Close()
+		return
+	}
+	if err := writeSocksReply(client_conn, socksReplySucceeded, dest_conn.LocalAddr()); err != nil {
+		dest_conn.Close()
+		client_conn.Close()
+		return
+	}
+	client_conn.SetDeadline(time.Time{})
+	entry.setUpstream(dest_conn)
+	relay(client_conn, dest_conn, entry)
+}
+
+// serveSOCKS5 accepts SOCKS5 clients until the listener is closed
+func serveSOCKS5(listener net.Listener, dialer proxy.Dialer, auth *authenticator) error {
+	return serveListener(listener, func(conn net.Conn) {
+		handleSOCKS5Conn(conn, dialer, auth)
+	})
+}
@@ -0,0 +1,201 @@
+package proxydialer
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+const socksCmdUDPAssociate = 0x03
+
+const (
+	// How long a destination of a UDP association is kept without traffic
+	socksUDPIdleTimeout = 2 * time.Minute
+	// How long the datagrams to a destination that couldn't be dialed are dropped before it is dialed again
+	socksUDPRetryDelay = 5 * time.Second
+	// Datagrams to a destination kept while it is dialed, the next ones are dropped
+	socksUDPMaxPending = 16
+)
+
+// socksUDPRelay forwards the datagrams of a UDP association, every destination is dialed once
+// through the dialer, which must support UDP (direct connections and WireGuard do)
+type socksUDPRelay struct {
+	relay    *net.UDPConn
+	dialer   proxy.Dialer
+	clientIP net.IP
+	ctx      context.Context
+
+	mu     sync.Mutex
+	client *net.UDPAddr
+	dests  map[string]*udpDest
+}
+
+// udpDest is a destination of a UDP association, being dialed, connected, or failed until a retry
+type udpDest struct {
+	conn net.Conn
+	// datagrams received while the destination is dialed
+	pending [][]byte
+	// the datagrams are dropped until then after a failed dial
+	failedUntil time.Time
+}
+
+// handleSOCKS5UDP serves a UDP ASSOCIATE request, the association lasts as long as the control connection
+func handleSOCKS5UDP(ctx context.Context, client_conn net.Conn, dialer proxy.Dialer) {
+	clientIP := client_conn.RemoteAddr().(*net.TCPAddr).IP
+	localIP := client_conn.LocalAddr().(*net.TCPAddr).IP
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: localIP})
+	if err != nil {
+		slog.Warn("SOCKS5 UDP ASSOCIATE failed", "client", client_conn.RemoteAddr().String(), "err", err)
+		writeSocksReply(client_conn, socksReplyGeneralFailure, nil)
+		client_conn.Close()
+		return
+	}
+	if err := writeSocksReply(client_conn, socksReplySucceeded, relay.LocalAddr()); err != nil {
+		relay.Close()
+		client_conn.Close()
+		return
+	}
+	slog.Info("SOCKS5 UDP ASSOCIATE", "client", client_conn.RemoteAddr().String(), "relay", relay.LocalAddr().String())
+	client_conn.SetDeadline(time.Time{})
+
+	r := &socksUDPRelay{
+		relay:    relay,
+		dialer:   dialer,
+		clientIP: clientIP,
+		ctx:      ctx,
+		dests:    make(map[string]*udpDest),
+	}
+	go func() {
+		// the client closes the control connection when it is done
+		io.Copy(io.Discard, client_conn)
+		client_conn.Close()
+		r.close()
+	}()
+	r.serve()
+}
+
+// serve reads the datagrams of the client until the relay is closed
+func (r *socksUDPRelay) serve() {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := r.relay.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		// only the client of the control connection may use the relay
+		if !addr.IP.Equal(r.clientIP) {
+			continue
+		}
+		r.mu.Lock()
+		r.client = addr
+		r.mu.Unlock()
+
+		// RSV, FRAG, then the destination, fragments are not supported
+		if n < 4 || buf[2] != 0x00 {
+			continue
+		}
+		reader := bytes.NewReader(buf[3:n])
+		address, err := readSocksAddr(reader)
+		if err != nil {
+			continue
+		}
+		r.send(address, buf[n-reader.Len():n])
+	}
+}
+
+// send writes a datagram to a destination, which is dialed in the background on its first datagram,
+// the datagrams are queued meanwhile and dropped for a while after the dial failed
+func (r *socksUDPRelay) send(address string, payload []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.dests == nil {
+		return
+	}
+	dest, ok := r.dests[address]
+	switch {
+	case ok && dest.conn != nil:
+		dest.conn.SetReadDeadline(time.Now().Add(socksUDPIdleTimeout))
+		dest.conn.Write(payload)
+	case ok && dest.failedUntil.IsZero():
+		if len(dest.pending) < socksUDPMaxPending {
+			dest.pending = append(dest.pending, bytes.Clone(payload))
+		}
+	case ok && time.Now().Before(dest.failedUntil):
+	default:
+		dest = &udpDest{pending: [][]byte{bytes.Clone(payload)}}
+		r.dests[address] = dest
+		go r.dial(address, dest)
+	}
+}
+
+// dial connects to a destination and sends it the datagrams queued meanwhile
+func (r *socksUDPRelay) dial(address string, dest *udpDest) {
+	conn, err := dialContext(r.ctx, r.dialer, "udp", address)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.dests == nil || r.dests[address] != dest {
+		// closed meanwhile
+		if conn != nil {
+			conn.Close()
+		}
+		return
+	}
+	if err != nil {
+		slog.Warn("SOCKS5 UDP failed", "client", r.clientIP.String(), "address", address, "err", err)
+		dest.pending = nil
+		dest.failedUntil = time.Now().Add(socksUDPRetryDelay)
+		return
+	}
+	dest.conn = conn
+	conn.SetReadDeadline(time.Now().Add(socksUDPIdleTimeout))
+	for _, payload := range dest.pending {
+		conn.Write(payload)
+	}
+	dest.pending = nil
+	go r.readDest(address, conn)
+}
+
+// readDest sends the datagrams of a destination back to the client until it is idle
+func (r *socksUDPRelay) readDest(address string, conn net.Conn) {
+	header, err := appendSocksAddr([]byte{0x00, 0x00, 0x00}, address)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	buf := make([]byte, 65535)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			break
+		}
+		conn.SetReadDeadline(time.Now().Add(socksUDPIdleTimeout))
+		r.mu.Lock()
+		client := r.client
+		r.mu.Unlock()
+		r.relay.WriteToUDP(append(header, buf[:n]...), client)
+	}
+	conn.Close()
+	r.mu.Lock()
+	if dest := r.dests[address]; dest != nil && dest.conn == conn {
+		delete(r.dests, address)
+	}
+	r.mu.Unlock()
+}
+
+func (r *socksUDPRelay) close() {
+	r.relay.Close()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, dest := range r.dests {
+		if dest.conn != nil {
+			dest.conn.Close()
+		}
+	}
+	r.dests = nil
+}
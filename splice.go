@@ -0,0 +1,122 @@
+package proxydialer
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"time"
+)
+
+// Time the splice of a tunnel stops at to update its counters
+const spliceCountInterval = time.Second
+
+// prefixedConn reads the bytes the server had buffered when the connection was hijacked before reading from it again
+type prefixedConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (c *prefixedConn) Read(b []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(b, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+// withBuffered returns the hijacked connection of a client, the bytes it sent after its request are read first
+func withBuffered(conn net.Conn, reader *bufio.Reader) net.Conn {
+	if reader == nil || reader.Buffered() == 0 {
+		return conn
+	}
+	prefix, _ := reader.Peek(reader.Buffered())
+	return &prefixedConn{Conn: conn, prefix: prefix}
+}
+
+// getSpliceConn returns the TCP connection under the wrappers of a side of a tunnel, with a function adding the
+// bytes spliced to the counters of the wrappers, nil when there is none or bytes are still buffered
+func getSpliceConn(side any, reading bool) (*net.TCPConn, func(n int64)) {
+	var counters []func(n int64)
+	for {
+		switch c := side.(type) {
+		case *net.TCPConn:
+			return c, func(n int64) {
+				for _, count := range counters {
+					count(n)
+				}
+			}
+		case *countingReader:
+			counters = append(counters, c.add)
+			side = c.ReadCloser
+		case *meteredConn:
+			counter := &c.stats.sent
+			if reading {
+				counter = &c.stats.received
+			}
+			counters = append(counters, func(n int64) { counter.Add(uint64(n)) })
+			side = c.Conn
+		case *throttledReader:
+			if c.isLimited() {
+				return nil, nil
+			}
+			side = c.ReadCloser
+		case *limitedConn:
+			side = c.Conn
+		case *prefixedConn:
+			if len(c.prefix) > 0 {
+				return nil, nil
+			}
+			side = c.Conn
+		default:
+			return nil, nil
+		}
+	}
+}
+
+// splice copies source to destination with splice(2) on Linux when both are TCP connections, the data doesn't go
+// through user space then, false when it can't be used and nothing was copied
+func splice(destination io.Writer, source io.Reader, buf []byte) bool {
+	if runtime.GOOS != "linux" {
+		return false
+	}
+	dst, countSent := getSpliceConn(destination, false)
+	if dst == nil {
+		return false
+	}
+	// the first read goes through the buffer, it takes the bytes buffered before the tunnel and the first byte
+	// is timed by the metered connections
+	n, err := source.Read(buf)
+	if n > 0 {
+		if _, err := destination.Write(buf[:n]); err != nil {
+			return true
+		}
+	}
+	if err != nil {
+		return true
+	}
+	src, countReceived := getSpliceConn(source, true)
+	if src == nil {
+		io.CopyBuffer(writerOnly{destination}, source, buf)
+		return true
+	}
+	for {
+		// the deadline only interrupts the splice, the tunnel is closed by relay or when it is idle
+		src.SetReadDeadline(time.Now().Add(spliceCountInterval))
+		n, err := dst.ReadFrom(src)
+		countReceived(n)
+		countSent(n)
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			return true
+		}
+		// a bandwidth limit set by a reload since is followed by copying through the limiters
+		if limited, _ := getSpliceConn(source, true); limited == nil {
+			src.SetReadDeadline(time.Time{})
+			io.CopyBuffer(writerOnly{destination}, source, buf)
+			return true
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package proxydialer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"golang.org/x/net/proxy"
+)
+
+// sshDialer opens direct-tcpip channels over a shared SSH connection,
+// reconnecting lazily when the connection to the server is lost
+type sshDialer struct {
+	forward proxy.Dialer
+	addr    string
+	config  *ssh.ClientConfig
+
+	mu     sync.Mutex
+	client *ssh.Client
+}
+
+// establishSSHProxy prepares a dialer that tunnels connections through an SSH server
+func establishSSHProxy(conf ProxyConf, forward proxy.Dialer) (proxy.Dialer, error) {
+	var auth []ssh.AuthMethod
+	if conf.PrivateKey != "" {
+		key, err := os.ReadFile(conf.PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		var signer ssh.Signer
+		if conf.PrivateKeyPassphrase != "" {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(key, []byte(conf.PrivateKeyPassphrase))
+		} else {
+			signer, err = ssh.ParsePrivateKey(key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("ssh private key %s: %w", conf.PrivateKey, err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if conf.Password != "" {
+		auth = append(auth, ssh.Password(conf.Password))
+	}
+	if len(auth) == 0 {
+		return nil, errors.New("ssh proxy requires password or private_key")
+	}
+
+	hostKeyCallback := ssh.InsecureIgnoreHostKey()
+	if conf.InsecureSkipHostKey {
+		slog.Warn("insecure_skip_host_key is set, the host key will not be verified", "proxy", conf.getProxyAddr())
+	} else {
+		knownHosts, err := getKnownHostsFile(conf)
+		if err != nil {
+			return nil, err
+		}
+		if hostKeyCallback, err = knownhosts.New(knownHosts); err != nil {
+			return nil, fmt.Errorf("known_hosts: %w", err)
+		}
+	}
+
+	return &sshDialer{
+		forward: forward,
+		addr:    conf.getProxyAddr(),
+		config: &ssh.ClientConfig{
+			User:            conf.Username,
+			Auth:            auth,
+			HostKeyCallback: hostKeyCallback,
+		},
+	}, nil
+}
+
+// getKnownHostsFile returns the known_hosts file verifying the host key of the server, ~/.ssh/known_hosts by default
+func getKnownHostsFile(conf ProxyConf) (string, error) {
+	if conf.KnownHosts != "" {
+		return conf.KnownHosts, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("known_hosts is not set and there is no home directory: %w", err)
+	}
+	return filepath.Join(home, ".ssh", "known_hosts"), nil
+}
+
+// getClient returns the SSH connection to the server, connecting when there is none. The handshake is
+// bounded by the dial timeout and the context, the other dials through the server wait for it
+func (d *sshDialer) getClient(ctx context.Context) (*ssh.Client, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.client != nil {
+		return d.client, nil
+	}
+
+	ctx, cancel := withDialTimeout(ctx)
+	defer cancel()
+	conn, err := dialContext(ctx, d.forward, "tcp", d.addr)
+	if err != nil {
+		return nil, err
+	}
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	c, chans, reqs, err := ssh.NewClientConn(conn, d.addr, d.config)
+	if !stop() && err == nil {
+		// canceled right after the handshake, the deadline may be set
+		c.Close()
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	client := ssh.NewClient(c, chans, reqs)
+	d.client = client
+
+	go func() {
+		client.Wait()
+		d.resetClient(client)
+	}()
+	return client, nil
+}
+
+func (d *sshDialer) resetClient(client *ssh.Client) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.client == client {
+		d.client = nil
+		client.Close()
+	}
+}
+
+func (d *sshDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+func (d *sshDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	client, err := d.getClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := client.DialContext(ctx, network, address)
+	var openErr *ssh.OpenChannelError
+	if err != nil && !errors.As(err, &openErr) && ctx.Err() == nil {
+		// The SSH connection itself is broken, retry once over a fresh one
+		d.resetClient(client)
+		if client, err = d.getClient(ctx); err != nil {
+			return nil, err
+		}
+		return client.DialContext(ctx, network, address)
+	}
+	return conn, err
+}
+
+func (d *sshDialer) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.client == nil {
+		return nil
+	}
+	client := d.client
+	d.client = nil
+	return client.Close()
+}
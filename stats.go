@@ -0,0 +1,34 @@
+package proxydialer
+
+import (
+	"log/slog"
+	"maps"
+	"runtime"
+	"slices"
+	"time"
+)
+
+// logStats writes a snapshot of the counters to the log, for servers without the admin API
+func logStats() {
+	metrics.mu.Lock()
+	names := slices.Sorted(maps.Keys(metrics.upstreams))
+	metrics.mu.Unlock()
+	proxies := make([]any, 0, len(names))
+	for _, name := range names {
+		traffic := getTraffic(name)
+		proxies = append(proxies, slog.Group(name,
+			"received", traffic.Received,
+			"sent", traffic.Sent,
+			"connections", traffic.Connections,
+			"open", traffic.Open,
+			"dial_errors", traffic.DialErrors,
+		))
+	}
+	slog.Info("Stats",
+		"uptime", time.Since(startTime).Round(time.Second),
+		"active_tunnels", metrics.activeTunnels.Load(),
+		"reloads", metrics.reloads.Load(),
+		"goroutines", runtime.NumGoroutine(),
+		slog.Group("proxies", proxies...),
+	)
+}
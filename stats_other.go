@@ -0,0 +1,18 @@
+//go:build !windows
+
+package proxydialer
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// logStatsOnSignal logs the stats every time SIGUSR1 is received, e.g. kill -USR1 <pid>
+func logStatsOnSignal() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR1)
+	for range sigs {
+		logStats()
+	}
+}
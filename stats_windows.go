@@ -0,0 +1,4 @@
+package proxydialer
+
+// logStatsOnSignal does nothing, Windows has no SIGUSR1
+func logStatsOnSignal() {}
@@ -0,0 +1,178 @@
+package proxydialer
+
+import (
+	"fmt"
+	"log/slog"
+	"maps"
+	"net"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DEFAULT_STATSD_PREFIX   = "proxydialer."
+	DEFAULT_STATSD_INTERVAL = 10 * time.Second
+)
+
+// Size of the datagrams the metrics are grouped in, below the usual MTU
+const statsdPacketSize = 1400
+
+// StatsdConf pushes the metrics to a statsd or DogStatsD agent
+type StatsdConf struct {
+	// Address of the agent, e.g. "127.0.0.1:8125", disabled when not set
+	Address string `yaml:"address"`
+	// Prefix of the metric names, default "proxydialer."
+	Prefix string `yaml:"prefix"`
+	// Send the labels as DogStatsD tags, otherwise they are appended to the metric names
+	DogStatsD bool `yaml:"dogstatsd"`
+	// Tags of every metric, e.g. {"env": "prod"}, only sent to DogStatsD
+	Tags map[string]string `yaml:"tags"`
+	// How often the counters and gauges are sent, default "10s", the timings are sent as they are measured
+	Interval time.Duration `yaml:"interval"`
+}
+
+// statsdClient sends the metrics of the running server, nil when statsd is disabled
+var statsdClient atomic.Pointer[statsdExporter]
+
+// statsdExporter sends the counters as the increments since the previous flush
+type statsdExporter struct {
+	conf StatsdConf
+	conn net.Conn
+	tags []string
+	// values of the counters at the previous flush, by line prefix
+	last map[string]uint64
+	done chan struct{}
+}
+
+func newStatsdExporter(conf StatsdConf) (*statsdExporter, error) {
+	if conf.Prefix == "" {
+		conf.Prefix = DEFAULT_STATSD_PREFIX
+	}
+	if conf.Interval <= 0 {
+		conf.Interval = DEFAULT_STATSD_INTERVAL
+	}
+	conn, err := net.Dial("udp", conf.Address)
+	if err != nil {
+		return nil, err
+	}
+	e := &statsdExporter{
+		conf: conf,
+		conn: conn,
+		last: make(map[string]uint64),
+		done: make(chan struct{}),
+	}
+	for _, key := range slices.Sorted(maps.Keys(conf.Tags)) {
+		e.tags = append(e.tags, key+":"+conf.Tags[key])
+	}
+	// the counters are kept across reloads, only what happens next is sent
+	e.getCounters()
+	go e.run()
+	slog.Info("Metrics are sent to statsd", "address", conf.Address)
+	return e, nil
+}
+
+// getName returns the metric name with its labels, like "proxy:vpn", and the tags to send
+func (e *statsdExporter) getName(name string, labels ...string) (string, []string) {
+	if e.conf.DogStatsD {
+		return e.conf.Prefix + name, append(slices.Clone(e.tags), labels...)
+	}
+	for _, label := range labels {
+		_, value, _ := strings.Cut(label, ":")
+		name += "." + strings.NewReplacer(".", "_", ":", "_", "|", "_", "@", "_").Replace(value)
+	}
+	return e.conf.Prefix + name, nil
+}
+
+func (e *statsdExporter) formatLine(name, value, metricType string, labels ...string) string {
+	name, tags := e.getName(name, labels...)
+	line := fmt.Sprintf("%s:%s|%s", name, value, metricType)
+	if len(tags) > 0 {
+		line += "|#" + strings.Join(tags, ",")
+	}
+	return line
+}
+
+// send sends the lines, grouped in as few datagrams as possible
+func (e *statsdExporter) send(lines []string) {
+	var packet strings.Builder
+	for _, line := range lines {
+		if packet.Len() > 0 && packet.Len()+1+len(line) > statsdPacketSize {
+			e.conn.Write([]byte(packet.String()))
+			packet.Reset()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	if packet.Len() > 0 {
+		e.conn.Write([]byte(packet.String()))
+	}
+}
+
+// getCounters returns the lines of the counters increased since the previous call
+func (e *statsdExporter) getCounters() []string {
+	var lines []string
+	counter := func(name string, value uint64, labels ...string) {
+		key := e.formatLine(name, "", "c", labels...)
+		if delta := value - e.last[key]; delta > 0 {
+			lines = append(lines, e.formatLine(name, fmt.Sprint(delta), "c", labels...))
+		}
+		e.last[key] = value
+	}
+	counter("config.reloads", metrics.reloads.Load())
+	metrics.mu.Lock()
+	names := slices.Sorted(maps.Keys(metrics.upstreams))
+	metrics.mu.Unlock()
+	for _, name := range names {
+		stats := metrics.getUpstream(name)
+		label := "proxy:" + name
+		counter("upstream.received_bytes", stats.received.Load(), label)
+		counter("upstream.sent_bytes", stats.sent.Load(), label)
+		counter("upstream.connections", stats.connections.Load(), label)
+		counter("upstream.dial_errors", stats.dialErrors.Load(), label)
+	}
+	return lines
+}
+
+func (e *statsdExporter) flush() {
+	lines := []string{e.formatLine("tunnels.active", fmt.Sprint(metrics.activeTunnels.Load()), "g")}
+	metrics.mu.Lock()
+	for name, stats := range metrics.upstreams {
+		lines = append(lines, e.formatLine("upstream.open_connections", fmt.Sprint(stats.open.Load()), "g", "proxy:"+name))
+	}
+	metrics.mu.Unlock()
+	e.send(append(lines, e.getCounters()...))
+}
+
+// run sends the counters and gauges every interval until the exporter is closed, and a last time then
+func (e *statsdExporter) run() {
+	ticker := time.NewTicker(e.conf.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-e.done:
+			e.flush()
+			e.conn.Close()
+			return
+		case <-ticker.C:
+			e.flush()
+		}
+	}
+}
+
+func (e *statsdExporter) Close() error {
+	close(e.done)
+	return nil
+}
+
+// sendTiming sends a duration measured with its labels, like "proxy:vpn", when statsd is enabled
+func sendTiming(name string, duration time.Duration, labels ...string) {
+	e := statsdClient.Load()
+	if e == nil {
+		return
+	}
+	e.send([]string{e.formatLine(name, fmt.Sprintf("%g", float64(duration)/float64(time.Millisecond)), "ms", labels...)})
+}
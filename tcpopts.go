@@ -0,0 +1,87 @@
+package proxydialer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// TCPConf tunes the TCP connections of the clients and the ones to the proxies and to the destinations dialed directly
+type TCPConf struct {
+	// Idle time before the keepalive probes and between them, default "15s", disabled when negative
+	KeepAlive time.Duration `yaml:"keepalive"`
+	// Delay the small writes to send them together (Nagle's algorithm), by default they are sent at once with TCP_NODELAY
+	Nagle bool `yaml:"nagle"`
+	// Time the data sent may stay unacknowledged before the connection is closed (TCP_USER_TIMEOUT),
+	// Linux only, the system default when 0
+	UserTimeout time.Duration `yaml:"user_timeout"`
+}
+
+func (conf TCPConf) validate() error {
+	if conf.UserTimeout < 0 {
+		return errors.New("negative user_timeout")
+	}
+	return nil
+}
+
+// tcpOptions are the options of the running server, the connections get the ones set when they are opened
+var tcpOptions atomic.Pointer[TCPConf]
+
+// setTCPOptions applies the options to a TCP connection, other connections are left as they are
+func setTCPOptions(conn net.Conn) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	conf := tcpOptions.Load()
+	if !ok || conf == nil {
+		return
+	}
+	if conf.KeepAlive < 0 {
+		tcpConn.SetKeepAlive(false)
+	} else if conf.KeepAlive > 0 {
+		tcpConn.SetKeepAliveConfig(net.KeepAliveConfig{Enable: true, Idle: conf.KeepAlive, Interval: conf.KeepAlive})
+	}
+	tcpConn.SetNoDelay(!conf.Nagle)
+	if conf.UserTimeout > 0 {
+		setUserTimeout(tcpConn, conf.UserTimeout)
+	}
+}
+
+// tcpDialer dials directly with the TCP options
+type tcpDialer struct{}
+
+// directDialer replaces proxy.Direct, to dial the first hops and the destinations reached directly
+var directDialer proxy.Dialer = tcpDialer{}
+
+func (d tcpDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+func (d tcpDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := proxy.Direct.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	setTCPOptions(conn)
+	return conn, nil
+}
+
+// tcpListener applies the TCP options to the connections it accepts
+type tcpListener struct {
+	net.Listener
+}
+
+func (l *tcpListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	setTCPOptions(conn)
+	return conn, nil
+}
+
+func withTCPOptions(listener net.Listener) net.Listener {
+	return &tcpListener{Listener: listener}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package proxydialer
+
+import (
+	"net"
+	"time"
+)
+
+// setUserTimeout does nothing, TCP_USER_TIMEOUT only exists on Linux
+func setUserTimeout(conn *net.TCPConn, timeout time.Duration) error {
+	return nil
+}
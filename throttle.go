@@ -0,0 +1,233 @@
+package proxydialer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// Smallest burst of the bandwidth limits, in bytes
+const minThrottleBurst = 4096
+
+// bandwidthLimits cap the throughput of all the tunnels in each direction, kept across reloads
+// so that the tunnels already open follow a new limit
+var bandwidthLimits = struct {
+	upload   *rate.Limiter
+	download *rate.Limiter
+}{
+	upload:   rate.NewLimiter(rate.Inf, 0),
+	download: rate.NewLimiter(rate.Inf, 0),
+}
+
+// setBandwidth sets the limit of a direction in kilobits per second, none when 0
+func setBandwidth(limiter *rate.Limiter, kbps int) {
+	if kbps == 0 {
+		limiter.SetLimit(rate.Inf)
+		return
+	}
+	// bytes per second, with bursts of a tenth of a second
+	bytes := kbps * 1000 / 8
+	limiter.SetBurst(max(bytes/10, minThrottleBurst))
+	limiter.SetLimit(rate.Limit(bytes))
+}
+
+// throttledReader waits for the bytes read to fit in its limiters
+type throttledReader struct {
+	io.ReadCloser
+	limiters []*rate.Limiter
+}
+
+// throttle returns the source of a tunnel limited by the limiters set
+func throttle(source io.ReadCloser, limiters ...*rate.Limiter) io.ReadCloser {
+	return &throttledReader{ReadCloser: source, limiters: limiters}
+}
+
+func (r *throttledReader) Read(b []byte) (int, error) {
+	for _, limiter := range r.limiters {
+		if limiter.Limit() != rate.Inf && len(b) > limiter.Burst() {
+			b = b[:limiter.Burst()]
+		}
+	}
+	n, err := r.ReadCloser.Read(b)
+	for _, limiter := range r.limiters {
+		if limiter.Limit() != rate.Inf && n > 0 {
+			// fails when the limit was lowered since the read, the bytes are let through
+			limiter.WaitN(context.Background(), n)
+		}
+	}
+	return n, err
+}
+
+// isLimited tells whether one of the limiters has a limit
+func (r *throttledReader) isLimited() bool {
+	for _, limiter := range r.limiters {
+		if limiter.Limit() != rate.Inf {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientBandwidthConf limits the bandwidth of each of the clients it matches
+type ClientBandwidthConf struct {
+	// Client IPs or ranges, e.g. "192.168.1.0/24"
+	Clients []string `yaml:"clients"`
+	// Authenticated users
+	Users []string `yaml:"users"`
+	// Throughput from a client in kilobits per second, no limit when 0
+	MaxUpload int `yaml:"max_upload"`
+	// Throughput to a client in kilobits per second, no limit when 0
+	MaxDownload int `yaml:"max_download"`
+}
+
+type clientBandwidthRule struct {
+	clients     []*net.IPNet
+	users       []string
+	maxUpload   int
+	maxDownload int
+}
+
+// clientBandwidthRules are the limits of the clients, the first rule matching a client applies,
+// the default limits otherwise
+type clientBandwidthRules struct {
+	rules       []clientBandwidthRule
+	maxUpload   int
+	maxDownload int
+}
+
+func newClientBandwidthRules(conf LimitsConf) (*clientBandwidthRules, error) {
+	r := &clientBandwidthRules{maxUpload: conf.MaxClientUpload, maxDownload: conf.MaxClientDownload}
+	for i, ruleConf := range conf.ClientBandwidth {
+		if ruleConf.MaxUpload < 0 || ruleConf.MaxDownload < 0 {
+			return nil, fmt.Errorf("client_bandwidth %d: negative limit", i)
+		}
+		clients, err := parseNets(ruleConf.Clients)
+		if err != nil {
+			return nil, fmt.Errorf("client_bandwidth %d: %w", i, err)
+		}
+		r.rules = append(r.rules, clientBandwidthRule{
+			clients:     clients,
+			users:       ruleConf.Users,
+			maxUpload:   ruleConf.MaxUpload,
+			maxDownload: ruleConf.MaxDownload,
+		})
+	}
+	return r, nil
+}
+
+// isEmpty tells whether no client is limited
+func (r *clientBandwidthRules) isEmpty() bool {
+	if r.maxUpload > 0 || r.maxDownload > 0 {
+		return false
+	}
+	for _, rule := range r.rules {
+		if rule.maxUpload > 0 || rule.maxDownload > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// getLimits returns the upload and download limits of a client in kilobits per second
+func (r *clientBandwidthRules) getLimits(ip net.IP, user string) (int, int) {
+	for _, rule := range r.rules {
+		if (user != "" && slices.Contains(rule.users, user)) || containsIP(rule.clients, ip) {
+			return rule.maxUpload, rule.maxDownload
+		}
+	}
+	return r.maxUpload, r.maxDownload
+}
+
+// clientBandwidth is shared by the tunnels and requests of a client open at the same time
+type clientBandwidth struct {
+	key      string
+	ip       net.IP
+	user     string
+	upload   *rate.Limiter
+	download *rate.Limiter
+	// tunnels and requests using the limiters
+	refs int
+}
+
+func (b *clientBandwidth) setLimits(rules *clientBandwidthRules) {
+	maxUpload, maxDownload := rules.getLimits(b.ip, b.user)
+	setBandwidth(b.upload, maxUpload)
+	setBandwidth(b.download, maxDownload)
+}
+
+// clientBandwidthRegistry keeps the limiters of the connected clients, by user when authenticated and otherwise by IP
+type clientBandwidthRegistry struct {
+	mu      sync.Mutex
+	rules   *clientBandwidthRules
+	clients map[string]*clientBandwidth
+}
+
+var clientBandwidths = &clientBandwidthRegistry{
+	rules:   &clientBandwidthRules{},
+	clients: make(map[string]*clientBandwidth),
+}
+
+// setRules changes the limits, of the clients already connected too
+func (r *clientBandwidthRegistry) setRules(rules *clientBandwidthRules) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.rules = rules
+	for _, bandwidth := range r.clients {
+		bandwidth.setLimits(rules)
+	}
+}
+
+// acquire returns the limiters of the client of ctx until they are released, nil when no client is limited
+func (r *clientBandwidthRegistry) acquire(ctx context.Context) *clientBandwidth {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.rules.isEmpty() {
+		return nil
+	}
+	client, user := getClientIP(ctx), getUser(ctx)
+	key := client
+	if user != "" {
+		key = "user:" + user
+	}
+	bandwidth, ok := r.clients[key]
+	if !ok {
+		bandwidth = &clientBandwidth{
+			key:      key,
+			ip:       net.ParseIP(client),
+			user:     user,
+			upload:   rate.NewLimiter(rate.Inf, 0),
+			download: rate.NewLimiter(rate.Inf, 0),
+		}
+		bandwidth.setLimits(r.rules)
+		r.clients[key] = bandwidth
+	}
+	bandwidth.refs++
+	return bandwidth
+}
+
+func (r *clientBandwidthRegistry) release(bandwidth *clientBandwidth) {
+	if bandwidth == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if bandwidth.refs--; bandwidth.refs == 0 {
+		delete(r.clients, bandwidth.key)
+	}
+}
+
+// getLimiters returns the upload and download limiters of a tunnel or request, the global ones and the client ones
+func getLimiters(bandwidth *clientBandwidth) ([]*rate.Limiter, []*rate.Limiter) {
+	upload := []*rate.Limiter{bandwidthLimits.upload}
+	download := []*rate.Limiter{bandwidthLimits.download}
+	if bandwidth != nil {
+		upload = append(upload, bandwidth.upload)
+		download = append(download, bandwidth.download)
+	}
+	return upload, download
+}
@@ -0,0 +1,77 @@
+package proxydialer
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// TLSConf describes how the TLS connection to an upstream proxy is verified
+type TLSConf struct {
+	Enabled    bool   `yaml:"enabled"`
+	ServerName string `yaml:"server_name"`
+	CA         string `yaml:"ca"`
+	Insecure   bool   `yaml:"insecure"`
+}
+
+// getTLSConfig builds the client TLS config, serverName is used when no server_name is configured
+func (conf *TLSConf) getTLSConfig(serverName string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{ServerName: serverName}
+	if conf == nil {
+		return tlsConfig, nil
+	}
+	if conf.ServerName != "" {
+		tlsConfig.ServerName = conf.ServerName
+	}
+	tlsConfig.InsecureSkipVerify = conf.Insecure
+	if conf.CA != "" {
+		pem, err := os.ReadFile(conf.CA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", conf.CA)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return tlsConfig, nil
+}
+
+// ServerTLSConf is the certificate the local proxy serves TLS with
+type ServerTLSConf struct {
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+	// CA the clients' certificates must be signed by, clients without one are refused
+	ClientCA string `yaml:"client_ca"`
+}
+
+// getTLSConfig builds the server TLS config, HTTP/2 is not offered since proxy clients expect HTTP/1.1 CONNECT
+func (conf *ServerTLSConf) getTLSConfig() (*tls.Config, error) {
+	if conf.Cert == "" || conf.Key == "" {
+		return nil, errors.New("tls: cert and key are required")
+	}
+	cert, err := tls.LoadX509KeyPair(conf.Cert, conf.Key)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"http/1.1"},
+	}
+	if conf.ClientCA != "" {
+		pem, err := os.ReadFile(conf.ClientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", conf.ClientCA)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
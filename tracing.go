@@ -0,0 +1,331 @@
+package proxydialer
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Kinds of the OTLP spans
+const (
+	SPAN_KIND_INTERNAL = 1
+	SPAN_KIND_SERVER   = 2
+	SPAN_KIND_CLIENT   = 3
+)
+
+const (
+	// Spans sent by request
+	tracingBatchSize = 512
+	// Spans waiting to be sent, the next ones are dropped
+	tracingQueueSize   = 4096
+	tracingFlushPeriod = 5 * time.Second
+)
+
+// TracingConf exports the spans of the requests to an OpenTelemetry collector with OTLP over HTTP
+type TracingConf struct {
+	// URL of the collector, e.g. "http://127.0.0.1:4318", disabled when not set
+	Endpoint string `yaml:"endpoint"`
+	// Name of the service the spans belong to, default "proxydialer"
+	ServiceName string `yaml:"service_name"`
+	// Headers sent with the spans, e.g. the API key of a hosted collector
+	Headers map[string]string `yaml:"headers"`
+}
+
+func (conf TracingConf) getURL() string {
+	endpoint := strings.TrimSuffix(conf.Endpoint, "/")
+	if strings.HasSuffix(endpoint, "/v1/traces") {
+		return endpoint
+	}
+	return endpoint + "/v1/traces"
+}
+
+// spanContext identifies a span, it is carried by the contexts of the dials
+type spanContext struct {
+	traceID [16]byte
+	spanID  [8]byte
+}
+
+type spanContextKey struct{}
+
+func getSpanContext(ctx context.Context) (spanContext, bool) {
+	sc, ok := ctx.Value(spanContextKey{}).(spanContext)
+	return sc, ok
+}
+
+// withTraceParent continues the trace of a W3C traceparent header sent by the client
+func withTraceParent(ctx context.Context, header http.Header) context.Context {
+	parts := strings.Split(header.Get("Traceparent"), "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return ctx
+	}
+	var sc spanContext
+	if _, err := hex.Decode(sc.traceID[:], []byte(parts[1])); err != nil {
+		return ctx
+	}
+	if _, err := hex.Decode(sc.spanID[:], []byte(parts[2])); err != nil {
+		return ctx
+	}
+	if sc.traceID == [16]byte{} || sc.spanID == [8]byte{} {
+		return ctx
+	}
+	return context.WithValue(ctx, spanContextKey{}, sc)
+}
+
+// spanTracer exports the spans of the running server, nil when tracing is disabled
+var spanTracer atomic.Pointer[otlpExporter]
+
+// span is an operation of a request, the methods of a nil span do nothing
+type span struct {
+	spanContext
+	exporter *otlpExporter
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+
+	mu         sync.Mutex
+	end        time.Time
+	attributes []otlpAttribute
+	failure    string
+}
+
+// startSpan starts a span, child of the one of ctx, and returns the context carrying it,
+// only the spans of the requests start a trace, the others are left out outside of one, e.g. health checks
+func startSpan(ctx context.Context, name string, kind int) (context.Context, *span) {
+	exporter := spanTracer.Load()
+	if exporter == nil {
+		return ctx, nil
+	}
+	parent, ok := getSpanContext(ctx)
+	if !ok && kind != SPAN_KIND_SERVER {
+		return ctx, nil
+	}
+	s := &span{exporter: exporter, name: name, kind: kind, start: time.Now()}
+	if ok {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.spanID[:])
+	return context.WithValue(ctx, spanContextKey{}, s.spanContext), s
+}
+
+// startChild starts a span under s, when the context of s isn't at hand
+func (s *span) startChild(name string, kind int) *span {
+	if s == nil {
+		return nil
+	}
+	_, child := startSpan(context.WithValue(context.Background(), spanContextKey{}, s.spanContext), name, kind)
+	return child
+}
+
+// setAttribute records a string, integer or boolean value
+func (s *span) setAttribute(key string, value any) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attributes = append(s.attributes, newOTLPAttribute(key, value))
+}
+
+func (s *span) setError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failure = err.Error()
+}
+
+// finish ends the span and queues it for the export
+func (s *span) finish() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.end = time.Now()
+	s.mu.Unlock()
+	s.exporter.export(s)
+}
+
+type otlpAttribute struct {
+	Key   string         `json:"key"`
+	Value map[string]any `json:"value"`
+}
+
+func newOTLPAttribute(key string, value any) otlpAttribute {
+	switch v := value.(type) {
+	case int:
+		return otlpAttribute{key, map[string]any{"intValue": strconv.Itoa(v)}}
+	case int64:
+		return otlpAttribute{key, map[string]any{"intValue": strconv.FormatInt(v, 10)}}
+	case bool:
+		return otlpAttribute{key, map[string]any{"boolValue": v}}
+	}
+	return otlpAttribute{key, map[string]any{"stringValue": fmt.Sprint(value)}}
+}
+
+type otlpStatus struct {
+	// 2 is an error
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+func (s *span) toOTLP() otlpSpan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	span := otlpSpan{
+		TraceID:           hex.EncodeToString(s.traceID[:]),
+		SpanID:            hex.EncodeToString(s.spanID[:]),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		Attributes:        s.attributes,
+	}
+	if s.parentID != [8]byte{} {
+		span.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+	if s.failure != "" {
+		span.Status = otlpStatus{Code: 2, Message: s.failure}
+	}
+	return span
+}
+
+// otlpExporter sends the finished spans to the collector in batches
+type otlpExporter struct {
+	conf   TracingConf
+	client *http.Client
+	spans  chan *span
+	done   chan struct{}
+	closed chan struct{}
+}
+
+func newOTLPExporter(conf TracingConf) *otlpExporter {
+	if conf.ServiceName == "" {
+		conf.ServiceName = "proxydialer"
+	}
+	e := &otlpExporter{
+		conf:   conf,
+		client: &http.Client{Timeout: 10 * time.Second},
+		spans:  make(chan *span, tracingQueueSize),
+		done:   make(chan struct{}),
+		closed: make(chan struct{}),
+	}
+	go e.run()
+	slog.Info("Spans are exported", "address", conf.getURL())
+	return e
+}
+
+func (e *otlpExporter) export(s *span) {
+	select {
+	case e.spans <- s:
+	default:
+		// the collector doesn't keep up
+	}
+}
+
+func (e *otlpExporter) run() {
+	defer close(e.closed)
+	ticker := time.NewTicker(tracingFlushPeriod)
+	defer ticker.Stop()
+	var batch []*span
+	for {
+		select {
+		case s := <-e.spans:
+			batch = append(batch, s)
+			if len(batch) >= tracingBatchSize {
+				e.send(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				e.send(batch)
+				batch = nil
+			}
+		case <-e.done:
+			for {
+				select {
+				case s := <-e.spans:
+					batch = append(batch, s)
+				default:
+					if len(batch) > 0 {
+						e.send(batch)
+					}
+					return
+				}
+			}
+		}
+	}
+}
+
+func (e *otlpExporter) send(batch []*span) {
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, s := range batch {
+		spans = append(spans, s.toOTLP())
+	}
+	body, err := json.Marshal(map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{
+				"attributes": []otlpAttribute{newOTLPAttribute("service.name", e.conf.ServiceName)},
+			},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]string{"name": "proxydialer"},
+				"spans": spans,
+			}},
+		}},
+	})
+	if err != nil {
+		slog.Warn("Cannot export the spans", "err", err)
+		return
+	}
+	req, err := http.NewRequest(http.MethodPost, e.conf.getURL(), bytes.NewReader(body))
+	if err != nil {
+		slog.Warn("Cannot export the spans", "err", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range e.conf.Headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		slog.Warn("Cannot export the spans", "err", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		slog.Warn("Cannot export the spans", "status", resp.Status)
+	}
+}
+
+// Close sends the spans left
+func (e *otlpExporter) Close() error {
+	close(e.done)
+	<-e.closed
+	return nil
+}
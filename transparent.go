@@ -0,0 +1,46 @@
+package proxydialer
+
+import (
+	"context"
+	"log/slog"
+	"net"
+
+	"golang.org/x/net/proxy"
+)
+
+// handleTransparentConn forwards a redirected connection to its original destination
+func handleTransparentConn(client_conn net.Conn, dialer proxy.Dialer, tproxy bool) {
+	var address string
+	var err error
+	if tproxy {
+		// TPROXY keeps the original destination as the local address of the connection
+		address = client_conn.LocalAddr().String()
+	} else {
+		address, err = getOriginalDst(client_conn)
+	}
+	if err != nil {
+		slog.Warn("TRANSPARENT failed", "client", client_conn.RemoteAddr().String(), "err", err)
+		client_conn.Close()
+		return
+	}
+
+	slog.Info("TRANSPARENT", "client", client_conn.RemoteAddr().String(), "address", address)
+	ctx := withClientAddr(context.Background(), client_conn.RemoteAddr().String())
+	ctx, entry := newAccessEntry(ctx, "CONNECT", address, "TRANSPARENT")
+	dest_conn, err := dialTunnel(ctx, dialer, "tcp", address)
+	if err != nil {
+		slog.Warn("TRANSPARENT failed", "client", client_conn.RemoteAddr().String(), "address", address, "err", err)
+		entry.finish(getDialErrorStatus(err), 0, 0)
+		client_conn.Close()
+		return
+	}
+	entry.setUpstream(dest_conn)
+	relay(client_conn, dest_conn, entry)
+}
+
+// serveTransparent accepts redirected connections until the listener is closed
+func serveTransparent(listener net.Listener, dialer proxy.Dialer, tproxy bool) error {
+	return serveListener(listener, func(conn net.Conn) {
+		handleTransparentConn(conn, dialer, tproxy)
+	})
+}
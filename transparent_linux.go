@@ -0,0 +1,75 @@
+package proxydialer
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Option returning the destination of a connection before it was redirected by iptables
+const soOriginalDst = 80
+
+// getOriginalDst returns the destination a connection redirected by iptables REDIRECT was made to
+func getOriginalDst(conn net.Conn) (string, error) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return "", errors.New("not a TCP connection")
+	}
+	rawConn, err := tcpConn.SyscallConn()
+	if err != nil {
+		return "", err
+	}
+	var address string
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		if tcpConn.LocalAddr().(*net.TCPAddr).IP.To4() != nil {
+			// sockaddr_in fits in the 16 bytes of an ipv6_mreq
+			mreq, err := unix.GetsockoptIPv6Mreq(int(fd), unix.SOL_IP, soOriginalDst)
+			if err != nil {
+				sockErr = err
+				return
+			}
+			port := binary.BigEndian.Uint16(mreq.Multiaddr[2:4])
+			address = net.JoinHostPort(net.IP(mreq.Multiaddr[4:8]).String(), strconv.Itoa(int(port)))
+			return
+		}
+		// sockaddr_in6 fits in an ip6_mtuinfo
+		info, err := unix.GetsockoptIPv6MTUInfo(int(fd), unix.SOL_IPV6, soOriginalDst)
+		if err != nil {
+			sockErr = err
+			return
+		}
+		// the port is kept in network byte order
+		port := binary.BigEndian.Uint16(binary.NativeEndian.AppendUint16(nil, info.Addr.Port))
+		address = net.JoinHostPort(net.IP(info.Addr.Addr[:]).String(), strconv.Itoa(int(port)))
+	})
+	if err != nil {
+		return "", err
+	}
+	return address, sockErr
+}
+
+// listenTransparent listens for connections diverted by iptables TPROXY
+func listenTransparent(address string) (net.Listener, error) {
+	config := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				sockErr = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1)
+				if sockErr == nil && network == "tcp6" {
+					sockErr = unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1)
+				}
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+	return config.Listen(context.Background(), "tcp", address)
+}
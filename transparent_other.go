@@ -0,0 +1,18 @@
+//go:build !linux
+
+package proxydialer
+
+import (
+	"errors"
+	"net"
+)
+
+var errTransparentUnsupported = errors.New("transparent proxying is only supported on Linux")
+
+func getOriginalDst(conn net.Conn) (string, error) {
+	return "", errTransparentUnsupported
+}
+
+func listenTransparent(address string) (net.Listener, error) {
+	return nil, errTransparentUnsupported
+}
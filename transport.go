@@ -0,0 +1,125 @@
+package proxydialer
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/proxy"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	TRANSPORT_TCP       = "tcp"
+	TRANSPORT_WEBSOCKET = "ws"
+)
+
+// TransportConf describes the stream carrying the proxy protocol to the server
+type TransportConf struct {
+	Type    string            `yaml:"type"`
+	Path    string            `yaml:"path"`
+	Host    string            `yaml:"host"`
+	Headers map[string]string `yaml:"headers"`
+}
+
+// transportDialer connects to the proxy server, optionally wrapping the stream in TLS and WebSocket
+type transportDialer struct {
+	forward   proxy.Dialer
+	addr      string
+	tlsConfig *tls.Config
+	wsConfig  *websocket.Config
+}
+
+// newTransportDialer prepares the transport of conf, TLS is used when forceTLS is set or tls is enabled in conf.
+// The connection to the server is made through forward
+func newTransportDialer(conf ProxyConf, forceTLS bool, forward proxy.Dialer) (*transportDialer, error) {
+	dialer := &transportDialer{forward: forward, addr: conf.getProxyAddr()}
+	useTLS := forceTLS || (conf.TLS != nil && conf.TLS.Enabled)
+	if useTLS {
+		tlsConfig, err := conf.TLS.getTLSConfig(conf.getServerHost())
+		if err != nil {
+			return nil, err
+		}
+		dialer.tlsConfig = tlsConfig
+	}
+
+	transport := conf.Transport
+	if transport == nil || transport.Type == "" || transport.Type == TRANSPORT_TCP {
+		return dialer, nil
+	}
+	if transport.Type != TRANSPORT_WEBSOCKET {
+		return nil, fmt.Errorf("unsupported transport: %s", transport.Type)
+	}
+
+	scheme, origin := "ws", "http"
+	if useTLS {
+		scheme, origin = "wss", "https"
+	}
+	host := transport.Host
+	if host == "" {
+		host = conf.getProxyAddr()
+	}
+	path := transport.Path
+	if path == "" {
+		path = "/"
+	}
+	// the path may carry a query, like the early data of some servers
+	location, err := url.Parse(path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid transport path: %w", err)
+	}
+	location.Scheme, location.Host = scheme, host
+	originURL := &url.URL{Scheme: origin, Host: host, Path: "/"}
+	wsConfig, err := websocket.NewConfig(location.String(), originURL.String())
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range transport.Headers {
+		wsConfig.Header.Set(key, value)
+	}
+	dialer.wsConfig = wsConfig
+	return dialer, nil
+}
+
+func (d *transportDialer) dialContext(ctx context.Context) (net.Conn, error) {
+	conn, err := dialContext(ctx, d.forward, "tcp", d.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if d.tlsConfig != nil {
+		tlsConn := tls.Client(conn, d.tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	if d.wsConfig != nil {
+		if deadline, ok := ctx.Deadline(); ok {
+			conn.SetDeadline(deadline)
+		}
+		wsConn, err := websocket.NewClient(d.wsConfig, conn)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn.SetDeadline(time.Time{})
+		wsConn.PayloadType = websocket.BinaryFrame
+		conn = wsConn
+	}
+	return conn, nil
+}
+
+// Dial connects to the proxy server, the address is ignored so the transport can be the forward dialer of a SOCKS5 dialer
+func (d *transportDialer) Dial(network, address string) (net.Conn, error) {
+	return d.dialContext(context.Background())
+}
+
+func (d *transportDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return d.dialContext(ctx)
+}
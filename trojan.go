@@ -0,0 +1,102 @@
+package proxydialer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+
+	"golang.org/x/net/proxy"
+)
+
+const (
+	socksAddrIPv4   = 0x01
+	socksAddrDomain = 0x03
+	socksAddrIPv6   = 0x04
+)
+
+const trojanCmdConnect = 0x01
+
+// trojanDialer dials through a Trojan server: a TLS connection authenticated by a password hash
+type trojanDialer struct {
+	transport *transportDialer
+	password  string
+}
+
+// appendSocksAddr appends address in the SOCKS5 ATYP/DST.ADDR/DST.PORT form
+func appendSocksAddr(buf []byte, address string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", portStr)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			buf = append(buf, socksAddrIPv4)
+			buf = append(buf, ip4...)
+		} else {
+			buf = append(buf, socksAddrIPv6)
+			buf = append(buf, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, errors.New("host name too long: " + host)
+		}
+		buf = append(buf, socksAddrDomain, byte(len(host)))
+		buf = append(buf, host...)
+	}
+	return binary.BigEndian.AppendUint16(buf, uint16(port)), nil
+}
+
+// establishTrojanProxy prepares a dialer for the Trojan protocol
+func establishTrojanProxy(conf ProxyConf, forward proxy.Dialer) (proxy.Dialer, error) {
+	if conf.Password == "" {
+		return nil, errors.New("trojan proxy requires password")
+	}
+	transport, err := newTransportDialer(conf, true, forward)
+	if err != nil {
+		return nil, err
+	}
+	return &trojanDialer{
+		transport: transport,
+		password:  conf.Password,
+	}, nil
+}
+
+func (d *trojanDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+func (d *trojanDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
+		return nil, errors.New("trojan: unsupported network " + network)
+	}
+
+	hash := sha256.Sum224([]byte(d.password))
+	request := make([]byte, 0, 64+len(address))
+	request = hex.AppendEncode(request, hash[:])
+	request = append(request, '\r', '\n', trojanCmdConnect)
+	request, err := appendSocksAddr(request, address)
+	if err != nil {
+		return nil, err
+	}
+	request = append(request, '\r', '\n')
+
+	conn, err := d.transport.dialContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// The server does not reply to the request, data can follow immediately
+	if _, err := conn.Write(request); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
@@ -0,0 +1,210 @@
+package proxydialer
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"runtime"
+	"strconv"
+	"sync"
+
+	"golang.org/x/net/proxy"
+	"golang.zx2c4.com/wireguard/tun"
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+const (
+	DEFAULT_TUN_NAME = "proxydialer0"
+	DEFAULT_TUN_MTU  = 1500
+)
+
+const (
+	tunNICID = 1
+	// room left before packets for the headers some platforms need
+	tunOffset = 16
+	// TCP connections being established at once
+	tunMaxInFlight = 1024
+)
+
+// TunConf is a virtual network interface whose TCP connections are sent through the proxies
+type TunConf struct {
+	Enabled bool   `yaml:"enabled"`
+	Name    string `yaml:"name"`
+	MTU     int    `yaml:"mtu"`
+}
+
+// tunDevice terminates the TCP connections of a TUN device in a userspace network stack
+type tunDevice struct {
+	device tun.Device
+	stack  *stack.Stack
+	ep     *channel.Endpoint
+	cancel context.CancelFunc
+
+	mu sync.Mutex
+	// dialer is replaced when a reload keeps the device
+	dialer proxy.Dialer
+}
+
+// startTun creates the TUN device and forwards its connections through dialer
+func startTun(conf TunConf, dialer proxy.Dialer) (*tunDevice, error) {
+	name := conf.Name
+	if name == "" {
+		name = DEFAULT_TUN_NAME
+		// macOS only accepts utun interfaces
+		if runtime.GOOS == "darwin" {
+			name = "utun"
+		}
+	}
+	mtu := conf.MTU
+	if mtu <= 0 {
+		mtu = DEFAULT_TUN_MTU
+	}
+	device, err := tun.CreateTUN(name, mtu)
+	if err != nil {
+		return nil, fmt.Errorf("tun: %w", err)
+	}
+
+	t := &tunDevice{
+		device: device,
+		stack: stack.New(stack.Options{
+			NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
+			TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol},
+		}),
+		ep:     channel.New(1024, uint32(mtu), ""),
+		dialer: dialer,
+	}
+	if tcpipErr := t.stack.CreateNIC(tunNICID, t.ep); tcpipErr != nil {
+		device.Close()
+		return nil, fmt.Errorf("tun: %s", tcpipErr)
+	}
+	// accept packets to any address and answer from it
+	t.stack.SetPromiscuousMode(tunNICID, true)
+	t.stack.SetSpoofing(tunNICID, true)
+	t.stack.SetRouteTable([]tcpip.Route{
+		{Destination: header.IPv4EmptySubnet, NIC: tunNICID},
+		{Destination: header.IPv6EmptySubnet, NIC: tunNICID},
+	})
+	forwarder := tcp.NewForwarder(t.stack, 0, tunMaxInFlight, t.handleTCP)
+	t.stack.SetTransportProtocolHandler(tcp.ProtocolNumber, forwarder.HandlePacket)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.cancel = cancel
+	go t.readDevice()
+	go t.writeDevice(ctx)
+	if realName, err := device.Name(); err == nil {
+		name = realName
+	}
+	slog.Info("TUN device is up", "name", name)
+	return t, nil
+}
+
+// handleTCP dials the destination of a connection made through the device before accepting it,
+// so that unreachable destinations are refused
+func (t *tunDevice) handleTCP(r *tcp.ForwarderRequest) {
+	id := r.ID()
+	clientAddr := net.JoinHostPort(id.RemoteAddress.String(), strconv.Itoa(int(id.RemotePort)))
+	address := net.JoinHostPort(id.LocalAddress.String(), strconv.Itoa(int(id.LocalPort)))
+
+	slog.Info("TUN", "client", clientAddr, "address", address)
+	ctx := withClientAddr(context.Background(), clientAddr)
+	ctx, entry := newAccessEntry(ctx, "CONNECT", address, "TUN")
+	dest_conn, err := dialTunnel(ctx, t.getDialer(), "tcp", address)
+	if err != nil {
+		slog.Warn("TUN failed", "client", clientAddr, "address", address, "err", err)
+		entry.finish(getDialErrorStatus(err), 0, 0)
+		r.Complete(true)
+		return
+	}
+	var wq waiter.Queue
+	ep, tcpipErr := r.CreateEndpoint(&wq)
+	if tcpipErr != nil {
+		dest_conn.Close()
+		r.Complete(true)
+		return
+	}
+	r.Complete(false)
+	client_conn := gonet.NewTCPConn(&wq, ep)
+	entry.setUpstream(dest_conn)
+	relay(client_conn, dest_conn, entry)
+}
+
+// readDevice injects the packets sent to the device into the network stack
+func (t *tunDevice) readDevice() {
+	batch := t.device.BatchSize()
+	bufs := make([][]byte, batch)
+	sizes := make([]int, batch)
+	for i := range bufs {
+		bufs[i] = make([]byte, tunOffset+65535)
+	}
+	for {
+		n, err := t.device.Read(bufs, sizes, tunOffset)
+		if err != nil {
+			return
+		}
+		for i := 0; i < n; i++ {
+			packet := bufs[i][tunOffset : tunOffset+sizes[i]]
+			if len(packet) == 0 {
+				continue
+			}
+			var protocol tcpip.NetworkProtocolNumber
+			switch packet[0] >> 4 {
+			case 4:
+				protocol = header.IPv4ProtocolNumber
+			case 6:
+				protocol = header.IPv6ProtocolNumber
+			default:
+				continue
+			}
+			pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{Payload: buffer.MakeWithData(packet)})
+			t.ep.InjectInbound(protocol, pkt)
+			pkt.DecRef()
+		}
+	}
+}
+
+// writeDevice sends the packets of the network stack to the device
+func (t *tunDevice) writeDevice(ctx context.Context) {
+	for {
+		pkt := t.ep.ReadContext(ctx)
+		if pkt.IsNil() {
+			return
+		}
+		view := pkt.ToView()
+		pkt.DecRef()
+		buf := make([]byte, tunOffset+view.Size())
+		view.Read(buf[tunOffset:])
+		view.Release()
+		if _, err := t.device.Write([][]byte{buf}, tunOffset); err != nil {
+			slog.Warn("TUN write failed", "err", err)
+		}
+	}
+}
+
+func (t *tunDevice) getDialer() proxy.Dialer {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.dialer
+}
+
+func (t *tunDevice) setDialer(dialer proxy.Dialer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.dialer = dialer
+}
+
+func (t *tunDevice) Close() error {
+	t.cancel()
+	t.stack.Close()
+	t.ep.Close()
+	return t.device.Close()
+}
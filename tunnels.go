@@ -0,0 +1,156 @@
+package proxydialer
+
+import (
+	"cmp"
+	"log/slog"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+// openTunnel is a tunnel being relayed, listed by the admin API
+type openTunnel struct {
+	id          uint64
+	start       time.Time
+	client      string
+	user        string
+	target      string
+	protocol    string
+	client_conn net.Conn
+	dest_conn   net.Conn
+	// bytes received from the client and from the destination
+	received *countingReader
+	sent     *countingReader
+}
+
+type tunnelStatus struct {
+	ID       uint64  `json:"id"`
+	Client   string  `json:"client"`
+	User     string  `json:"user,omitempty"`
+	Target   string  `json:"target"`
+	Protocol string  `json:"protocol,omitempty"`
+	Upstream string  `json:"upstream,omitempty"`
+	Sent     int64   `json:"sent"`
+	Received int64   `json:"received"`
+	Age      float64 `json:"age_seconds"`
+}
+
+// tunnelRegistry keeps the open tunnels of the process, across reloads
+type tunnelRegistry struct {
+	mu      sync.Mutex
+	next    uint64
+	tunnels map[uint64]*openTunnel
+}
+
+var openTunnels = &tunnelRegistry{tunnels: make(map[uint64]*openTunnel)}
+
+// add registers a tunnel, described by its access log entry when there is one
+func (r *tunnelRegistry) add(client_conn, dest_conn net.Conn, entry *accessEntry, received, sent *countingReader) *openTunnel {
+	t := &openTunnel{
+		start:       time.Now(),
+		client:      client_conn.RemoteAddr().String(),
+		target:      dest_conn.RemoteAddr().String(),
+		client_conn: client_conn,
+		dest_conn:   dest_conn,
+		received:    received,
+		sent:        sent,
+	}
+	if entry != nil {
+		t.start = entry.start
+		t.client = entry.client
+		t.user = entry.user
+		t.target = entry.target
+		t.protocol = entry.protocol
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.next++
+	t.id = r.next
+	r.tunnels[t.id] = t
+	return t
+}
+
+func (r *tunnelRegistry) remove(t *openTunnel) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.tunnels, t.id)
+}
+
+// list returns the open tunnels, the oldest first
+func (r *tunnelRegistry) list() []tunnelStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	tunnels := make([]tunnelStatus, 0, len(r.tunnels))
+	for _, t := range r.tunnels {
+		status := tunnelStatus{
+			ID:       t.id,
+			Client:   t.client,
+			User:     t.user,
+			Target:   t.target,
+			Protocol: t.protocol,
+			Sent:     t.sent.n.Load(),
+			Received: t.received.n.Load(),
+			Age:      time.Since(t.start).Seconds(),
+		}
+		if metered, ok := getMeteredConn(t.dest_conn); ok {
+			status.Upstream = metered.upstream
+		}
+		tunnels = append(tunnels, status)
+	}
+	slices.SortFunc(tunnels, func(a, b tunnelStatus) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+	return tunnels
+}
+
+// event returns the description of the tunnel passed to the event handlers
+func (t *openTunnel) event() Tunnel {
+	tunnel := Tunnel{ID: t.id, Client: t.client, User: t.user, Target: t.target, Protocol: t.protocol, Start: t.start}
+	if metered, ok := getMeteredConn(t.dest_conn); ok {
+		tunnel.Upstream = metered.upstream
+	}
+	return tunnel
+}
+
+// lastActivity returns the time bytes were last relayed at, either way
+func (t *openTunnel) lastActivity() time.Time {
+	last := max(t.start.UnixNano(), t.received.last.Load(), t.sent.last.Load())
+	return time.Unix(0, last)
+}
+
+// closeIdle closes the tunnel once no byte was relayed for the timeout, until done is closed
+func (t *openTunnel) closeIdle(timeout time.Duration, done <-chan struct{}) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-timer.C:
+			// the bytes spliced are counted up to spliceCountInterval late
+			idle := time.Since(t.lastActivity())
+			if idle < timeout+spliceCountInterval {
+				timer.Reset(timeout + spliceCountInterval - idle)
+				continue
+			}
+			slog.Info("Idle tunnel closed", "client", t.client, "address", t.target, "idle", idle.Round(time.Second))
+			t.client_conn.Close()
+			t.dest_conn.Close()
+			return
+		}
+	}
+}
+
+// close closes both sides of a tunnel, relay finishes it, false when it isn't open
+func (r *tunnelRegistry) close(id uint64) (*openTunnel, bool) {
+	r.mu.Lock()
+	t, ok := r.tunnels[id]
+	r.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+	t.client_conn.Close()
+	t.dest_conn.Close()
+	return t, true
+}
@@ -0,0 +1,41 @@
+package proxydialer
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// listenUnix listens on a unix socket, a socket left by a previous run is removed
+// and the permissions are set from an octal mode such as "0660" when given
+func listenUnix(path, mode string) (net.Listener, error) {
+	var perm os.FileMode
+	if mode != "" {
+		value, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid socket mode %q", mode)
+		}
+		perm = os.FileMode(value) & os.ModePerm
+	}
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode().Type() != os.ModeSocket {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		os.Remove(path)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if mode != "" {
+		if err := os.Chmod(path, perm); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+	return listener, nil
+}
@@ -0,0 +1,108 @@
+package proxydialer
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+
+	"golang.org/x/net/http/httpguts"
+	"golang.org/x/net/proxy"
+)
+
+// isUpgradeRequest tells whether a plain HTTP request switches its connection to another protocol, like
+// WebSocket, the connection is then relayed like a tunnel. Upgrades to TLS origins go through CONNECT
+func isUpgradeRequest(req *http.Request) bool {
+	return req.URL.Scheme == "http" && req.Header.Get("Upgrade") != "" &&
+		httpguts.HeaderValuesContainsToken(req.Header["Connection"], "Upgrade")
+}
+
+// handleUpgrade sends the handshake of an upgrade request to the origin through the dialer, the connection
+// of the client is relayed to the origin once it switched protocols, the other responses are forwarded
+func handleUpgrade(w http.ResponseWriter, req *http.Request, dialer proxy.Dialer, headers HeadersConf) {
+	ctx, entry := newRequestAccessEntry(req)
+	port := req.URL.Port()
+	if port == "" {
+		port = "80"
+	}
+	dest_conn, err := dialTunnel(ctx, dialer, "tcp", net.JoinHostPort(req.URL.Hostname(), port))
+	if err != nil {
+		entry.finish(writeDialError(w, req, err), 0, 0)
+		return
+	}
+	entry.setUpstream(dest_conn)
+	// the upgrade is the only hop-by-hop header forwarded
+	upgrade := req.Header.Get("Upgrade")
+	req.Header = req.Header.Clone()
+	removeHopHeaders(req.Header)
+	headers.setForwardedHeaders(req)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", upgrade)
+	if _, ok := req.Header["User-Agent"]; !ok {
+		// an empty one isn't written, rather than the one of Go
+		req.Header.Set("User-Agent", "")
+	}
+	if err := req.Write(dest_conn); err != nil {
+		dest_conn.Close()
+		entry.finish(writeDialError(w, req, err), 0, 0)
+		return
+	}
+	reader := bufio.NewReader(dest_conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		dest_conn.Close()
+		entry.finish(writeDialError(w, req, err), 0, 0)
+		return
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		// the origin refused the upgrade, e.g. an authentication is required
+		defer dest_conn.Close()
+		defer resp.Body.Close()
+		removeHopHeaders(resp.Header)
+		headers.setVia(resp)
+		copyHeader(w.Header(), resp.Header)
+		w.WriteHeader(resp.StatusCode)
+		sent, _ := io.Copy(w, resp.Body)
+		entry.finish(resp.StatusCode, sent, 0)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		dest_conn.Close()
+		http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	client_conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		dest_conn.Close()
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	upgrade = resp.Header.Get("Upgrade")
+	removeHopHeaders(resp.Header)
+	headers.setVia(resp)
+	resp.Header.Set("Connection", "Upgrade")
+	resp.Header.Set("Upgrade", upgrade)
+	// the bytes the origin sent after its response, like the first WebSocket frames, were read with it
+	buffered, _ := reader.Peek(reader.Buffered())
+	_, err = fmt.Fprintf(client_conn, "HTTP/1.1 %s\r\n", resp.Status)
+	if err == nil {
+		err = resp.Header.Write(client_conn)
+	}
+	if err == nil {
+		_, err = io.WriteString(client_conn, "\r\n")
+	}
+	if err == nil {
+		_, err = client_conn.Write(buffered)
+	}
+	if err != nil {
+		slog.Warn("Upgrade failed", "client", req.RemoteAddr, "url", req.URL.String(), "err", err)
+		client_conn.Close()
+		dest_conn.Close()
+		entry.finish(http.StatusSwitchingProtocols, 0, 0)
+		return
+	}
+	relay(withBuffered(client_conn, rw.Reader), dest_conn, entry)
+}
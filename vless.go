@@ -0,0 +1,150 @@
+package proxydialer
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/proxy"
+)
+
+// Address types used by VMess and VLESS requests
+const (
+	v2rayAddrIPv4   = 0x01
+	v2rayAddrDomain = 0x02
+	v2rayAddrIPv6   = 0x03
+)
+
+const (
+	vlessVersion    = 0x00
+	vlessCmdConnect = 0x01
+)
+
+// parseUUID parses the canonical 8-4-4-4-12 textual form of a UUID
+func parseUUID(s string) ([16]byte, error) {
+	var uuid [16]byte
+	raw := strings.ReplaceAll(s, "-", "")
+	if len(s) != 36 || len(raw) != 32 {
+		return uuid, fmt.Errorf("invalid uuid %q", s)
+	}
+	if _, err := hex.Decode(uuid[:], []byte(raw)); err != nil {
+		return uuid, fmt.Errorf("invalid uuid %q", s)
+	}
+	return uuid, nil
+}
+
+// appendV2rayAddr appends address in the PORT/ATYP/ADDR form shared by VMess and VLESS
+func appendV2rayAddr(buf []byte, address string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", portStr)
+	}
+	buf = binary.BigEndian.AppendUint16(buf, uint16(port))
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			buf = append(buf, v2rayAddrIPv4)
+			return append(buf, ip4...), nil
+		}
+		buf = append(buf, v2rayAddrIPv6)
+		return append(buf, ip.To16()...), nil
+	}
+	if len(host) > 255 {
+		return nil, errors.New("host name too long: " + host)
+	}
+	buf = append(buf, v2rayAddrDomain, byte(len(host)))
+	return append(buf, host...), nil
+}
+
+// vlessDialer dials through a VLESS server
+type vlessDialer struct {
+	transport *transportDialer
+	uuid      [16]byte
+}
+
+// vlessConn skips the VLESS response header before the first read
+type vlessConn struct {
+	net.Conn
+	once sync.Once
+	err  error
+}
+
+// establishVLESSProxy prepares a dialer for the VLESS protocol
+func establishVLESSProxy(conf ProxyConf, forward proxy.Dialer) (proxy.Dialer, error) {
+	uuid, err := parseUUID(conf.UUID)
+	if err != nil {
+		return nil, err
+	}
+	transport, err := newTransportDialer(conf, false, forward)
+	if err != nil {
+		return nil, err
+	}
+	return &vlessDialer{transport: transport, uuid: uuid}, nil
+}
+
+func (d *vlessDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+func (d *vlessDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
+		return nil, errors.New("vless: unsupported network " + network)
+	}
+
+	request := make([]byte, 0, 24+len(address))
+	request = append(request, vlessVersion)
+	request = append(request, d.uuid[:]...)
+	// no addons
+	request = append(request, 0x00, vlessCmdConnect)
+	request, err := appendV2rayAddr(request, address)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := d.transport.dialContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(request); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &vlessConn{Conn: conn}, nil
+}
+
+func (c *vlessConn) readResponse() error {
+	// VERSION, ADDONS LENGTH, ADDONS
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(c.Conn, header); err != nil {
+		return err
+	}
+	if header[0] != vlessVersion {
+		return fmt.Errorf("vless: unexpected response version %d", header[0])
+	}
+	if header[1] > 0 {
+		if _, err := io.CopyN(io.Discard, c.Conn, int64(header[1])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *vlessConn) Read(b []byte) (int, error) {
+	c.once.Do(func() {
+		c.err = c.readResponse()
+	})
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.Conn.Read(b)
+}
@@ -0,0 +1,364 @@
+package proxydialer
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"hash/fnv"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/net/proxy"
+)
+
+const (
+	vmessVersion           = 0x01
+	vmessCmdTCP            = 0x01
+	vmessOptionChunkStream = 0x01
+	vmessMaxChunkSize      = 1 << 14
+	vmessCloseTimeout      = 100 * time.Millisecond
+)
+
+const (
+	vmessSecurityAES128GCM        = 0x03
+	vmessSecurityChacha20Poly1305 = 0x04
+	vmessSecurityNone             = 0x05
+)
+
+var vmessSecurities = map[string]byte{
+	"":                  vmessSecurityAES128GCM,
+	"aes-128-gcm":       vmessSecurityAES128GCM,
+	"chacha20-poly1305": vmessSecurityChacha20Poly1305,
+	"none":              vmessSecurityNone,
+}
+
+// vmessDialer dials through a VMess server using AEAD headers
+type vmessDialer struct {
+	transport *transportDialer
+	cmdKey    []byte
+	security  byte
+}
+
+// vmessConn encrypts the stream into VMess chunks and decrypts the response chunks
+type vmessConn struct {
+	net.Conn
+	security byte
+
+	writeMu    sync.Mutex
+	writeAEAD  cipher.AEAD
+	writeNonce []byte
+	writeCount uint16
+
+	readOnce  sync.Once
+	readErr   error
+	readAEAD  cipher.AEAD
+	readNonce []byte
+	readCount uint16
+	readBuf   []byte
+
+	respKey []byte
+	respIV  []byte
+	respV   byte
+}
+
+// vmessKDF is the nested HMAC-SHA256 key derivation of VMess AEAD
+func vmessKDF(key []byte, path ...string) []byte {
+	newHash := func() hash.Hash {
+		return hmac.New(sha256.New, []byte("VMess AEAD KDF"))
+	}
+	for _, p := range path {
+		parent, value := newHash, []byte(p)
+		newHash = func() hash.Hash {
+			return hmac.New(parent, value)
+		}
+	}
+	h := newHash()
+	h.Write(key)
+	return h.Sum(nil)
+}
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// newVMessChunkAEAD creates the body cipher for the security type, nil for "none"
+func newVMessChunkAEAD(security byte, key []byte) (cipher.AEAD, error) {
+	switch security {
+	case vmessSecurityAES128GCM:
+		return newAESGCM(key)
+	case vmessSecurityChacha20Poly1305:
+		first := md5.Sum(key)
+		second := md5.Sum(first[:])
+		return chacha20poly1305.New(append(first[:], second[:]...))
+	}
+	return nil, nil
+}
+
+// vmessAuthID creates the encrypted timestamp identifying the user to the server
+func vmessAuthID(cmdKey []byte) ([]byte, error) {
+	plain := make([]byte, 16)
+	binary.BigEndian.PutUint64(plain, uint64(time.Now().Unix()))
+	if _, err := rand.Read(plain[8:12]); err != nil {
+		return nil, err
+	}
+	binary.BigEndian.PutUint32(plain[12:], crc32.ChecksumIEEE(plain[:12]))
+	block, err := aes.NewCipher(vmessKDF(cmdKey, "AES Auth ID Encryption")[:16])
+	if err != nil {
+		return nil, err
+	}
+	authID := make([]byte, 16)
+	block.Encrypt(authID, plain)
+	return authID, nil
+}
+
+// sealVMessHeader encrypts the request header: AUTH ID, encrypted length, nonce, encrypted header
+func sealVMessHeader(cmdKey, header []byte) ([]byte, error) {
+	authID, err := vmessAuthID(cmdKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, 8)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	lengthAEAD, err := newAESGCM(vmessKDF(cmdKey, "VMess Header AEAD Key_Length", string(authID), string(nonce))[:16])
+	if err != nil {
+		return nil, err
+	}
+	lengthNonce := vmessKDF(cmdKey, "VMess Header AEAD Nonce_Length", string(authID), string(nonce))[:12]
+	headerAEAD, err := newAESGCM(vmessKDF(cmdKey, "VMess Header AEAD Key", string(authID), string(nonce))[:16])
+	if err != nil {
+		return nil, err
+	}
+	headerNonce := vmessKDF(cmdKey, "VMess Header AEAD Nonce", string(authID), string(nonce))[:12]
+
+	sealed := append([]byte{}, authID...)
+	sealed = lengthAEAD.Seal(sealed, lengthNonce, binary.BigEndian.AppendUint16(nil, uint16(len(header))), authID)
+	sealed = append(sealed, nonce...)
+	return headerAEAD.Seal(sealed, headerNonce, header, authID), nil
+}
+
+// establishVMessProxy prepares a dialer for the VMess protocol
+func establishVMessProxy(conf ProxyConf, forward proxy.Dialer) (proxy.Dialer, error) {
+	uuid, err := parseUUID(conf.UUID)
+	if err != nil {
+		return nil, err
+	}
+	security, ok := vmessSecurities[conf.Security]
+	if !ok {
+		return nil, fmt.Errorf("unsupported vmess security: %s", conf.Security)
+	}
+	transport, err := newTransportDialer(conf, false, forward)
+	if err != nil {
+		return nil, err
+	}
+	cmdKey := md5.Sum(append(uuid[:], []byte("c48619fe-8f02-49e0-b9e9-edf763e17e21")...))
+	return &vmessDialer{
+		transport: transport,
+		cmdKey:    cmdKey[:],
+		security:  security,
+	}, nil
+}
+
+func (d *vmessDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+func (d *vmessDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
+		return nil, errors.New("vmess: unsupported network " + network)
+	}
+
+	// request body IV, request body key, response authentication byte, padding
+	random := make([]byte, 16+16+1+16)
+	if _, err := rand.Read(random); err != nil {
+		return nil, err
+	}
+	reqIV, reqKey, respV := random[:16], random[16:32], random[32]
+	padding := random[33] % 16
+
+	header := []byte{vmessVersion}
+	header = append(header, reqIV...)
+	header = append(header, reqKey...)
+	header = append(header, respV, vmessOptionChunkStream, padding<<4|d.security, 0x00, vmessCmdTCP)
+	header, err := appendV2rayAddr(header, address)
+	if err != nil {
+		return nil, err
+	}
+	header = append(header, random[33:33+padding]...)
+	checksum := fnv.New32a()
+	checksum.Write(header)
+	header = checksum.Sum(header)
+
+	request, err := sealVMessHeader(d.cmdKey, header)
+	if err != nil {
+		return nil, err
+	}
+
+	respKey := sha256.Sum256(reqKey)
+	respIV := sha256.Sum256(reqIV)
+	c := &vmessConn{
+		security:   d.security,
+		writeNonce: append([]byte{}, reqIV[:12]...),
+		readNonce:  append([]byte{}, respIV[:12]...),
+		respKey:    respKey[:16],
+		respIV:     respIV[:16],
+		respV:      respV,
+	}
+	if c.writeAEAD, err = newVMessChunkAEAD(d.security, reqKey); err != nil {
+		return nil, err
+	}
+	if c.readAEAD, err = newVMessChunkAEAD(d.security, c.respKey); err != nil {
+		return nil, err
+	}
+
+	conn, err := d.transport.dialContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(request); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c.Conn = conn
+	return c, nil
+}
+
+func (c *vmessConn) chunkNonce(nonce []byte, count uint16) []byte {
+	binary.BigEndian.PutUint16(nonce, count)
+	return nonce
+}
+
+func (c *vmessConn) writeChunk(payload []byte) error {
+	var chunk []byte
+	if c.writeAEAD != nil {
+		size := len(payload) + c.writeAEAD.Overhead()
+		chunk = binary.BigEndian.AppendUint16(make([]byte, 0, 2+size), uint16(size))
+		chunk = c.writeAEAD.Seal(chunk, c.chunkNonce(c.writeNonce, c.writeCount), payload, nil)
+		c.writeCount++
+	} else {
+		chunk = binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(payload)), uint16(len(payload)))
+		chunk = append(chunk, payload...)
+	}
+	_, err := c.Conn.Write(chunk)
+	return err
+}
+
+func (c *vmessConn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	written := 0
+	for written < len(b) {
+		// an empty chunk marks the end of the stream, it is never produced here
+		end := min(written+vmessMaxChunkSize, len(b))
+		if err := c.writeChunk(b[written:end]); err != nil {
+			return written, err
+		}
+		written = end
+	}
+	return written, nil
+}
+
+// readResponseHeader checks the AEAD response header sent before the first chunk
+func (c *vmessConn) readResponseHeader() error {
+	lengthAEAD, err := newAESGCM(vmessKDF(c.respKey, "AEAD Resp Header Len Key")[:16])
+	if err != nil {
+		return err
+	}
+	lengthNonce := vmessKDF(c.respIV, "AEAD Resp Header Len IV")[:12]
+	sealedLength := make([]byte, 2+lengthAEAD.Overhead())
+	if _, err := io.ReadFull(c.Conn, sealedLength); err != nil {
+		return err
+	}
+	length, err := lengthAEAD.Open(nil, lengthNonce, sealedLength, nil)
+	if err != nil {
+		return fmt.Errorf("vmess: response header: %w", err)
+	}
+
+	headerAEAD, err := newAESGCM(vmessKDF(c.respKey, "AEAD Resp Header Key")[:16])
+	if err != nil {
+		return err
+	}
+	headerNonce := vmessKDF(c.respIV, "AEAD Resp Header IV")[:12]
+	sealedHeader := make([]byte, int(binary.BigEndian.Uint16(length))+headerAEAD.Overhead())
+	if _, err := io.ReadFull(c.Conn, sealedHeader); err != nil {
+		return err
+	}
+	header, err := headerAEAD.Open(nil, headerNonce, sealedHeader, nil)
+	if err != nil {
+		return fmt.Errorf("vmess: response header: %w", err)
+	}
+	if len(header) < 4 || header[0] != c.respV {
+		return errors.New("vmess: unexpected response header")
+	}
+	return nil
+}
+
+func (c *vmessConn) readChunk() error {
+	sizeBuf := make([]byte, 2)
+	if _, err := io.ReadFull(c.Conn, sizeBuf); err != nil {
+		return err
+	}
+	chunk := make([]byte, binary.BigEndian.Uint16(sizeBuf))
+	if _, err := io.ReadFull(c.Conn, chunk); err != nil {
+		return err
+	}
+	if c.readAEAD != nil {
+		payload, err := c.readAEAD.Open(chunk[:0], c.chunkNonce(c.readNonce, c.readCount), chunk, nil)
+		if err != nil {
+			return fmt.Errorf("vmess: %w", err)
+		}
+		c.readCount++
+		chunk = payload
+	}
+	if len(chunk) == 0 {
+		return io.EOF
+	}
+	c.readBuf = chunk
+	return nil
+}
+
+func (c *vmessConn) Read(b []byte) (int, error) {
+	c.readOnce.Do(func() {
+		c.readErr = c.readResponseHeader()
+	})
+	if c.readErr != nil {
+		return 0, c.readErr
+	}
+	if len(c.readBuf) == 0 {
+		if err := c.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, c.readBuf)
+	c.readBuf = c.readBuf[n:]
+	return n, nil
+}
+
+// Close tells the server the request stream is over, unless a Write is still blocked, which only closing
+// the connection stops, and gives up on it after vmessCloseTimeout when the server doesn't read
+func (c *vmessConn) Close() error {
+	if c.writeMu.TryLock() {
+		c.Conn.SetWriteDeadline(time.Now().Add(vmessCloseTimeout))
+		c.writeChunk(nil)
+		c.writeMu.Unlock()
+	}
+	return c.Conn.Close()
+}
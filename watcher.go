@@ -0,0 +1,157 @@
+package proxydialer
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Time without a modification after which the watched files are reloaded, the events of a save come in bursts
+const CONFIG_WATCH_DELAY = 200 * time.Millisecond
+
+// watchedFile is the state of a watched file compared on every event of its directory, the file is replaced
+// when it is saved by a rename or when the target of a symbolic link changes, like a Kubernetes ConfigMap
+type watchedFile struct {
+	target  string
+	modTime time.Time
+	size    int64
+	mode    os.FileMode
+}
+
+func statWatchedFile(path string) watchedFile {
+	var file watchedFile
+	file.target, _ = filepath.EvalSymlinks(path)
+	if info, err := os.Stat(path); err == nil {
+		file.modTime, file.size, file.mode = info.ModTime(), info.Size(), info.Mode()
+	}
+	return file
+}
+
+// configWatcher signals notify when watched files are modified, replaced, removed or created again, it watches
+// their directories since the watch of a file is lost when the file is replaced
+type configWatcher struct {
+	watcher *fsnotify.Watcher
+	notify  chan int
+	closed  chan struct{}
+	once    sync.Once
+	mu      sync.Mutex
+	files   map[string]watchedFile
+	// directories whose files are all watched, like the included ones
+	dirs     map[string]bool
+	timer    *time.Timer
+	modified string
+}
+
+func newConfigWatcher(notify chan int) (*configWatcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	w := &configWatcher{watcher: watcher, notify: notify, closed: make(chan struct{})}
+	go w.run()
+	return w, nil
+}
+
+// watch replaces the watched paths, files and directories
+func (w *configWatcher) watch(paths []string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	files := make(map[string]watchedFile)
+	dirs := make(map[string]bool)
+	watched := make(map[string]bool)
+	for _, path := range paths {
+		path, err := filepath.Abs(path)
+		if err != nil {
+			return err
+		}
+		if info, err := os.Stat(path); err == nil && info.IsDir() {
+			dirs[path] = true
+			watched[path] = true
+			continue
+		}
+		files[path] = statWatchedFile(path)
+		watched[filepath.Dir(path)] = true
+	}
+	w.files, w.dirs = files, dirs
+	for _, path := range w.watcher.WatchList() {
+		if !watched[path] {
+			w.watcher.Remove(path)
+		}
+	}
+	var errs []error
+	for path := range watched {
+		if err := w.watcher.Add(path); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (w *configWatcher) run() {
+	for {
+		select {
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			w.handle(event)
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			slog.Error("Watch file error", "err", err)
+		}
+	}
+}
+
+// handle schedules the notification when an event modified a watched file, the other files of their
+// directories are ignored, and the notification is delayed until the events stop
+func (w *configWatcher) handle(event fsnotify.Event) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	name := filepath.Clean(event.Name)
+	modified := ""
+	if w.dirs[filepath.Dir(name)] && event.Op != fsnotify.Chmod {
+		modified = name
+	}
+	// a watched file or the symbolic links it goes through are replaced by another file of its directory
+	for path, file := range w.files {
+		if filepath.Dir(path) != filepath.Dir(name) {
+			continue
+		}
+		if current := statWatchedFile(path); current != file {
+			w.files[path] = current
+			modified = path
+		}
+	}
+	if modified == "" {
+		return
+	}
+	w.modified = modified
+	if w.timer == nil {
+		w.timer = time.AfterFunc(CONFIG_WATCH_DELAY, w.fire)
+	} else {
+		w.timer.Reset(CONFIG_WATCH_DELAY)
+	}
+}
+
+func (w *configWatcher) fire() {
+	w.mu.Lock()
+	modified := w.modified
+	w.mu.Unlock()
+	slog.Info("Modified file", "file", modified)
+	select {
+	case w.notify <- 1:
+	case <-w.closed:
+	}
+}
+
+func (w *configWatcher) Close() error {
+	w.once.Do(func() { close(w.closed) })
+	return w.watcher.Close()
+}
@@ -0,0 +1,158 @@
+package proxydialer
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+
+	"golang.org/x/net/proxy"
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun/netstack"
+)
+
+const DEFAULT_WIREGUARD_MTU = 1420
+
+var defaultWireGuardDNS = []string{"1.1.1.1"}
+
+type WireGuardConf struct {
+	PrivateKey   string   `yaml:"private_key" secret:"true"`
+	PublicKey    string   `yaml:"public_key"`
+	PresharedKey string   `yaml:"preshared_key" secret:"true"`
+	Address      []string `yaml:"address"`
+	DNS          []string `yaml:"dns"`
+	MTU          int      `yaml:"mtu"`
+	Keepalive    int      `yaml:"keepalive"`
+}
+
+// wireguardDialer dials through a userspace WireGuard tunnel backed by a netstack
+type wireguardDialer struct {
+	device *device.Device
+	tnet   *netstack.Net
+}
+
+// wireguardKeyToHex converts a base64 encoded key, as used by wg-quick configs, to the hex form of the UAPI
+func wireguardKeyToHex(key string) (string, error) {
+	raw, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return "", err
+	}
+	if len(raw) != 32 {
+		return "", errors.New("key must be 32 bytes long")
+	}
+	return hex.EncodeToString(raw), nil
+}
+
+func parseWireGuardAddrs(values []string) ([]netip.Addr, error) {
+	addrs := make([]netip.Addr, 0, len(values))
+	for _, value := range values {
+		if prefix, err := netip.ParsePrefix(value); err == nil {
+			addrs = append(addrs, prefix.Addr())
+			continue
+		}
+		addr, err := netip.ParseAddr(value)
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+// getWireGuardIpcConfig builds the UAPI configuration of the device with a single peer
+func getWireGuardIpcConfig(conf ProxyConf) (string, error) {
+	wgConf := conf.WireGuard
+	privateKey, err := wireguardKeyToHex(wgConf.PrivateKey)
+	if err != nil {
+		return "", fmt.Errorf("wireguard private_key: %w", err)
+	}
+	publicKey, err := wireguardKeyToHex(wgConf.PublicKey)
+	if err != nil {
+		return "", fmt.Errorf("wireguard public_key: %w", err)
+	}
+	endpoint, err := net.ResolveUDPAddr("udp", conf.getProxyAddr())
+	if err != nil {
+		return "", err
+	}
+
+	var ipc strings.Builder
+	fmt.Fprintf(&ipc, "private_key=%s\n", privateKey)
+	fmt.Fprintf(&ipc, "public_key=%s\n", publicKey)
+	if wgConf.PresharedKey != "" {
+		presharedKey, err := wireguardKeyToHex(wgConf.PresharedKey)
+		if err != nil {
+			return "", fmt.Errorf("wireguard preshared_key: %w", err)
+		}
+		fmt.Fprintf(&ipc, "preshared_key=%s\n", presharedKey)
+	}
+	fmt.Fprintf(&ipc, "endpoint=%s\n", endpoint.String())
+	if wgConf.Keepalive > 0 {
+		fmt.Fprintf(&ipc, "persistent_keepalive_interval=%d\n", wgConf.Keepalive)
+	}
+	ipc.WriteString("allowed_ip=0.0.0.0/0\n")
+	ipc.WriteString("allowed_ip=::/0\n")
+	return ipc.String(), nil
+}
+
+// establishWireGuardProxy brings up a userspace WireGuard tunnel to the configured peer
+func establishWireGuardProxy(conf ProxyConf) (proxy.Dialer, error) {
+	if conf.WireGuard == nil {
+		return nil, errors.New("wireguard proxy requires wireguard section")
+	}
+	addresses, err := parseWireGuardAddrs(conf.WireGuard.Address)
+	if err != nil {
+		return nil, fmt.Errorf("wireguard address: %w", err)
+	}
+	if len(addresses) == 0 {
+		return nil, errors.New("wireguard proxy requires at least one address")
+	}
+	dnsServers := conf.WireGuard.DNS
+	if len(dnsServers) == 0 {
+		dnsServers = defaultWireGuardDNS
+	}
+	dns, err := parseWireGuardAddrs(dnsServers)
+	if err != nil {
+		return nil, fmt.Errorf("wireguard dns: %w", err)
+	}
+	mtu := conf.WireGuard.MTU
+	if mtu == 0 {
+		mtu = DEFAULT_WIREGUARD_MTU
+	}
+	ipc, err := getWireGuardIpcConfig(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	tunDevice, tnet, err := netstack.CreateNetTUN(addresses, dns, mtu)
+	if err != nil {
+		return nil, err
+	}
+	dev := device.NewDevice(tunDevice, conn.NewDefaultBind(), device.NewLogger(device.LogLevelError, "wireguard: "))
+	if err := dev.IpcSet(ipc); err != nil {
+		dev.Close()
+		return nil, err
+	}
+	if err := dev.Up(); err != nil {
+		dev.Close()
+		return nil, err
+	}
+	return &wireguardDialer{device: dev, tnet: tnet}, nil
+}
+
+func (d *wireguardDialer) Dial(network, address string) (net.Conn, error) {
+	return d.tnet.Dial(network, address)
+}
+
+func (d *wireguardDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return d.tnet.DialContext(ctx, network, address)
+}
+
+func (d *wireguardDialer) Close() error {
+	d.device.Close()
+	return nil
+}